@@ -27,6 +27,7 @@ var (
 			subcmdRestart,
 			subcmdFlushQueues,
 			subcmdLogging,
+			subcmdMaintenance,
 		},
 	}
 	subcmdShutdown = cli.Command{
@@ -49,6 +50,31 @@ var (
 		},
 		Action: runRestart,
 	}
+	subcmdMaintenance = cli.Command{
+		Name:  "maintenance",
+		Usage: "Switch the maintenance mode of the running process until it is restarted",
+		Subcommands: []cli.Command{
+			{
+				Name:  "on",
+				Usage: "Answer requests with 503 Service Unavailable, except for the health checks, the metrics and the MAINTENANCE_BYPASS_IPS",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name: "debug",
+					},
+				},
+				Action: runMaintenanceOn,
+			}, {
+				Name:  "off",
+				Usage: "Answer requests as usual again",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name: "debug",
+					},
+				},
+				Action: runMaintenanceOff,
+			},
+		},
+	}
 	subcmdFlushQueues = cli.Command{
 		Name:   "flush-queues",
 		Usage:  "Flush queues in the running process",
@@ -127,6 +153,15 @@ var (
 					},
 				},
 				Action: runReleaseReopenLogging,
+			}, {
+				Name:  "reload-access-log-template",
+				Usage: "Cause Gitea to read the ACCESS_LOG_TEMPLATE from app.ini again",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name: "debug",
+					},
+				},
+				Action: runReloadAccessLogTemplate,
 			}, {
 				Name:      "remove",
 				Usage:     "Remove a logger",
@@ -405,6 +440,26 @@ func runRestart(c *cli.Context) error {
 	return nil
 }
 
+func runMaintenanceOn(c *cli.Context) error {
+	return setMaintenanceMode(c, true)
+}
+
+func runMaintenanceOff(c *cli.Context) error {
+	return setMaintenanceMode(c, false)
+}
+
+func setMaintenanceMode(c *cli.Context, enabled bool) error {
+	setup("manager", c.Bool("debug"))
+	statusCode, msg := private.SetMaintenanceMode(enabled)
+	switch statusCode {
+	case http.StatusInternalServerError:
+		fail("InternalServerError", msg)
+	}
+
+	fmt.Fprintln(os.Stdout, msg)
+	return nil
+}
+
 func runFlushQueues(c *cli.Context) error {
 	setup("manager", c.Bool("debug"))
 	statusCode, msg := private.FlushQueues(c.Duration("timeout"), c.Bool("non-blocking"))
@@ -452,3 +507,15 @@ func runReleaseReopenLogging(c *cli.Context) error {
 	fmt.Fprintln(os.Stdout, msg)
 	return nil
 }
+
+func runReloadAccessLogTemplate(c *cli.Context) error {
+	setup("manager", c.Bool("debug"))
+	statusCode, msg := private.ReloadAccessLogTemplate()
+	switch statusCode {
+	case http.StatusInternalServerError:
+		fail("InternalServerError", msg)
+	}
+
+	fmt.Fprintln(os.Stdout, msg)
+	return nil
+}
@@ -72,6 +72,16 @@ func runHTTPRedirector() {
 	}
 }
 
+func runMetricsListener() {
+	log.Info("Serving the metrics and health checks on %s", setting.Metrics.ListenAddress)
+
+	var err = runHTTP("tcp", setting.Metrics.ListenAddress, routes.NewMonitoringChi())
+
+	if err != nil {
+		log.Fatal("Failed to start the metrics listener: %v", err)
+	}
+}
+
 func runLetsEncrypt(listenAddr, domain, directory, email string, m http.Handler) error {
 	certManager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
@@ -168,6 +178,13 @@ func runWeb(ctx *cli.Context) error {
 	// Set up Macaron
 	c := routes.NewChi()
 	routes.RegisterRoutes(c)
+	if setting.Metrics.ListenAddress != "" {
+		go runMetricsListener()
+	} else {
+		NoMetricsListener()
+	}
+	routes.MarkStartupComplete()
+	graceful.GetManager().RunAtShutdown(graceful.GetManager().HammerContext(), routes.BeginShutdown)
 
 	err := listen(c, true)
 	<-graceful.GetManager().Done()
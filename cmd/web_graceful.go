@@ -43,6 +43,12 @@ func NoInstallListener() {
 	graceful.GetManager().InformCleanup()
 }
 
+// NoMetricsListener tells our cleanup routine that we will not be using a possibly provided listener
+// for the metrics and health checks
+func NoMetricsListener() {
+	graceful.GetManager().InformCleanup()
+}
+
 func runFCGI(network, listenAddr string, m http.Handler) error {
 	// This needs to handle stdin as fcgi point
 	fcgiServer := graceful.NewServer(network, listenAddr)
@@ -36,7 +36,7 @@ func (repo *Repository) generateRandomAvatar(e Engine) error {
 
 	repo.Avatar = idToString
 
-	if err := storage.SaveFrom(storage.RepoAvatars, repo.CustomAvatarRelativePath(), func(w io.Writer) error {
+	if err := storage.SaveFromWithFilename(storage.RepoAvatars, repo.CustomAvatarRelativePath(), repo.Name+".png", func(w io.Writer) error {
 		if err := png.Encode(w, img); err != nil {
 			log.Error("Encode: %v", err)
 		}
@@ -143,7 +143,7 @@ func (repo *Repository) UploadAvatar(data []byte) error {
 		return fmt.Errorf("UploadAvatar: Update repository avatar: %v", err)
 	}
 
-	if err := storage.SaveFrom(storage.RepoAvatars, repo.CustomAvatarRelativePath(), func(w io.Writer) error {
+	if err := storage.SaveFromWithFilename(storage.RepoAvatars, repo.CustomAvatarRelativePath(), repo.Name+".png", func(w io.Writer) error {
 		if err := png.Encode(w, *m); err != nil {
 			log.Error("Encode: %v", err)
 		}
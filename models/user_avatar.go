@@ -44,7 +44,7 @@ func (u *User) generateRandomAvatar(e Engine) error {
 		u.Avatar = base.HashEmail(u.AvatarEmail)
 	}
 
-	if err := storage.SaveFrom(storage.Avatars, u.CustomAvatarRelativePath(), func(w io.Writer) error {
+	if err := storage.SaveFromWithFilename(storage.Avatars, u.CustomAvatarRelativePath(), u.Name+".png", func(w io.Writer) error {
 		if err := png.Encode(w, img); err != nil {
 			log.Error("Encode: %v", err)
 		}
@@ -137,7 +137,7 @@ func (u *User) UploadAvatar(data []byte) error {
 		return fmt.Errorf("updateUser: %v", err)
 	}
 
-	if err := storage.SaveFrom(storage.Avatars, u.CustomAvatarRelativePath(), func(w io.Writer) error {
+	if err := storage.SaveFromWithFilename(storage.Avatars, u.CustomAvatarRelativePath(), u.Name+".png", func(w io.Writer) error {
 		if err := png.Encode(w, *m); err != nil {
 			log.Error("Encode: %v", err)
 		}
@@ -27,8 +27,15 @@ func IsAPIPath(url string) bool {
 // SignedInUser returns the user object of signed user.
 // It returns a bool value to indicate whether user uses basic auth or not.
 func SignedInUser(ctx *macaron.Context, sess session.Store) (*models.User, bool) {
+	user, method := SignedInUserWithMethod(ctx, sess)
+	return user, method == "basic"
+}
+
+// SignedInUserWithMethod returns the user object of signed user along with the name of the SSO method
+// the user signed in with, e.g. "session", "token" or "basic", or "" if nobody is signed in.
+func SignedInUserWithMethod(ctx *macaron.Context, sess session.Store) (*models.User, string) {
 	if !models.HasEngine {
-		return nil, false
+		return nil, ""
 	}
 
 	// Try to sign in with each of the enabled plugins
@@ -38,12 +45,11 @@ func SignedInUser(ctx *macaron.Context, sess session.Store) (*models.User, bool)
 		}
 		user := ssoMethod.VerifyAuthData(ctx, sess)
 		if user != nil {
-			_, isBasic := ssoMethod.(*sso.Basic)
-			return user, isBasic
+			return user, ssoMethod.Name()
 		}
 	}
 
-	return nil, false
+	return nil, ""
 }
 
 // Form form binding interface
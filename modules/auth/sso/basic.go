@@ -39,6 +39,11 @@ func (b *Basic) Free() error {
 	return nil
 }
 
+// Name returns "basic" for the credentials, or a token, sent with HTTP basic authentication
+func (b *Basic) Name() string {
+	return "basic"
+}
+
 // IsEnabled returns true as this plugin is enabled by default and its not possible to disable
 // it from settings.
 func (b *Basic) IsEnabled() bool {
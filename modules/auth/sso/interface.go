@@ -24,6 +24,9 @@ type SingleSignOn interface {
 	// IsEnabled checks if the current SSO method has been enabled in settings.
 	IsEnabled() bool
 
+	// Name returns the name of the method, which is logged as how a request authenticated.
+	Name() string
+
 	// VerifyAuthData tries to verify the SSO authentication data contained in the request.
 	// If verification is successful returns either an existing user object (with id > 0)
 	// or a new user object (with id = 0) populated with the information that was found
@@ -6,6 +6,7 @@
 package sso
 
 import (
+	"net/http"
 	"strings"
 	"time"
 
@@ -62,16 +63,16 @@ func (o *OAuth2) Free() error {
 	return nil
 }
 
-// userIDFromToken returns the user id corresponding to the OAuth token.
-func (o *OAuth2) userIDFromToken(ctx *macaron.Context) int64 {
-	// Check access token.
-	tokenSHA := ctx.Query("token")
+// tokenFromRequest returns the access or OAuth token of a request from its query parameters, looked up with
+// query, or its "Authorization" header, or "" if it has none.
+func tokenFromRequest(query func(string) string, header http.Header) string {
+	tokenSHA := query("token")
 	if len(tokenSHA) == 0 {
-		tokenSHA = ctx.Query("access_token")
+		tokenSHA = query("access_token")
 	}
 	if len(tokenSHA) == 0 {
 		// Well, check with header again.
-		auHead := ctx.Req.Header.Get("Authorization")
+		auHead := header.Get("Authorization")
 		if len(auHead) > 0 {
 			auths := strings.Fields(auHead)
 			if len(auths) == 2 && (auths[0] == "token" || strings.ToLower(auths[0]) == "bearer") {
@@ -79,6 +80,37 @@ func (o *OAuth2) userIDFromToken(ctx *macaron.Context) int64 {
 			}
 		}
 	}
+	return tokenSHA
+}
+
+// VerifiedTokenUserID returns the id of the user of the access or OAuth token the request carries, or 0 if
+// it carries none or it is not valid. Unlike the OAuth2 plugin it can be used before the request has reached
+// macaron, and it does not mark the token as used.
+func VerifiedTokenUserID(req *http.Request) int64 {
+	if !models.HasEngine {
+		return 0
+	}
+	tokenSHA := tokenFromRequest(req.URL.Query().Get, req.Header)
+	if len(tokenSHA) == 0 {
+		return 0
+	}
+	if strings.Contains(tokenSHA, ".") {
+		return CheckOAuthAccessToken(tokenSHA)
+	}
+	t, err := models.GetAccessTokenBySHA(tokenSHA)
+	if err != nil {
+		if !models.IsErrAccessTokenNotExist(err) && !models.IsErrAccessTokenEmpty(err) {
+			log.Error("GetAccessTokenBySHA: %v", err)
+		}
+		return 0
+	}
+	return t.UID
+}
+
+// userIDFromToken returns the user id corresponding to the OAuth token.
+func (o *OAuth2) userIDFromToken(ctx *macaron.Context) int64 {
+	// Check access token.
+	tokenSHA := tokenFromRequest(ctx.Query, ctx.Req.Header)
 	if len(tokenSHA) == 0 {
 		return 0
 	}
@@ -106,6 +138,11 @@ func (o *OAuth2) userIDFromToken(ctx *macaron.Context) int64 {
 	return t.UID
 }
 
+// Name returns "token" for the access and OAuth2 tokens
+func (o *OAuth2) Name() string {
+	return "token"
+}
+
 // IsEnabled returns true as this plugin is enabled by default and its not possible
 // to disable it from settings.
 func (o *OAuth2) IsEnabled() bool {
@@ -49,6 +49,11 @@ func (r *ReverseProxy) Free() error {
 	return nil
 }
 
+// Name returns "reverse_proxy" for the user name sent by the reverse proxy
+func (r *ReverseProxy) Name() string {
+	return "reverse_proxy"
+}
+
 // IsEnabled checks if EnableReverseProxyAuth setting is true
 func (r *ReverseProxy) IsEnabled() bool {
 	return setting.Service.EnableReverseProxyAuth
@@ -31,6 +31,11 @@ func (s *Session) Free() error {
 	return nil
 }
 
+// Name returns "session" for the user ID stored in the session
+func (s *Session) Name() string {
+	return "session"
+}
+
 // IsEnabled returns true as this plugin is enabled by default and its not possible to disable
 // it from settings.
 func (s *Session) IsEnabled() bool {
@@ -55,6 +55,11 @@ func (s *SSPI) Free() error {
 	return sspiAuth.Free()
 }
 
+// Name returns "sspi" for SSPI authentication
+func (s *SSPI) Name() string {
+	return "sspi"
+}
+
 // IsEnabled checks if there is an active SSPI authentication source
 func (s *SSPI) IsEnabled() bool {
 	return models.IsSSPIEnabled()
@@ -0,0 +1,51 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// The decisions a cache layer can record for a response
+const (
+	StatusHit    = "hit"
+	StatusMiss   = "miss"
+	StatusStale  = "stale"
+	StatusBypass = "bypass"
+)
+
+type statusContextKey struct{}
+
+// statusRecorder holds the cache decision recorded for a request
+type statusRecorder struct {
+	lock   sync.Mutex
+	status string
+}
+
+// WithStatusRecorder returns a context in which cache layers can record their decision with SetStatus
+func WithStatusRecorder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statusContextKey{}, &statusRecorder{})
+}
+
+// SetStatus records the cache decision for the request of the context, it does nothing if the context
+// has no recorder. The decision of the last cache layer to record one wins.
+func SetStatus(ctx context.Context, status string) {
+	if r, ok := ctx.Value(statusContextKey{}).(*statusRecorder); ok {
+		r.lock.Lock()
+		r.status = status
+		r.lock.Unlock()
+	}
+}
+
+// GetStatus returns the cache decision recorded for the request of the context, or "" if there is none
+func GetStatus(ctx context.Context) string {
+	if r, ok := ctx.Value(statusContextKey{}).(*statusRecorder); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.status
+	}
+	return ""
+}
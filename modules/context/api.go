@@ -91,6 +91,10 @@ func (ctx *APIContext) Error(status int, title string, obj interface{}) {
 		}
 	}
 
+	if WantsProblemDetails(ctx.Req.Request) {
+		WriteProblemDetails(ctx.Resp, ctx.Req.Request, status, message)
+		return
+	}
 	ctx.JSON(status, APIError{
 		Message: message,
 		URL:     setting.API.SwaggerURL,
@@ -107,6 +111,10 @@ func (ctx *APIContext) InternalServerError(err error) {
 		message = err.Error()
 	}
 
+	if WantsProblemDetails(ctx.Req.Request) {
+		WriteProblemDetails(ctx.Resp, ctx.Req.Request, http.StatusInternalServerError, message)
+		return
+	}
 	ctx.JSON(http.StatusInternalServerError, APIError{
 		Message: message,
 		URL:     setting.API.SwaggerURL,
@@ -253,6 +261,10 @@ func (ctx *APIContext) NotFound(objs ...interface{}) {
 		}
 	}
 
+	if WantsProblemDetails(ctx.Req.Request) {
+		WriteProblemDetails(ctx.Resp, ctx.Req.Request, http.StatusNotFound, strings.Join(append([]string{message}, errors...), ": "))
+		return
+	}
 	ctx.JSON(404, map[string]interface{}{
 		"message":           message,
 		"documentation_url": setting.API.SwaggerURL,
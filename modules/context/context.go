@@ -20,6 +20,7 @@ import (
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/timing"
 	"code.gitea.io/gitea/modules/util"
 
 	"gitea.com/macaron/cache"
@@ -137,6 +138,7 @@ func (ctx *Context) RedirectToFirst(location ...string) {
 // HTML calls Context.HTML and converts template name to string.
 func (ctx *Context) HTML(status int, name base.TplName) {
 	log.Debug("Template: %s", name)
+	defer timing.Start(ctx.Req.Context(), timing.PhaseRender)()
 	ctx.Context.HTML(status, string(name))
 }
 
@@ -229,6 +231,7 @@ func (ctx *Context) ServeContent(name string, r io.ReadSeeker, params ...interfa
 // Contexter initializes a classic context for a request.
 func Contexter() macaron.Handler {
 	return func(c *macaron.Context, l i18n.Locale, cache cache.Cache, sess session.Store, f *session.Flash, x csrf.CSRF) {
+		SetRoute(c.Req.Context(), c.Req.URL.EscapedPath(), c.AllParams())
 		ctx := &Context{
 			Context: c,
 			Cache:   cache,
@@ -303,9 +306,14 @@ func Contexter() macaron.Handler {
 		}
 
 		// Get user from session if logged in.
-		ctx.User, ctx.IsBasicAuth = auth.SignedInUser(ctx.Context, ctx.Session)
+		stopAuthTiming := timing.Start(ctx.Req.Context(), timing.PhaseAuth)
+		var authMethod string
+		ctx.User, authMethod = auth.SignedInUserWithMethod(ctx.Context, ctx.Session)
+		ctx.IsBasicAuth = authMethod == "basic"
+		stopAuthTiming()
 
 		if ctx.User != nil {
+			SetIdentity(ctx.Req.Context(), ctx.User.Name, authMethod)
 			ctx.IsSigned = true
 			ctx.Data["IsSigned"] = ctx.IsSigned
 			ctx.Data["SignedUser"] = ctx.User
@@ -0,0 +1,46 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package context
+
+import (
+	gocontext "context"
+	"sync"
+)
+
+type identityContextKey struct{}
+
+// identityRecorder holds the signed in user of a request and how they authenticated
+type identityRecorder struct {
+	lock       sync.Mutex
+	name       string
+	authMethod string
+}
+
+// WithIdentityRecorder returns a context in which the signed in user of the request is recorded once they have
+// been authenticated, so that middlewares wrapping the macaron routes can get them with GetIdentity
+func WithIdentityRecorder(ctx gocontext.Context) gocontext.Context {
+	return gocontext.WithValue(ctx, identityContextKey{}, &identityRecorder{})
+}
+
+// SetIdentity records the signed in user of the request of the context, it does nothing if the context has no
+// recorder
+func SetIdentity(ctx gocontext.Context, name, authMethod string) {
+	if r, ok := ctx.Value(identityContextKey{}).(*identityRecorder); ok {
+		r.lock.Lock()
+		r.name, r.authMethod = name, authMethod
+		r.lock.Unlock()
+	}
+}
+
+// GetIdentity returns the name of the signed in user of the request of the context and the SSO method they
+// authenticated with, e.g. "session", "token" or "basic", or empty strings if nobody is signed in
+func GetIdentity(ctx gocontext.Context) (name, authMethod string) {
+	if r, ok := ctx.Value(identityContextKey{}).(*identityRecorder); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.name, r.authMethod
+	}
+	return "", ""
+}
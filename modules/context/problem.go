@@ -0,0 +1,54 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package context
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// ProblemDetailsContentType is the media type of ProblemDetails
+const ProblemDetailsContentType = "application/problem+json"
+
+// ProblemDetails is an error response as per RFC 7807
+type ProblemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// WantsProblemDetails returns whether the client accepts ProblemDetails and the request is below one of the
+// path prefixes of setting.ProblemDetailsPaths, so that its errors should be sent as ProblemDetails
+func WantsProblemDetails(req *http.Request) bool {
+	if !strings.Contains(req.Header.Get("Accept"), ProblemDetailsContentType) {
+		return false
+	}
+	for _, prefix := range setting.ProblemDetailsPaths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteProblemDetails responds with an error as ProblemDetails
+func WriteProblemDetails(w http.ResponseWriter, req *http.Request, status int, detail string) {
+	body, _ := json.Marshal(ProblemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: req.URL.RequestURI(),
+	})
+	w.Header().Set("Content-Type", ProblemDetailsContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
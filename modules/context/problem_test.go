@@ -0,0 +1,48 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package context
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemDetails(t *testing.T) {
+	defer func(paths []string) {
+		setting.ProblemDetailsPaths = paths
+	}(setting.ProblemDetailsPaths)
+	setting.ProblemDetailsPaths = []string{"/api/"}
+
+	req := httptest.NewRequest("GET", "/api/v1/repos/user2/missing?token=1", nil)
+	assert.False(t, WantsProblemDetails(req))
+	req.Header.Set("Accept", "application/problem+json, application/json")
+	assert.True(t, WantsProblemDetails(req))
+
+	resp := httptest.NewRecorder()
+	WriteProblemDetails(resp, req, http.StatusNotFound, "repository does not exist")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+
+	var problem ProblemDetails
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &problem))
+	assert.Equal(t, ProblemDetails{
+		Type:     "about:blank",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "repository does not exist",
+		Instance: "/api/v1/repos/user2/missing?token=1",
+	}, problem)
+
+	// other route groups keep their usual errors
+	req = httptest.NewRequest("GET", "/user2/missing", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	assert.False(t, WantsProblemDetails(req))
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package context
+
+import (
+	gocontext "context"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitea.com/macaron/macaron"
+)
+
+type routeContextKey struct{}
+
+// routeRecorder holds the macaron route handling a request and its parameters
+type routeRecorder struct {
+	lock    sync.Mutex
+	pattern string
+	params  map[string]string
+}
+
+// WithRouteRecorder returns a context in which the macaron route handling the request is recorded once it has
+// been matched, so that middlewares wrapping the macaron routes can get it with GetRoute
+func WithRouteRecorder(ctx gocontext.Context) gocontext.Context {
+	return gocontext.WithValue(ctx, routeContextKey{}, &routeRecorder{})
+}
+
+// SetRoute records the macaron route of the request of the context from its escaped path and the parameters
+// macaron matched, it does nothing if the context has no recorder
+func SetRoute(ctx gocontext.Context, escapedPath string, params macaron.Params) {
+	r, ok := ctx.Value(routeContextKey{}).(*routeRecorder)
+	if !ok {
+		return
+	}
+	pattern, resource := routePattern(escapedPath, params)
+	r.lock.Lock()
+	r.pattern, r.params = pattern, resource
+	r.lock.Unlock()
+}
+
+// GetRoute returns the pattern of the macaron route handling the request of the context, e.g.
+// "/:username/:reponame/settings", and its parameters by name, or "" and nil if no macaron route was matched
+func GetRoute(ctx gocontext.Context) (pattern string, params map[string]string) {
+	if r, ok := ctx.Value(routeContextKey{}).(*routeRecorder); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.pattern, r.params
+	}
+	return "", nil
+}
+
+// routePattern rebuilds the pattern of a macaron route from the path it matched and its parameters, as macaron
+// does not keep the pattern of the matched route. The path segments holding a parameter are replaced by its name
+// and the path matched by a wildcard by "*".
+func routePattern(escapedPath string, params macaron.Params) (string, map[string]string) {
+	if len(params) == 0 {
+		return escapedPath, nil
+	}
+
+	resource := make(map[string]string, len(params))
+	names := make([]string, 0, len(params))
+	for key, value := range params {
+		if strings.HasPrefix(key, ":") {
+			names = append(names, key)
+			resource[key[1:]] = value
+		}
+	}
+	// the parameters are assigned to the segments in a stable order if several have the same value
+	sort.Strings(names)
+
+	pattern := escapedPath
+	suffix := ""
+	if splat := params["*"]; splat != "" && strings.HasSuffix(pattern, "/"+splat) {
+		resource["*"] = splat
+		pattern = strings.TrimSuffix(pattern, "/"+splat)
+		suffix = "/*"
+	}
+
+	segments := strings.Split(pattern, "/")
+	used := make(map[string]bool, len(names))
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		for _, name := range names {
+			if !used[name] && params[name] == segment {
+				segments[i] = name
+				used[name] = true
+				break
+			}
+		}
+	}
+	if len(resource) == 0 {
+		resource = nil
+	}
+	return strings.Join(segments, "/") + suffix, resource
+}
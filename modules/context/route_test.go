@@ -0,0 +1,50 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package context
+
+import (
+	gocontext "context"
+	"testing"
+
+	"gitea.com/macaron/macaron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteRecorder(t *testing.T) {
+	ctx := WithRouteRecorder(gocontext.Background())
+	pattern, params := GetRoute(ctx)
+	assert.Empty(t, pattern)
+	assert.Nil(t, params)
+
+	SetRoute(ctx, "/user2/repo1/issues/1/comments", macaron.Params{":username": "user2", ":reponame": "repo1", ":index": "1"})
+	pattern, params = GetRoute(ctx)
+	assert.Equal(t, "/:username/:reponame/issues/:index/comments", pattern)
+	assert.Equal(t, map[string]string{"username": "user2", "reponame": "repo1", "index": "1"}, params)
+
+	// without a recorder nothing is recorded
+	SetRoute(gocontext.Background(), "/user/settings", nil)
+	pattern, _ = GetRoute(gocontext.Background())
+	assert.Empty(t, pattern)
+}
+
+func TestRoutePattern(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		params   macaron.Params
+		pattern  string
+		resource map[string]string
+	}{
+		{"/user/settings", nil, "/user/settings", nil},
+		{"/api/v1/repos/user2/repo1", macaron.Params{":username": "user2", ":reponame": "repo1"}, "/api/v1/repos/:username/:reponame", map[string]string{"username": "user2", "reponame": "repo1"}},
+		// the values are matched against whole segments only
+		{"/user2/user2-repo/settings", macaron.Params{":username": "user2", ":reponame": "user2-repo"}, "/:username/:reponame/settings", map[string]string{"username": "user2", "reponame": "user2-repo"}},
+		{"/user2/repo1/raw/branch/master/docs/README.md", macaron.Params{":username": "user2", ":reponame": "repo1", "*": "branch/master/docs/README.md", "*0": "branch/master/docs/README.md"}, "/:username/:reponame/raw/*", map[string]string{"username": "user2", "reponame": "repo1", "*": "branch/master/docs/README.md"}},
+		{"/user2/repo%20x/settings", macaron.Params{":username": "user2", ":reponame": "repo%20x"}, "/:username/:reponame/settings", map[string]string{"username": "user2", "reponame": "repo%20x"}},
+	} {
+		pattern, resource := routePattern(tc.path, tc.params)
+		assert.Equal(t, tc.pattern, pattern, tc.path)
+		assert.Equal(t, tc.resource, resource, tc.path)
+	}
+}
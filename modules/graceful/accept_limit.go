@@ -0,0 +1,76 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package graceful
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// acceptLimiterIdleTime is the time after which the limiter of an address without new connections is dropped
+const acceptLimiterIdleTime = time.Minute
+
+// acceptRateLimiter limits the rate of new connections from each remote address
+type acceptRateLimiter struct {
+	limit     rate.Limit
+	burst     int
+	lock      sync.Mutex
+	limiters  map[string]*addressLimiter
+	nextSweep time.Time
+}
+
+type addressLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// newAcceptRateLimiter returns a limiter allowing limit new connections per second from each address,
+// or nil if limit is 0 or less and connections are not limited
+func newAcceptRateLimiter(limit float64) *acceptRateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	return &acceptRateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*addressLimiter),
+	}
+}
+
+// allow returns whether a new connection from addr is within the limit
+func (l *acceptRateLimiter) allow(addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.After(l.nextSweep) {
+		for key, limiter := range l.limiters {
+			if now.Sub(limiter.lastSeen) > acceptLimiterIdleTime {
+				delete(l.limiters, key)
+			}
+		}
+		l.nextSweep = now.Add(acceptLimiterIdleTime)
+	}
+
+	limiter, ok := l.limiters[host]
+	if !ok {
+		limiter = &addressLimiter{Limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[host] = limiter
+	}
+	limiter.lastSeen = now
+	return limiter.AllowN(now, 1)
+}
@@ -20,9 +20,13 @@ import (
 )
 
 var (
-	// DefaultReadTimeOut default read timeout
+	// DefaultReadTimeOut default read timeout, used if READ_TIMEOUT is not set
+	//
+	// Deprecated: set READ_TIMEOUT in the [server] section instead
 	DefaultReadTimeOut time.Duration
-	// DefaultWriteTimeOut default write timeout
+	// DefaultWriteTimeOut default write timeout, used if WRITE_TIMEOUT is not set
+	//
+	// Deprecated: set WRITE_TIMEOUT in the [server] section instead
 	DefaultWriteTimeOut time.Duration
 	// DefaultMaxHeaderBytes default max header bytes
 	DefaultMaxHeaderBytes int
@@ -45,6 +49,8 @@ type Server struct {
 	lock        *sync.RWMutex
 	BeforeBegin func(network, address string)
 	OnShutdown  func()
+
+	acceptLimiter *acceptRateLimiter
 }
 
 // NewServer creates a server on network at provided address
@@ -201,21 +207,30 @@ func newWrappedListener(l net.Listener, srv *Server) *wrappedListener {
 
 func (wl *wrappedListener) Accept() (net.Conn, error) {
 	var c net.Conn
-	// Set keepalive on TCPListeners connections.
-	if tcl, ok := wl.Listener.(*net.TCPListener); ok {
-		tc, err := tcl.AcceptTCP()
-		if err != nil {
-			return nil, err
+	for {
+		// Set keepalive on TCPListeners connections.
+		if tcl, ok := wl.Listener.(*net.TCPListener); ok {
+			tc, err := tcl.AcceptTCP()
+			if err != nil {
+				return nil, err
+			}
+			_ = tc.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
+			_ = tc.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
+			c = tc
+		} else {
+			var err error
+			c, err = wl.Listener.Accept()
+			if err != nil {
+				return nil, err
+			}
 		}
-		_ = tc.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
-		_ = tc.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
-		c = tc
-	} else {
-		var err error
-		c, err = wl.Listener.Accept()
-		if err != nil {
-			return nil, err
+
+		if wl.server.acceptLimiter == nil || wl.server.acceptLimiter.allow(c.RemoteAddr()) {
+			break
 		}
+		// Close connections beyond the rate limit of their address straight away
+		log.Debug("Rejecting connection from %s: too many new connections", c.RemoteAddr())
+		_ = c.Close()
 	}
 
 	closed := int32(0)
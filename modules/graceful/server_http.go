@@ -5,17 +5,61 @@
 package graceful
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-func newHTTPServer(network, address string, handler http.Handler) (*Server, ServeFunction) {
+// connContextKey is the context key of the connection a request was received on
+type connContextKey struct{}
+
+// ConnContext records c in the contexts of the requests received on it, so that RequestConn can return it. It is the
+// http.Server ConnContext of the servers.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// RequestConn returns the connection the request of ctx was received on, or nil if it is not known, e.g. to change
+// its deadlines
+func RequestConn(ctx context.Context) net.Conn {
+	c, _ := ctx.Value(connContextKey{}).(net.Conn)
+	return c
+}
+
+// newHTTPServer creates the server, if enableH2C is set cleartext HTTP/2 connections, either from clients with prior
+// knowledge or upgraded from HTTP/1.1, are accepted alongside HTTP/1.1
+func newHTTPServer(network, address string, handler http.Handler, enableH2C bool) (*Server, ServeFunction) {
 	server := NewServer(network, address)
+	server.acceptLimiter = newAcceptRateLimiter(setting.ConnectionRateLimit)
+	maxHeaderBytes := DefaultMaxHeaderBytes
+	if setting.MaxHeaderBytes > 0 {
+		maxHeaderBytes = setting.MaxHeaderBytes
+	}
+	readTimeout := setting.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeOut
+	}
+	writeTimeout := setting.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeOut
+	}
+	if enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
 	httpServer := http.Server{
-		ReadTimeout:    DefaultReadTimeOut,
-		WriteTimeout:   DefaultWriteTimeOut,
-		MaxHeaderBytes: DefaultMaxHeaderBytes,
-		Handler:        handler,
+		ReadHeaderTimeout: setting.ReadHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       setting.IdleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		Handler:           handler,
+		ConnContext:       ConnContext,
 	}
 	server.OnShutdown = func() {
 		httpServer.SetKeepAlivesEnabled(false)
@@ -26,20 +70,20 @@ func newHTTPServer(network, address string, handler http.Handler) (*Server, Serv
 // HTTPListenAndServe listens on the provided network address and then calls Serve
 // to handle requests on incoming connections.
 func HTTPListenAndServe(network, address string, handler http.Handler) error {
-	server, lHandler := newHTTPServer(network, address, handler)
+	server, lHandler := newHTTPServer(network, address, handler, setting.EnableH2C)
 	return server.ListenAndServe(lHandler)
 }
 
 // HTTPListenAndServeTLS listens on the provided network address and then calls Serve
 // to handle requests on incoming connections.
 func HTTPListenAndServeTLS(network, address, certFile, keyFile string, handler http.Handler) error {
-	server, lHandler := newHTTPServer(network, address, handler)
+	server, lHandler := newHTTPServer(network, address, handler, false)
 	return server.ListenAndServeTLS(certFile, keyFile, lHandler)
 }
 
 // HTTPListenAndServeTLSConfig listens on the provided network address and then calls Serve
 // to handle requests on incoming connections.
 func HTTPListenAndServeTLSConfig(network, address string, tlsConfig *tls.Config, handler http.Handler) error {
-	server, lHandler := newHTTPServer(network, address, handler)
+	server, lHandler := newHTTPServer(network, address, handler, false)
 	return server.ListenAndServeTLSConfig(tlsConfig, lHandler)
 }
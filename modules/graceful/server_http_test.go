@@ -0,0 +1,112 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package graceful
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTPServerH2C(t *testing.T) {
+	var protoMajor int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protoMajor = req.ProtoMajor
+		w.WriteHeader(http.StatusOK)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, serve := newHTTPServer("tcp", listener.Addr().String(), handler, true)
+	go func() {
+		_ = serve(listener)
+	}()
+	defer listener.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	resp, err := client.Get("http://" + listener.Addr().String() + "/")
+	assert.NoError(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+	}
+	assert.Equal(t, 2, protoMajor)
+
+	// HTTP/1.1 clients are still served
+	resp, err = http.Get("http://" + listener.Addr().String() + "/")
+	assert.NoError(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, 1, protoMajor)
+
+	// as are those upgrading an HTTP/1.1 connection
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"))
+	assert.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status := make([]byte, len("HTTP/1.1 101"))
+	_, err = io.ReadFull(conn, status)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(status), "HTTP/1.1 101"), string(status))
+}
+
+func TestAcceptRateLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &Server{lock: &sync.RWMutex{}, acceptLimiter: newAcceptRateLimiter(2)}
+	wl := newWrappedListener(listener, srv)
+	defer wl.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := wl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	// the connections within the limit are accepted, the rest are closed by the server
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		conns = append(conns, c)
+	}
+	for _, c := range conns[2:] {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	assert.Len(t, accepted, 2)
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	for len(accepted) > 0 {
+		_ = (<-accepted).Close()
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +37,9 @@ type FileLogger struct {
 	Maxdays       int64 `json:"maxdays"`
 	dailyOpenDate int
 
+	// Number of rotated files to keep, 0 keeps them all
+	MaxBackups int `json:"maxbackups"`
+
 	Rotate bool `json:"rotate"`
 
 	Compress         bool `json:"compress"`
@@ -98,6 +102,7 @@ func NewFileLogger() LoggerProvider {
 //	"maxsize":1<<30,
 //	"daily":true,
 //	"maxdays":15,
+//	"maxbackups":10,
 //	"rotate":true
 //	}
 func (log *FileLogger) Init(config string) error {
@@ -225,6 +230,7 @@ func compressOldLogFile(fname string, compressionLevel int) error {
 
 func (log *FileLogger) deleteOldLog() {
 	dir := filepath.Dir(log.Filename)
+	defer log.deleteExcessBackups()
 	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) (returnErr error) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -244,6 +250,25 @@ func (log *FileLogger) deleteOldLog() {
 	})
 }
 
+// deleteExcessBackups deletes the oldest rotated files beyond the MaxBackups newest
+func (log *FileLogger) deleteExcessBackups() {
+	if log.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(log.Filename + ".*")
+	if err != nil || len(backups) <= log.MaxBackups {
+		return
+	}
+	// the rotated files are named after their date and number, and compressing them only adds a suffix,
+	// so sorting them by name sorts them by age
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i], ".gz") > strings.TrimSuffix(backups[j], ".gz")
+	})
+	for _, backup := range backups[log.MaxBackups:] {
+		_ = util.Remove(backup)
+	}
+}
+
 // Flush flush file logger.
 // there are no buffering messages in file logger in memory.
 // flush file means sync file from disk.
@@ -244,3 +244,44 @@ func TestCompressOldFile(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, original, data)
 }
+
+func TestFileLoggerMaxBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestFileLoggerMaxBackups")
+	assert.NoError(t, err)
+	defer util.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "access.log")
+	fileLogger := NewFileLogger()
+	realFileLogger, ok := fileLogger.(*FileLogger)
+	assert.Equal(t, true, ok)
+	assert.NoError(t, fileLogger.Init(fmt.Sprintf("{\"filename\":\"%s\",\"maxbackups\":2,\"compress\":false}", filepath.ToSlash(filename))))
+	defer fileLogger.Close()
+	assert.Equal(t, 2, realFileLogger.MaxBackups)
+
+	backups := []string{
+		filename + ".2019-01-12.001.gz",
+		filename + ".2019-01-13.001",
+		filename + ".2019-01-13.002.gz",
+		filename + ".2019-01-14.001",
+	}
+	for _, backup := range backups {
+		assert.NoError(t, ioutil.WriteFile(backup, []byte("old"), 0666))
+	}
+	other := filepath.Join(tmpDir, "gitea.log.2019-01-12.001")
+	assert.NoError(t, ioutil.WriteFile(other, []byte("old"), 0666))
+
+	realFileLogger.deleteOldLog()
+
+	for i, backup := range backups {
+		_, err := os.Stat(backup)
+		if i < 2 {
+			assert.True(t, os.IsNotExist(err), backup)
+		} else {
+			assert.NoError(t, err, backup)
+		}
+	}
+	_, err = os.Stat(filename)
+	assert.NoError(t, err)
+	_, err = os.Stat(other)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,19 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NotFoundRequests counts the requests for routes that do not exist, by the first segment of their path, e.g. api,
+// or other for a segment that is not the start of any route, such as what scanners probe for
+var NotFoundRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: namespace + "http_not_found_total",
+		Help: "Number of requests answered with 404 Not Found by the routes",
+	},
+	[]string{"prefix"},
+)
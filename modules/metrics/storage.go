@@ -0,0 +1,19 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StorageBytesServed counts the bytes of the objects sent from the storages, by the prefix of their routes,
+// e.g. avatars. Objects served directly by the storage are not counted, as their size is not looked up just for this.
+var StorageBytesServed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: namespace + "storage_bytes_served_total",
+		Help: "Number of bytes served from the storages",
+	},
+	[]string{"prefix"},
+)
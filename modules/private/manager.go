@@ -137,6 +137,46 @@ func ReleaseReopenLogging() (int, string) {
 	return http.StatusOK, "Logging Restarted"
 }
 
+// SetMaintenanceMode switches the maintenance mode on or off
+func SetMaintenanceMode(enabled bool) (int, string) {
+	mode, msg := "off", "Maintenance Mode Off"
+	if enabled {
+		mode, msg = "on", "Maintenance Mode On"
+	}
+	reqURL := setting.LocalURL + "api/internal/manager/maintenance/" + mode
+
+	req := newInternalRequest(reqURL, "POST")
+	resp, err := req.Response()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Unable to contact gitea: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, decodeJSONError(resp).Err
+	}
+
+	return http.StatusOK, msg
+}
+
+// ReloadAccessLogTemplate reloads the ACCESS_LOG_TEMPLATE from app.ini
+func ReloadAccessLogTemplate() (int, string) {
+	reqURL := setting.LocalURL + "api/internal/manager/reload-access-log-template"
+
+	req := newInternalRequest(reqURL, "POST")
+	resp, err := req.Response()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Unable to contact gitea: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, decodeJSONError(resp).Err
+	}
+
+	return http.StatusOK, "Access Log Template Reloaded"
+}
+
 // LoggerOptions represents the options for the add logger call
 type LoggerOptions struct {
 	Group  string
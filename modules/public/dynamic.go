@@ -8,6 +8,11 @@ package public
 
 import "net/http"
 
+// CheckAssets returns an error if the assets are missing from dir, the `public` directory below STATIC_ROOT_PATH
+func CheckAssets(dir string) error {
+	return checkAssetsDir(dir)
+}
+
 // Static implements the macaron static handler for serving assets.
 func Static(opts *Options) func(next http.Handler) http.Handler {
 	return opts.staticHandler(opts.Directory)
@@ -8,12 +8,15 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"code.gitea.io/gitea/modules/cache"
 	"code.gitea.io/gitea/modules/setting"
 )
 
@@ -25,8 +28,17 @@ type Options struct {
 	// if set to true, will enable caching. Expires header will also be set to
 	// expire after the defined time.
 	ExpiresAfter time.Duration
-	FileSystem   http.FileSystem
-	Prefix       string
+	// if set, files for which it returns true are cached as immutable, which
+	// should only be used for files whose name changes with their content.
+	Immutable func(file string) bool
+	// if set to true, a ".br" or ".gz" file next to the requested file is
+	// served instead to clients accepting that encoding.
+	Precompressed bool
+	// if set, answers the requests for missing files under the known entries
+	// of the `public` directory instead of an empty 404.
+	NotFound   http.Handler
+	FileSystem http.FileSystem
+	Prefix     string
 }
 
 // KnownPublicEntries list all direct children in the `public` directory
@@ -38,6 +50,29 @@ var KnownPublicEntries = []string{
 	"vendor",
 }
 
+// expectedAssetDirs are the directories of the `public` directory without which Gitea cannot be used
+var expectedAssetDirs = []string{"css", "img", "js"}
+
+// checkAssetsDir returns an error if the directory or any of expectedAssetDirs in it is missing
+func checkAssetsDir(dir string) error {
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	var missing []string
+	for _, name := range expectedAssetDirs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s lacks %s", dir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // Custom implements the macaron static handler for serving custom assets.
 func Custom(opts *Options) func(next http.Handler) http.Handler {
 	return opts.staticHandler(path.Join(setting.CustomPath, "public"))
@@ -119,7 +154,11 @@ func (opts *Options) handle(w http.ResponseWriter, req *http.Request, opt *Optio
 			}
 			for _, entry := range KnownPublicEntries {
 				if entry == parts[1] {
-					w.WriteHeader(404)
+					if opts.NotFound != nil {
+						opts.NotFound.ServeHTTP(w, req)
+					} else {
+						w.WriteHeader(404)
+					}
 					return true
 				}
 			}
@@ -154,6 +193,17 @@ func (opts *Options) handle(w http.ResponseWriter, req *http.Request, opt *Optio
 		}
 	}
 
+	if opt.Precompressed {
+		// the response depends on the encodings the client accepts whether or not a variant is served
+		w.Header().Add("Vary", "Accept-Encoding")
+		if cf, cfi, encoding := opt.openPrecompressed(req, file); cf != nil {
+			defer cf.Close()
+			f, fi = cf, cfi
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(file)))
+		}
+	}
+
 	if !opt.SkipLogging {
 		log.Println("[Static] Serving " + file)
 	}
@@ -161,18 +211,83 @@ func (opts *Options) handle(w http.ResponseWriter, req *http.Request, opt *Optio
 	// Add an Expires header to the static content
 	if opt.ExpiresAfter > 0 {
 		w.Header().Set("Expires", time.Now().Add(opt.ExpiresAfter).UTC().Format(http.TimeFormat))
+		cacheControl := fmt.Sprintf("public, max-age=%d", int64(opt.ExpiresAfter.Seconds()))
+		if opt.Immutable != nil && opt.Immutable(file) {
+			cacheControl += ", immutable"
+		}
+		w.Header().Set("Cache-Control", cacheControl)
 		tag := GenerateETag(fmt.Sprint(fi.Size()), fi.Name(), fi.ModTime().UTC().Format(http.TimeFormat))
 		w.Header().Set("ETag", tag)
 		if req.Header.Get("If-None-Match") == tag {
+			cache.SetStatus(req.Context(), cache.StatusHit)
 			w.WriteHeader(304)
 			return true
 		}
+		cache.SetStatus(req.Context(), cache.StatusMiss)
+	} else {
+		cache.SetStatus(req.Context(), cache.StatusBypass)
 	}
 
 	http.ServeContent(w, req, file, fi.ModTime(), f)
 	return true
 }
 
+// precompressedExtensions are the extensions of the precompressed variants of a file by their encoding,
+// in order of preference
+var precompressedExtensions = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptsEncoding returns whether an Accept-Encoding header accepts the encoding, i.e. lists it or "*"
+// without a quality of 0
+func acceptsEncoding(header, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		name, params := part, ""
+		if idx := strings.IndexByte(part, ';'); idx >= 0 {
+			name, params = part[:idx], part[idx+1:]
+		}
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		params = strings.ReplaceAll(params, " ", "")
+		zero := strings.HasPrefix(params, "q=0") && strings.Trim(params[len("q=0"):], ".0") == ""
+		if strings.EqualFold(name, encoding) {
+			// an explicit entry takes precedence over "*"
+			return !zero
+		}
+		accepted = !zero
+	}
+	return accepted
+}
+
+// openPrecompressed opens the precompressed variant of a file the client accepts the encoding of. Only files
+// of a known content type are served precompressed, so that the type is not sniffed from the compressed data.
+func (opts *Options) openPrecompressed(req *http.Request, file string) (http.File, os.FileInfo, string) {
+	if mime.TypeByExtension(path.Ext(file)) == "" {
+		return nil, nil, ""
+	}
+	header := req.Header.Get("Accept-Encoding")
+	for _, variant := range precompressedExtensions {
+		if !acceptsEncoding(header, variant.encoding) {
+			continue
+		}
+		f, err := opts.FileSystem.Open(file + variant.ext)
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, fi, variant.encoding
+	}
+	return nil, nil, ""
+}
+
 // GenerateETag generates an ETag based on size, filename and file modification time
 func GenerateETag(fileSize, fileName, modTime string) string {
 	etag := fileSize + fileName + modTime
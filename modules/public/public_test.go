@@ -0,0 +1,116 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package public
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticHandlerCacheControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "public")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"index.js", "index.0123abcd.js"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("alert(1)"), 0644))
+	}
+
+	handler := StaticHandler(dir, &Options{
+		SkipLogging:  true,
+		ExpiresAfter: 24 * time.Hour,
+		Immutable: func(file string) bool {
+			return strings.Count(file, ".") > 1
+		},
+	})(http.NotFoundHandler())
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/index.js", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "public, max-age=86400", resp.Header().Get("Cache-Control"))
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/index.0123abcd.js", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "public, max-age=86400, immutable", resp.Header().Get("Cache-Control"))
+
+	// without an expiry nothing is cached
+	handler = StaticHandler(dir, &Options{SkipLogging: true})(http.NotFoundHandler())
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/index.0123abcd.js", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Cache-Control"))
+}
+
+func TestStaticHandlerPrecompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "public")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"index.js":     "alert(1)",
+		"index.js.br":  "brotli",
+		"index.js.gz":  "gzip",
+		"style.css":    "body{}",
+		"style.css.gz": "gzip",
+		"LICENSE":      "MIT",
+		"LICENSE.gz":   "gzip",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	handler := StaticHandler(dir, &Options{SkipLogging: true, ExpiresAfter: time.Hour, Precompressed: true})(http.NotFoundHandler())
+	serve := func(file, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", file, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "Accept-Encoding", resp.Header().Get("Vary"))
+		return resp
+	}
+
+	for _, tc := range []struct {
+		file, acceptEncoding, encoding, body string
+	}{
+		{"/index.js", "gzip, deflate, br", "br", "brotli"},
+		{"/index.js", "gzip", "gzip", "gzip"},
+		{"/index.js", "br;q=0, gzip;q=0.5", "gzip", "gzip"},
+		{"/index.js", "*", "br", "brotli"},
+		{"/index.js", "*, br;q=0", "gzip", "gzip"},
+		{"/index.js", "gzip;q=0.0, br;q=0", "", "alert(1)"},
+		{"/index.js", "", "", "alert(1)"},
+		{"/style.css", "br, gzip", "gzip", "gzip"},
+		// without a known content type the original is served
+		{"/LICENSE", "gzip", "", "MIT"},
+	} {
+		resp := serve(tc.file, tc.acceptEncoding)
+		assert.Equal(t, tc.encoding, resp.Header().Get("Content-Encoding"), "%s with %q", tc.file, tc.acceptEncoding)
+		assert.Equal(t, tc.body, resp.Body.String(), "%s with %q", tc.file, tc.acceptEncoding)
+	}
+
+	resp := serve("/style.css", "gzip")
+	assert.Equal(t, "text/css; charset=utf-8", resp.Header().Get("Content-Type"))
+	// the variants are cached separately
+	assert.NotEqual(t, serve("/style.css", "").Header().Get("ETag"), resp.Header().Get("ETag"))
+
+	// without the option the variants are left alone
+	handler = StaticHandler(dir, &Options{SkipLogging: true})(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/index.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Vary"))
+	assert.Equal(t, "alert(1)", rec.Body.String())
+}
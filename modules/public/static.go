@@ -11,6 +11,11 @@ import (
 	"net/http"
 )
 
+// CheckAssets always returns nil, as the assets are built into the binary
+func CheckAssets(dir string) error {
+	return nil
+}
+
 // Static implements the macaron static handler for serving assets.
 func Static(opts *Options) func(next http.Handler) http.Handler {
 	opts.FileSystem = Assets
@@ -16,6 +16,7 @@ import (
 
 	"code.gitea.io/gitea/modules/log"
 
+	"github.com/unknwon/com"
 	ini "gopkg.in/ini.v1"
 )
 
@@ -184,6 +185,7 @@ func generateLogConfig(sec *ini.Section, name string, defaults defaultLogOptions
 		logConfig["maxsize"] = 1 << uint(sec.Key("MAX_SIZE_SHIFT").MustInt(28))
 		logConfig["daily"] = sec.Key("DAILY_ROTATE").MustBool(true)
 		logConfig["maxdays"] = sec.Key("MAX_DAYS").MustInt(7)
+		logConfig["maxbackups"] = sec.Key("MAX_BACKUPS").MustInt(0)
 		logConfig["compress"] = sec.Key("COMPRESS").MustBool(true)
 		logConfig["compressionLevel"] = sec.Key("COMPRESSION_LEVEL").MustInt(-1)
 	case "conn":
@@ -254,6 +256,30 @@ func generateNamedLogger(key string, options defaultLogOptions) *LogDescription
 	return &description
 }
 
+// generateSectionLogger creates the named logger key with a single sublogger configured by sec, rather than
+// one for each of the modes listed in [log]. The sublogger writes to a file unless sec sets another MODE.
+func generateSectionLogger(key string, sec *ini.Section, options defaultLogOptions) *LogDescription {
+	description := LogDescription{
+		Name: key,
+	}
+
+	provider, config, levelName := generateLogConfig(sec, "file", options)
+	if err := log.NewNamedLogger(key, options.bufferLength, key, provider, config); err != nil {
+		log.Error("Could not create new named logger: %v", err.Error())
+	}
+
+	description.SubLogDescriptions = append(description.SubLogDescriptions, SubLogDescription{
+		Name:     key,
+		Provider: provider,
+		Config:   config,
+	})
+	log.Info("%s Log: %s(%s:%s)", strings.Title(key), strings.Title(key), provider, levelName)
+
+	AddLogDescription(key, &description)
+
+	return &description
+}
+
 func newMacaronLogService() {
 	options := newDefaultLogOptions()
 	options.filename = filepath.Join(LogRootPath, "macaron.log")
@@ -265,17 +291,65 @@ func newMacaronLogService() {
 	}
 }
 
+// defaultAccessLogTemplate is the ACCESS_LOG_TEMPLATE used if none is set
+const defaultAccessLogTemplate = `{{.ClientIP}} - {{.Identity}} {{.Start.Format "[02/Jan/2006:15:04:05 -0700]" }} "{{.Method}} {{.RequestURI}} {{.Proto}}" {{.ResponseWriter.Status}} {{.ResponseWriter.Size}} "{{.Referer}}" "{{.UserAgent}}"`
+
+// defaultAccessLogTimeFormat is the ACCESS_LOG_TIME_FORMAT used if none is set, the date of the NCSA log formats
+const defaultAccessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// ReadAccessLogTemplate reads the ACCESS_LOG_TEMPLATE from the custom config again, so that the access log
+// can be changed without a restart
+func ReadAccessLogTemplate() (string, error) {
+	cfg := ini.Empty()
+	if com.IsFile(CustomConf) {
+		if err := cfg.Append(CustomConf); err != nil {
+			return "", fmt.Errorf("failed to load custom conf '%s': %v", CustomConf, err)
+		}
+	}
+	return cfg.Section("log").Key("ACCESS_LOG_TEMPLATE").MustString(defaultAccessLogTemplate), nil
+}
+
 func newAccessLogService() {
 	EnableAccessLog = Cfg.Section("log").Key("ENABLE_ACCESS_LOG").MustBool(false)
-	AccessLogTemplate = Cfg.Section("log").Key("ACCESS_LOG_TEMPLATE").MustString(
-		`{{.Ctx.RemoteAddr}} - {{.Identity}} {{.Start.Format "[02/Jan/2006:15:04:05 -0700]" }} "{{.Ctx.Req.Method}} {{.Ctx.Req.URL.RequestURI}} {{.Ctx.Req.Proto}}" {{.ResponseWriter.Status}} {{.ResponseWriter.Size}} "{{.Ctx.Req.Referer}}\" \"{{.Ctx.Req.UserAgent}}"`)
+	AccessLogTemplate = Cfg.Section("log").Key("ACCESS_LOG_TEMPLATE").MustString(defaultAccessLogTemplate)
+	AccessLogFormat = strings.ToLower(Cfg.Section("log").Key("ACCESS_LOG_FORMAT").MustString(""))
+	switch AccessLogFormat {
+	case "", "combined", "common":
+	default:
+		log.Fatal("Invalid ACCESS_LOG_FORMAT %q: must be empty, combined or common", AccessLogFormat)
+	}
+	Cfg.Section("log").Key("ACCESS_LOG_EXCLUDE_PATHS").MustString("/api/healthz")
+	AccessLogExcludePaths = Cfg.Section("log").Key("ACCESS_LOG_EXCLUDE_PATHS").Strings(",")
+	AccessLogTraceStartPaths = Cfg.Section("log").Key("ACCESS_LOG_TRACE_START_PATHS").Strings(",")
+	AccessLogTimeFormat = Cfg.Section("log").Key("ACCESS_LOG_TIME_FORMAT").MustString(defaultAccessLogTimeFormat)
+	AccessLogUseUTC = Cfg.Section("log").Key("ACCESS_LOG_USE_UTC").MustBool(false)
 	Cfg.Section("log").Key("ACCESS").MustString("file")
 	if EnableAccessLog {
 		options := newDefaultLogOptions()
 		options.filename = filepath.Join(LogRootPath, "access.log")
 		options.flags = "" // For the router we don't want any prefixed flags
 		options.bufferLength = Cfg.Section("log").Key("BUFFER_LEN").MustInt64(10000)
-		generateNamedLogger("access", options)
+		// [log.access] configures a sink of its own for the access log, e.g. a file with its own rotation,
+		// otherwise the access log is configured like the other named loggers
+		if sec, err := Cfg.GetSection("log.access"); err == nil {
+			generateSectionLogger("access", sec, options)
+		} else {
+			generateNamedLogger("access", options)
+		}
+	}
+}
+
+func newAuditLogService() {
+	EnableAuditLog = Cfg.Section("log").Key("ENABLE_AUDIT_LOG").MustBool(false)
+	Cfg.Section("log").Key("AUDIT_LOG_PATHS").MustString("/**")
+	AuditLogPaths = Cfg.Section("log").Key("AUDIT_LOG_PATHS").Strings(",")
+	Cfg.Section("log").Key("AUDIT").MustString("file")
+	if EnableAuditLog {
+		options := newDefaultLogOptions()
+		options.filename = filepath.Join(LogRootPath, "audit.log")
+		options.flags = "" // The entries carry their own time
+		options.bufferLength = Cfg.Section("log").Key("BUFFER_LEN").MustInt64(10000)
+		generateNamedLogger("audit", options)
 	}
 }
 
@@ -363,6 +437,7 @@ func NewLogServices(disableConsole bool) {
 	newMacaronLogService()
 	newRouterLogService()
 	newAccessLogService()
+	newAuditLogService()
 	NewXORMLogService(disableConsole)
 }
 
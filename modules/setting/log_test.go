@@ -0,0 +1,71 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package setting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/stretchr/testify/assert"
+	ini "gopkg.in/ini.v1"
+)
+
+func Test_newAccessLogService(t *testing.T) {
+	defer func(cfg *ini.File, logRootPath string) {
+		Cfg = cfg
+		LogRootPath = logRootPath
+		EnableAccessLog = false
+	}(Cfg, LogRootPath)
+
+	tmpDir, err := ioutil.TempDir("", "Test_newAccessLogService")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	LogRootPath = tmpDir
+
+	accessConfig := func(iniStr string) map[string]interface{} {
+		Cfg, err = ini.Load([]byte(iniStr))
+		assert.NoError(t, err)
+		newAccessLogService()
+		defer log.DelNamedLogger("access")
+
+		desc := GetLogDescriptions()["access"]
+		if !assert.NotNil(t, desc) || !assert.Len(t, desc.SubLogDescriptions, 1) {
+			return nil
+		}
+		config := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal([]byte(desc.SubLogDescriptions[0].Config), &config))
+		return config
+	}
+
+	// a dedicated sink with its own rotation
+	config := accessConfig(`
+[log]
+ENABLE_ACCESS_LOG = true
+MODE = console
+[log.access]
+FILE_NAME = cdn/access.log
+MAX_SIZE_SHIFT = 20
+MAX_DAYS = 3
+MAX_BACKUPS = 5
+`)
+	assert.Equal(t, filepath.Join(tmpDir, "cdn", "access.log"), config["filename"])
+	assert.EqualValues(t, 1<<20, config["maxsize"])
+	assert.EqualValues(t, 3, config["maxdays"])
+	assert.EqualValues(t, 5, config["maxbackups"])
+
+	// without the section the access log is configured as before
+	config = accessConfig(`
+[log]
+ENABLE_ACCESS_LOG = true
+`)
+	assert.Equal(t, filepath.Join(tmpDir, "access.log"), config["filename"])
+	assert.EqualValues(t, 1<<28, config["maxsize"])
+	assert.EqualValues(t, 0, config["maxbackups"])
+}
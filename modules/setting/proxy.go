@@ -0,0 +1,28 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package setting
+
+import (
+	"code.gitea.io/gitea/modules/log"
+)
+
+var (
+	// Proxy defines the settings for the reverse proxies in front of Gitea
+	Proxy = struct {
+		TrustedProxies       []string
+		ForwardedProtoHeader string
+		ForwardedForDepth    int
+	}{
+		TrustedProxies:       []string{"loopback"},
+		ForwardedProtoHeader: "X-Forwarded-Proto",
+	}
+)
+
+func newProxyService() {
+	sec := Cfg.Section("proxy")
+	if err := sec.MapTo(&Proxy); err != nil {
+		log.Fatal("Failed to map proxy settings: %v", err)
+	}
+}
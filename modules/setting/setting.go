@@ -32,6 +32,18 @@ import (
 	ini "gopkg.in/ini.v1"
 )
 
+// PaginationCap is the maximum number of items per page of the API endpoints matching a path pattern
+type PaginationCap struct {
+	Path             string
+	MaxResponseItems int
+}
+
+// LogSampleRate is the share of the requests with a path matching a pattern which the router logs, 1 in Rate
+type LogSampleRate struct {
+	Path string
+	Rate int
+}
+
 // Scheme describes protocol types
 type Scheme string
 
@@ -76,31 +88,76 @@ var (
 	AppWorkPath    string
 
 	// Server settings
-	Protocol             Scheme
-	Domain               string
-	HTTPAddr             string
-	HTTPPort             string
-	LocalURL             string
-	RedirectOtherPort    bool
-	PortToRedirect       string
-	OfflineMode          bool
-	CertFile             string
-	KeyFile              string
-	StaticRootPath       string
-	StaticCacheTime      time.Duration
-	EnableGzip           bool
-	LandingPageURL       LandingPage
-	UnixSocketPermission uint32
-	EnablePprof          bool
-	PprofDataPath        string
-	EnableLetsEncrypt    bool
-	LetsEncryptTOS       bool
-	LetsEncryptDirectory string
-	LetsEncryptEmail     string
-	GracefulRestartable  bool
-	GracefulHammerTime   time.Duration
-	StartupTimeout       time.Duration
-	StaticURLPrefix      string
+	Protocol              Scheme
+	Domain                string
+	HTTPAddr              string
+	HTTPPort              string
+	LocalURL              string
+	RedirectOtherPort     bool
+	PortToRedirect        string
+	ForceHTTPS            bool
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	OfflineMode           bool
+	CertFile              string
+	KeyFile               string
+	StaticRootPath        string
+	StaticCacheTime       time.Duration
+	CustomStaticCacheTime time.Duration
+	ImmutableStaticPaths  []string
+	ServePrecompressed    bool
+	RequireStaticAssets   bool
+	EnableGzip            bool
+	CompressionAlgorithms []string
+	EnableH2C             bool
+	ConnectionRateLimit   float64
+	EnableServerTiming    bool
+	ReadHeaderTimeout     time.Duration
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	IdleTimeout           time.Duration
+	LongTransferPaths     []string
+	LandingPageURL        LandingPage
+	UnixSocketPermission  uint32
+	EnablePprof           bool
+	PprofDataPath         string
+	EnableLetsEncrypt     bool
+	LetsEncryptTOS        bool
+	LetsEncryptDirectory  string
+	LetsEncryptEmail      string
+	GracefulRestartable   bool
+	GracefulHammerTime    time.Duration
+	StartupTimeout        time.Duration
+	StaticURLPrefix       string
+	MaxRequestBodySize    int64
+	MaxResponseHeaderSize int
+	MaxUploadParts        int
+	MaxHeaderBytes        int
+	MaxHeaderCount        int
+	MaxURLLength          int
+	HealthCheckRateLimit  float64
+	AllowedRedirectPorts  []string
+	EnforceTrustedHosts   bool
+	DisableWebUI          bool
+	TrustedHosts          []string
+
+	RedirectToCanonicalPath bool
+	GracefulShutdownTimeout time.Duration
+	MaxDecompressedBodySize int64
+
+	InstanceName      string
+	ShowVersionHeader bool
+
+	MaintenanceMode       bool
+	MaintenanceBypassIPs  []string
+	MaintenanceRetryAfter time.Duration
+
+	MaxConcurrentExpensiveRequests int
+	ExpensiveRequestPaths          []string
+	RenderTimeout                  time.Duration
+	RenderRequestPaths             []string
+	RobotsNoIndexPaths             []string
+	ProblemDetailsPaths            []string
 
 	SSH = struct {
 		Disabled                       bool              `ini:"DISABLE_SSH"`
@@ -156,6 +213,7 @@ var (
 	PasswordComplexity                 []string
 	PasswordHashAlgo                   string
 	PasswordCheckPwn                   bool
+	ChangePasswordURL                  string
 
 	// UI settings
 	UI = struct {
@@ -272,16 +330,27 @@ var (
 	}
 
 	// Log settings
-	LogLevel           string
-	StacktraceLogLevel string
-	LogRootPath        string
-	RedirectMacaronLog bool
-	DisableRouterLog   bool
-	RouterLogLevel     log.Level
-	RouterLogMode      string
-	EnableAccessLog    bool
-	AccessLogTemplate  string
-	EnableXORMLog      bool
+	LogLevel                 string
+	StacktraceLogLevel       string
+	LogRootPath              string
+	RedirectMacaronLog       bool
+	DisableRouterLog         bool
+	RouterLogLevel           log.Level
+	RouterLogMode            string
+	RouterLogRedactParams    []string
+	RouterLogSampleRate      int
+	RouterLogSampleRates     []LogSampleRate
+	RouterLogSlowThreshold   time.Duration
+	EnableAccessLog          bool
+	AccessLogTemplate        string
+	AccessLogFormat          string
+	AccessLogExcludePaths    []string
+	AccessLogTraceStartPaths []string
+	AccessLogTimeFormat      string
+	AccessLogUseUTC          bool
+	EnableAuditLog           bool
+	AuditLogPaths            []string
+	EnableXORMLog            bool
 
 	// Time settings
 	TimeFormat string
@@ -301,10 +370,13 @@ var (
 	API = struct {
 		EnableSwagger          bool
 		SwaggerURL             string
+		SwaggerFilterFeatures  bool
 		MaxResponseItems       int
 		DefaultPagingNum       int
 		DefaultGitTreesPerPage int
 		DefaultMaxBlobSize     int64
+		MaxPage                int
+		PaginationCaps         []PaginationCap `ini:"-"`
 	}{
 		EnableSwagger:          true,
 		SwaggerURL:             "",
@@ -339,6 +411,9 @@ var (
 	Metrics = struct {
 		Enabled bool
 		Token   string
+		// ListenAddress is the address the startup probe, health check and metrics are served on instead of
+		// the main listener, e.g. on an internal interface
+		ListenAddress string
 	}{
 		Enabled: false,
 		Token:   "",
@@ -517,6 +592,17 @@ func NewContext() {
 	forcePathSeparator(LogRootPath)
 	RedirectMacaronLog = Cfg.Section("log").Key("REDIRECT_MACARON_LOG").MustBool(false)
 	RouterLogLevel = log.FromString(Cfg.Section("log").Key("ROUTER_LOG_LEVEL").MustString("Info"))
+	Cfg.Section("log").Key("ROUTER_LOG_REDACT_PARAMS").MustString("token,access_token")
+	RouterLogRedactParams = Cfg.Section("log").Key("ROUTER_LOG_REDACT_PARAMS").Strings(",")
+	RouterLogSampleRate = Cfg.Section("log").Key("ROUTER_LOG_SAMPLE_RATE").MustInt(1)
+	RouterLogSampleRates = nil
+	for _, key := range Cfg.Section("log.router_sample_rate").Keys() {
+		RouterLogSampleRates = append(RouterLogSampleRates, LogSampleRate{
+			Path: key.Name(),
+			Rate: key.MustInt(RouterLogSampleRate),
+		})
+	}
+	RouterLogSlowThreshold = Cfg.Section("log").Key("ROUTER_LOG_SLOW_THRESHOLD").MustDuration(5 * time.Second)
 
 	sec := Cfg.Section("server")
 	AppName = Cfg.Section("").Key("APP_NAME").MustString("Gitea: Git with a cup of tea")
@@ -565,7 +651,26 @@ func NewContext() {
 	HTTPPort = sec.Key("HTTP_PORT").MustString("3000")
 	GracefulRestartable = sec.Key("ALLOW_GRACEFUL_RESTARTS").MustBool(true)
 	GracefulHammerTime = sec.Key("GRACEFUL_HAMMER_TIME").MustDuration(60 * time.Second)
+	GracefulShutdownTimeout = sec.Key("GRACEFUL_SHUTDOWN_TIMEOUT").MustDuration(0)
 	StartupTimeout = sec.Key("STARTUP_TIMEOUT").MustDuration(0 * time.Second)
+	MaxRequestBodySize = sec.Key("MAX_REQUEST_BODY_SIZE").MustInt64(0)
+	MaxDecompressedBodySize = sec.Key("MAX_DECOMPRESSED_BODY_SIZE").MustInt64(0)
+	MaxResponseHeaderSize = sec.Key("MAX_RESPONSE_HEADER_SIZE").MustInt(0)
+	MaxUploadParts = sec.Key("MAX_UPLOAD_PARTS").MustInt(0)
+	MaxHeaderBytes = sec.Key("MAX_HEADER_BYTES").MustInt(0)
+	MaxHeaderCount = sec.Key("MAX_HEADER_COUNT").MustInt(0)
+	MaxURLLength = sec.Key("MAX_URL_LENGTH").MustInt(0)
+	HealthCheckRateLimit = sec.Key("HEALTH_CHECK_RATE_LIMIT").MustFloat64(10)
+	RedirectToCanonicalPath = sec.Key("REDIRECT_TO_CANONICAL_PATH").MustBool(false)
+	MaxConcurrentExpensiveRequests = sec.Key("MAX_CONCURRENT_EXPENSIVE_REQUESTS").MustInt(0)
+	sec.Key("EXPENSIVE_REQUEST_PATHS").MustString("/explore/**,/*/*/search,/*/*/compare/**,/*/*/blame/**,/*/*/commit/*,/*/*/pulls/*/files,/api/v1/repos/search,/api/v1/repos/issues/search,/api/v1/users/search")
+	ExpensiveRequestPaths = sec.Key("EXPENSIVE_REQUEST_PATHS").Strings(",")
+	RenderTimeout = sec.Key("RENDER_TIMEOUT").MustDuration(0)
+	sec.Key("RENDER_REQUEST_PATHS").MustString("/api/v1/markdown,/api/v1/markdown/raw,/*/*/markdown,/*/*/wiki/**,/*/*/src/**")
+	RenderRequestPaths = sec.Key("RENDER_REQUEST_PATHS").Strings(",")
+	RobotsNoIndexPaths = sec.Key("ROBOTS_NOINDEX_PATHS").Strings(",")
+	sec.Key("PROBLEM_DETAILS_PATHS").MustString("/api/")
+	ProblemDetailsPaths = sec.Key("PROBLEM_DETAILS_PATHS").Strings(",")
 
 	defaultAppURL := string(Protocol) + "://" + Domain
 	if (Protocol == HTTP && HTTPPort != "80") || (Protocol == HTTPS && HTTPPort != "443") {
@@ -609,6 +714,18 @@ func NewContext() {
 	LocalURL = sec.Key("LOCAL_ROOT_URL").MustString(defaultLocalURL)
 	RedirectOtherPort = sec.Key("REDIRECT_OTHER_PORT").MustBool(false)
 	PortToRedirect = sec.Key("PORT_TO_REDIRECT").MustString("80")
+	ForceHTTPS = sec.Key("FORCE_HTTPS").MustBool(false)
+	HSTSMaxAge = sec.Key("HSTS_MAX_AGE").MustDuration(365 * 24 * time.Hour)
+	HSTSIncludeSubdomains = sec.Key("HSTS_INCLUDE_SUBDOMAINS").MustBool(false)
+	AllowedRedirectPorts = sec.Key("ALLOWED_REDIRECT_PORTS").Strings(",")
+	EnforceTrustedHosts = sec.Key("ENFORCE_TRUSTED_HOSTS").MustBool(false)
+	DisableWebUI = sec.Key("DISABLE_WEB_UI").MustBool(false)
+	TrustedHosts = sec.Key("TRUSTED_HOSTS").Strings(",")
+	InstanceName = sec.Key("INSTANCE_NAME").MustString("")
+	ShowVersionHeader = sec.Key("SHOW_VERSION_HEADER").MustBool(false)
+	MaintenanceMode = sec.Key("MAINTENANCE_MODE").MustBool(false)
+	MaintenanceBypassIPs = sec.Key("MAINTENANCE_BYPASS_IPS").Strings(",")
+	MaintenanceRetryAfter = sec.Key("MAINTENANCE_RETRY_AFTER").MustDuration(5 * time.Minute)
 	OfflineMode = sec.Key("OFFLINE_MODE").MustBool()
 	DisableRouterLog = sec.Key("DISABLE_ROUTER_LOG").MustBool()
 	if len(StaticRootPath) == 0 {
@@ -616,8 +733,32 @@ func NewContext() {
 	}
 	StaticRootPath = sec.Key("STATIC_ROOT_PATH").MustString(StaticRootPath)
 	StaticCacheTime = sec.Key("STATIC_CACHE_TIME").MustDuration(6 * time.Hour)
+	CustomStaticCacheTime = sec.Key("CUSTOM_STATIC_CACHE_TIME").MustDuration(StaticCacheTime)
+	ImmutableStaticPaths = sec.Key("IMMUTABLE_STATIC_PATHS").Strings(",")
+	ServePrecompressed = sec.Key("SERVE_PRECOMPRESSED").MustBool(false)
+	RequireStaticAssets = sec.Key("REQUIRE_STATIC_ASSETS").MustBool(false)
 	AppDataPath = sec.Key("APP_DATA_PATH").MustString(path.Join(AppWorkPath, "data"))
 	EnableGzip = sec.Key("ENABLE_GZIP").MustBool()
+	sec.Key("COMPRESSION_ALGORITHMS").MustString("br,gzip,deflate")
+	CompressionAlgorithms = nil
+	for _, algorithm := range sec.Key("COMPRESSION_ALGORITHMS").Strings(",") {
+		algorithm = strings.ToLower(algorithm)
+		switch algorithm {
+		case "br", "gzip", "deflate":
+			CompressionAlgorithms = append(CompressionAlgorithms, algorithm)
+		default:
+			log.Fatal("Invalid COMPRESSION_ALGORITHMS %q: must be a list of br, gzip and deflate", algorithm)
+		}
+	}
+	EnableH2C = sec.Key("ENABLE_H2C").MustBool()
+	ConnectionRateLimit = sec.Key("CONNECTION_RATE_LIMIT").MustFloat64(0)
+	EnableServerTiming = sec.Key("ENABLE_SERVER_TIMING").MustBool(false)
+	ReadHeaderTimeout = sec.Key("READ_HEADER_TIMEOUT").MustDuration(10 * time.Second)
+	ReadTimeout = sec.Key("READ_TIMEOUT").MustDuration(0)
+	WriteTimeout = sec.Key("WRITE_TIMEOUT").MustDuration(0)
+	IdleTimeout = sec.Key("IDLE_TIMEOUT").MustDuration(0)
+	sec.Key("LONG_TRANSFER_PATHS").MustString("/*/*/info/refs,/*/*/git-upload-pack,/*/*/git-receive-pack,/*/*/info/lfs/**,/*/*/objects/**,/*/*/archive/**,/*/*/raw/**,/*/*/media/**,/attachments/**,/avatars/**,/repo-avatars/**")
+	LongTransferPaths = sec.Key("LONG_TRANSFER_PATHS").Strings(",")
 	EnablePprof = sec.Key("ENABLE_PPROF").MustBool(false)
 	PprofDataPath = sec.Key("PPROF_DATA_PATH").MustString(path.Join(AppWorkPath, "data/tmp/pprof"))
 	if !filepath.IsAbs(PprofDataPath) {
@@ -774,6 +915,10 @@ func NewContext() {
 	PasswordHashAlgo = sec.Key("PASSWORD_HASH_ALGO").MustString("argon2")
 	CSRFCookieHTTPOnly = sec.Key("CSRF_COOKIE_HTTP_ONLY").MustBool(true)
 	PasswordCheckPwn = sec.Key("PASSWORD_CHECK_PWN").MustBool(false)
+	ChangePasswordURL = sec.Key("CHANGE_PASSWORD_URL").MustString("/user/settings/account")
+	if !strings.Contains(ChangePasswordURL, "://") {
+		ChangePasswordURL = AppSubURL + "/" + strings.TrimPrefix(ChangePasswordURL, "/")
+	}
 
 	InternalToken = loadInternalToken(sec)
 
@@ -862,6 +1007,12 @@ func NewContext() {
 	} else if err = Cfg.Section("metrics").MapTo(&Metrics); err != nil {
 		log.Fatal("Failed to map Metrics settings: %v", err)
 	}
+	for _, key := range Cfg.Section("api.max_response_items").Keys() {
+		API.PaginationCaps = append(API.PaginationCaps, PaginationCap{
+			Path:             key.Name(),
+			MaxResponseItems: key.MustInt(API.MaxResponseItems),
+		})
+	}
 
 	u := *appURL
 	u.Path = path.Join(u.Path, "api", "swagger")
@@ -1029,6 +1180,7 @@ func NewServices() {
 	newCacheService()
 	newSessionService()
 	newCORSService()
+	newProxyService()
 	newMailService()
 	newRegisterMailService()
 	newNotifyMailService()
@@ -5,8 +5,16 @@
 package setting
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
 
 	ini "gopkg.in/ini.v1"
 )
@@ -17,6 +25,32 @@ type Storage struct {
 	Path        string
 	Section     *ini.Section
 	ServeDirect bool
+	// ServeDirectRegionHeader is the request header holding the region of the client, e.g. as set by the GeoIP
+	// module of the reverse proxy, objects served directly are served from the endpoint for that region
+	ServeDirectRegionHeader string
+	// AllowedRedirectHosts are the hosts objects served directly may be redirected to, any host if empty
+	AllowedRedirectHosts []string
+	// AcceptRanges lets clients request ranges of the objects, otherwise the whole object is always sent
+	AcceptRanges bool
+	// CopyBufferSize is the size in bytes of the buffers objects are copied to responses with
+	CopyBufferSize int
+	// CacheControl and Vary are sent with the objects served from the storage
+	CacheControl string
+	Vary         string
+	// MaxConcurrentPerIP is the number of objects a client IP may download at once
+	MaxConcurrentPerIP int
+	// MaxConcurrentPerIPSignedIn is the number of objects a client IP may download at once with a valid access
+	// or OAuth2 token
+	MaxConcurrentPerIPSignedIn int
+	// ServeViaXAccel lets the reverse proxy send the objects of a local storage from the disk, with XAccelHeader
+	// pointing at the object below XAccelLocation for X-Accel-Redirect or at its file for X-Sendfile
+	ServeViaXAccel bool
+	XAccelHeader   string
+	XAccelLocation string
+	// OperationTimeout is the time the storage has to open an object or get its info or URL, 0 for no limit
+	OperationTimeout time.Duration
+	// Fallback is the storage objects are read from when they cannot be found in this storage
+	Fallback *Storage
 }
 
 // MapTo implements the Mappable interface
@@ -31,14 +65,108 @@ func (s *Storage) MapTo(v interface{}) error {
 	return nil
 }
 
+const storageSectionName = "storage"
+
 func getStorage(name, typ string, overrides ...*ini.Section) Storage {
-	const sectionName = "storage"
-	sec := Cfg.Section(sectionName)
+	storage := getStorageSection(name, typ, overrides...)
+
+	// Objects that are not found are read from the fallback storage instead, e.g. whilst they are being
+	// migrated to a new storage. The fallback storage itself has no fallback.
+	if fallbackName := storage.Section.Key("FALLBACK_STORAGE").MustString(""); fallbackName != "" {
+		fallbackSec := Cfg.Section(storageSectionName + "." + fallbackName)
+		fallback := getStorageSection(name, typ, fallbackSec)
+		fallback.Type = fallbackSec.Key("STORAGE_TYPE").MustString(fallback.Type)
+		storage.Fallback = &fallback
+	}
+
+	// The cache headers are configured in [storage.<name>], e.g. [storage.avatars], so that they can differ from
+	// those of other storages sharing the same storage type
+	nameSec := Cfg.Section(storageSectionName + "." + name)
+	storage.CacheControl = nameSec.Key("CACHE_CONTROL").MustString(storage.Section.Key("CACHE_CONTROL").String())
+	storage.Vary = nameSec.Key("VARY").MustString(storage.Section.Key("VARY").String())
+	if err := validateStorageCacheHeaders(storage.CacheControl, storage.Vary); err != nil {
+		log.Fatal("Invalid cache headers for storage %s: %v", name, err)
+	}
+
+	// The reverse proxy needs an internal location for each storage, so these are configured in [storage.<name>] too
+	storage.ServeViaXAccel = nameSec.Key("SERVE_VIA_X_ACCEL").MustBool(false)
+	storage.XAccelHeader = http.CanonicalHeaderKey(nameSec.Key("X_ACCEL_HEADER").MustString("X-Accel-Redirect"))
+	storage.XAccelLocation = strings.TrimSuffix(nameSec.Key("X_ACCEL_LOCATION").MustString("/internal/"+name), "/")
+	if storage.ServeViaXAccel {
+		switch {
+		case storage.XAccelHeader != "X-Accel-Redirect" && storage.XAccelHeader != "X-Sendfile":
+			log.Fatal("Invalid X_ACCEL_HEADER %q for storage %s: must be X-Accel-Redirect or X-Sendfile", storage.XAccelHeader, name)
+		case storage.Type != "local":
+			log.Warn("SERVE_VIA_X_ACCEL is ignored for storage %s as only local storages can be served by the reverse proxy", name)
+			storage.ServeViaXAccel = false
+		}
+	}
+
+	return storage
+}
+
+// validateStorageCacheHeaders checks that a Cache-Control and Vary for a storage are well formed and make sense together
+func validateStorageCacheHeaders(cacheControl, vary string) error {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "" {
+			continue
+		}
+		name, value := directive, ""
+		if idx := strings.IndexByte(directive, '='); idx >= 0 {
+			name, value = strings.TrimSpace(directive[:idx]), strings.TrimSpace(directive[idx+1:])
+		}
+		switch name {
+		case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error":
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				return fmt.Errorf("%s must be a number of seconds, not %q", name, value)
+			}
+		case "public", "private", "no-cache", "no-store", "no-transform", "must-revalidate", "proxy-revalidate", "immutable":
+			if value != "" {
+				return fmt.Errorf("%s does not take a value", name)
+			}
+		default:
+			return fmt.Errorf("unknown Cache-Control directive %q", name)
+		}
+		directives[name] = value
+	}
+
+	has := func(name string) bool {
+		_, ok := directives[name]
+		return ok
+	}
+	cacheable := has("max-age") || has("s-maxage") || has("immutable")
+	switch {
+	case has("public") && has("private"):
+		return errors.New("the Cache-Control cannot be both public and private")
+	case has("no-store") && (cacheable || has("public")):
+		return errors.New("the Cache-Control cannot be no-store and allow the objects to be cached")
+	case has("private") && has("s-maxage"):
+		return errors.New("the Cache-Control cannot be private and set s-maxage for shared caches")
+	}
+
+	for _, field := range strings.Split(vary, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "" && strings.TrimSpace(vary) != "":
+			return errors.New("the Vary has an empty header name")
+		case field == "*" && cacheable:
+			return errors.New("a Vary of * prevents the objects from being cached, which the Cache-Control allows")
+		case strings.ContainsAny(field, " \t\"():;<>@[]{}/?=\\"):
+			return fmt.Errorf("the Vary has an invalid header name %q", field)
+		}
+	}
+	return nil
+}
+
+func getStorageSection(name, typ string, overrides ...*ini.Section) Storage {
+	sec := Cfg.Section(storageSectionName)
 
 	if len(overrides) == 0 {
 		overrides = []*ini.Section{
-			Cfg.Section(sectionName + "." + typ),
-			Cfg.Section(sectionName + "." + name),
+			Cfg.Section(storageSectionName + "." + typ),
+			Cfg.Section(storageSectionName + "." + name),
 		}
 	}
 
@@ -74,6 +202,13 @@ func getStorage(name, typ string, overrides ...*ini.Section) Storage {
 		storage.Section.Key("PATH").SetValue(storage.Path)
 	}
 	storage.Section.Key("MINIO_BASE_PATH").MustString(name + "/")
+	storage.ServeDirectRegionHeader = storage.Section.Key("SERVE_DIRECT_REGION_HEADER").MustString("")
+	storage.AllowedRedirectHosts = storage.Section.Key("ALLOWED_REDIRECT_HOSTS").Strings(",")
+	storage.AcceptRanges = storage.Section.Key("ACCEPT_RANGES").MustBool(true)
+	storage.CopyBufferSize = storage.Section.Key("COPY_BUFFER_SIZE").MustInt(32 * 1024)
+	storage.MaxConcurrentPerIP = storage.Section.Key("MAX_CONCURRENT_PER_IP").MustInt(0)
+	storage.MaxConcurrentPerIPSignedIn = storage.Section.Key("MAX_CONCURRENT_PER_IP_SIGNED_IN").MustInt(storage.MaxConcurrentPerIP)
+	storage.OperationTimeout = storage.Section.Key("OPERATION_TIMEOUT").MustDuration(0)
 
 	return storage
 }
@@ -0,0 +1,41 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package setting
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateStorageCacheHeaders(t *testing.T) {
+	valid := []struct{ cacheControl, vary string }{
+		{"", ""},
+		{"public, max-age=86400, s-maxage=604800", "Accept-Encoding, Accept"},
+		{"private, max-age=0, must-revalidate", ""},
+		{"no-store", "*"},
+		{"Public, Max-Age=60", ""},
+	}
+	for _, kase := range valid {
+		assert.NoError(t, validateStorageCacheHeaders(kase.cacheControl, kase.vary), kase.cacheControl)
+	}
+
+	invalid := []struct{ cacheControl, vary string }{
+		{"public, private", ""},
+		{"no-store, max-age=60", ""},
+		{"public, no-store", ""},
+		{"private, s-maxage=60", ""},
+		{"max-age=soon", ""},
+		{"max-age=-1", ""},
+		{"public=yes", ""},
+		{"maxage=60", ""},
+		{"max-age=60", "*"},
+		{"", "Accept-Encoding,,Accept"},
+		{"", "Accept Encoding"},
+	}
+	for _, kase := range invalid {
+		assert.Error(t, validateStorageCacheHeaders(kase.cacheControl, kase.vary), kase.cacheControl+" "+kase.vary)
+	}
+}
@@ -6,6 +6,7 @@ package setting
 
 import (
 	"net/url"
+	"time"
 
 	"code.gitea.io/gitea/modules/log"
 )
@@ -21,6 +22,10 @@ var (
 		ProxyURL       string
 		ProxyURLFixed  *url.URL
 		ProxyHosts     []string
+
+		DeduplicationTTL     time.Duration
+		DeduplicationHeaders []string
+		DeduplicationPaths   []string
 	}{
 		QueueLength:    1000,
 		DeliverTimeout: 5,
@@ -48,4 +53,9 @@ func newWebhookService() {
 		}
 	}
 	Webhook.ProxyHosts = sec.Key("PROXY_HOSTS").Strings(",")
+
+	Webhook.DeduplicationTTL = sec.Key("DEDUPLICATION_TTL").MustDuration(time.Hour)
+	sec.Key("DEDUPLICATION_HEADERS").MustString("X-Gitea-Delivery,X-GitHub-Delivery,X-Gogs-Delivery")
+	Webhook.DeduplicationHeaders = sec.Key("DEDUPLICATION_HEADERS").Strings(",")
+	Webhook.DeduplicationPaths = sec.Key("DEDUPLICATION_PATHS").Strings(",")
 }
@@ -6,7 +6,9 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -17,16 +19,24 @@ import (
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
 )
 
 var (
-	_ ObjectStorage = &MinioStorage{}
+	_ ObjectStorage   = &MinioStorage{}
+	_ FilenameSaver   = &MinioStorage{}
+	_ RegionURLGetter = &MinioStorage{}
+	_ ContextStorage  = &MinioStorage{}
+	_ ContextStater   = &minioObject{}
+	_ FilenameInfo    = &minioFileInfo{}
 
 	quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 )
 
 type minioObject struct {
 	*minio.Object
+	storage *MinioStorage
+	key     string
 }
 
 func (m *minioObject) Stat() (os.FileInfo, error) {
@@ -38,6 +48,12 @@ func (m *minioObject) Stat() (os.FileInfo, error) {
 	return &minioFileInfo{oi}, nil
 }
 
+// StatContext gets the info of the object within ctx. The object does not take a context for this itself, so its
+// info is got from the bucket instead.
+func (m *minioObject) StatContext(ctx context.Context) (os.FileInfo, error) {
+	return m.storage.statKey(ctx, m.key)
+}
+
 // MinioStorageType is the type descriptor for minio storage
 const MinioStorageType Type = "minio"
 
@@ -50,14 +66,18 @@ type MinioStorageConfig struct {
 	Location        string `ini:"MINIO_LOCATION"`
 	BasePath        string `ini:"MINIO_BASE_PATH"`
 	UseSSL          bool   `ini:"MINIO_USE_SSL"`
+	// RegionEndpoints is a comma separated list of region=endpoint pairs, the URLs of objects served directly
+	// to clients of a region are signed for its endpoint
+	RegionEndpoints string `ini:"MINIO_REGION_ENDPOINTS"`
 }
 
 // MinioStorage returns a minio bucket storage
 type MinioStorage struct {
-	ctx      context.Context
-	client   *minio.Client
-	bucket   string
-	basePath string
+	ctx           context.Context
+	client        *minio.Client
+	regionClients map[string]*minio.Client
+	bucket        string
+	basePath      string
 }
 
 func convertMinioErr(err error) error {
@@ -75,6 +95,11 @@ func convertMinioErr(err error) error {
 		return os.ErrNotExist
 	case "AccessDenied":
 		return os.ErrPermission
+	case "SlowDown", "RequestLimitExceeded", "TooManyRequests":
+		return ErrThrottled{err}
+	}
+	if errResp.StatusCode == http.StatusTooManyRequests || errResp.StatusCode == http.StatusServiceUnavailable {
+		return ErrThrottled{err}
 	}
 
 	return err
@@ -108,37 +133,103 @@ func NewMinioStorage(ctx context.Context, cfg interface{}) (ObjectStorage, error
 		}
 	}
 
+	regionClients, err := newMinioRegionClients(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MinioStorage{
-		ctx:      ctx,
-		client:   minioClient,
-		bucket:   config.Bucket,
-		basePath: config.BasePath,
+		ctx:           ctx,
+		client:        minioClient,
+		regionClients: regionClients,
+		bucket:        config.Bucket,
+		basePath:      config.BasePath,
 	}, nil
 }
 
+// newMinioRegionClients creates the clients for the endpoints of config.RegionEndpoints by their region. They
+// are only used to sign URLs, which needs no requests to the endpoints as the location of the bucket is given.
+func newMinioRegionClients(config MinioStorageConfig) (map[string]*minio.Client, error) {
+	clients := make(map[string]*minio.Client)
+	for _, pair := range strings.Split(config.RegionEndpoints, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		idx := strings.IndexByte(pair, '=')
+		if idx <= 0 || idx == len(pair)-1 {
+			return nil, ErrInvalidConfiguration{cfg: config.RegionEndpoints, err: fmt.Errorf("%q is not a region=endpoint pair", pair)}
+		}
+		region, endpoint := strings.ToLower(strings.TrimSpace(pair[:idx])), strings.TrimSpace(pair[idx+1:])
+
+		// S3 picks the host of its URLs from the location of the bucket, unless transfer acceleration is used
+		clientEndpoint, location := endpoint, config.Location
+		accelerate := strings.HasPrefix(endpoint, "s3-accelerate.")
+		if accelerate {
+			clientEndpoint = config.Endpoint
+			if !s3utils.IsAmazonEndpoint(url.URL{Host: clientEndpoint}) {
+				return nil, ErrInvalidConfiguration{cfg: config.RegionEndpoints, err: fmt.Errorf("transfer acceleration needs an S3 endpoint, not %s", clientEndpoint)}
+			}
+		} else if endpointLocation := s3utils.GetRegionFromURL(url.URL{Host: endpoint}); endpointLocation != "" {
+			location = endpointLocation
+		}
+
+		client, err := minio.New(clientEndpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, ""),
+			Secure: config.UseSSL,
+			Region: location,
+		})
+		if err != nil {
+			return nil, ErrInvalidConfiguration{cfg: config.RegionEndpoints, err: err}
+		}
+		if accelerate {
+			client.SetS3TransferAccelerate(endpoint)
+		}
+		clients[region] = client
+	}
+	return clients, nil
+}
+
 func (m *MinioStorage) buildMinioPath(p string) string {
 	return strings.TrimPrefix(path.Join(m.basePath, p), "/")
 }
 
-// Open open a file
+// Open open a file. No request is made until the object is read or its info is got.
 func (m *MinioStorage) Open(path string) (Object, error) {
 	var opts = minio.GetObjectOptions{}
-	object, err := m.client.GetObject(m.ctx, m.bucket, m.buildMinioPath(path), opts)
+	key := m.buildMinioPath(path)
+	object, err := m.client.GetObject(m.ctx, m.bucket, key, opts)
 	if err != nil {
 		return nil, convertMinioErr(err)
 	}
-	return &minioObject{object}, nil
+	return &minioObject{Object: object, storage: m, key: key}, nil
 }
 
+// minioFilenameMetadata is the user metadata key the filename of an object is stored in
+const minioFilenameMetadata = "Filename"
+
 // Save save a file to minio
 func (m *MinioStorage) Save(path string, r io.Reader) (int64, error) {
+	return m.save(path, r, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+}
+
+// SaveWithFilename saves a file to minio along with the filename it should be downloaded as
+func (m *MinioStorage) SaveWithFilename(path string, r io.Reader, filename string) (int64, error) {
+	return m.save(path, r, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		// metadata is sent as a header so has to be ASCII
+		UserMetadata: map[string]string{minioFilenameMetadata: url.QueryEscape(filename)},
+	})
+}
+
+func (m *MinioStorage) save(path string, r io.Reader, opts minio.PutObjectOptions) (int64, error) {
 	uploadInfo, err := m.client.PutObject(
 		m.ctx,
 		m.bucket,
 		m.buildMinioPath(path),
 		r,
 		-1,
-		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+		opts,
 	)
 	if err != nil {
 		return 0, convertMinioErr(err)
@@ -174,12 +265,30 @@ func (m minioFileInfo) Sys() interface{} {
 	return nil
 }
 
+// Filename returns the filename stored with the object, if any
+func (m minioFileInfo) Filename() string {
+	filename, err := url.QueryUnescape(m.UserMetadata[minioFilenameMetadata])
+	if err != nil {
+		return ""
+	}
+	return filename
+}
+
 // Stat returns the stat information of the object
 func (m *MinioStorage) Stat(path string) (os.FileInfo, error) {
+	return m.StatContext(m.ctx, path)
+}
+
+// StatContext returns the stat information of the object, cancelling the request once ctx is done
+func (m *MinioStorage) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return m.statKey(ctx, m.buildMinioPath(path))
+}
+
+func (m *MinioStorage) statKey(ctx context.Context, key string) (os.FileInfo, error) {
 	info, err := m.client.StatObject(
-		m.ctx,
+		ctx,
 		m.bucket,
-		m.buildMinioPath(path),
+		key,
 		minio.StatObjectOptions{},
 	)
 	if err != nil {
@@ -197,10 +306,29 @@ func (m *MinioStorage) Delete(path string) error {
 
 // URL gets the redirect URL to a file. The presigned link is valid for 5 minutes.
 func (m *MinioStorage) URL(path, name string) (*url.URL, error) {
+	return m.presignedURL(m.ctx, m.client, path, name)
+}
+
+// RegionURL gets the redirect URL to a file from the endpoint of region, or from the default endpoint if the
+// region has none. The presigned link is valid for 5 minutes.
+func (m *MinioStorage) RegionURL(path, name, region string) (*url.URL, error) {
+	return m.RegionURLContext(m.ctx, path, name, region)
+}
+
+// RegionURLContext gets the redirect URL to a file as RegionURL does, cancelling any request for it once ctx is
+// done, e.g. for the location of the bucket
+func (m *MinioStorage) RegionURLContext(ctx context.Context, path, name, region string) (*url.URL, error) {
+	if client, ok := m.regionClients[strings.ToLower(region)]; ok {
+		return m.presignedURL(ctx, client, path, name)
+	}
+	return m.presignedURL(ctx, m.client, path, name)
+}
+
+func (m *MinioStorage) presignedURL(ctx context.Context, client *minio.Client, path, name string) (*url.URL, error) {
 	reqParams := make(url.Values)
 	// TODO it may be good to embed images with 'inline' like ServeData does, but we don't want to have to read the file, do we?
 	reqParams.Set("response-content-disposition", "attachment; filename=\""+quoteEscaper.Replace(name)+"\"")
-	u, err := m.client.PresignedGetObject(m.ctx, m.bucket, m.buildMinioPath(path), 5*time.Minute, reqParams)
+	u, err := client.PresignedGetObject(ctx, m.bucket, m.buildMinioPath(path), 5*time.Minute, reqParams)
 	return u, convertMinioErr(err)
 }
 
@@ -219,7 +347,7 @@ func (m *MinioStorage) IterateObjects(fn func(path string, obj Object) error) er
 		}
 		if err := func(object *minio.Object, fn func(path string, obj Object) error) error {
 			defer object.Close()
-			return fn(strings.TrimPrefix(m.basePath, mObjInfo.Key), &minioObject{object})
+			return fn(strings.TrimPrefix(m.basePath, mObjInfo.Key), &minioObject{Object: object, storage: m, key: mObjInfo.Key})
 		}(object, fn); err != nil {
 			return convertMinioErr(err)
 		}
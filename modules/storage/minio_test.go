@@ -0,0 +1,64 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinioStorageRegionURL(t *testing.T) {
+	config := MinioStorageConfig{
+		Endpoint:        "s3.eu-central-1.amazonaws.com",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Bucket:          "gitea",
+		Location:        "eu-central-1",
+		BasePath:        "avatars/",
+		UseSSL:          true,
+		RegionEndpoints: "US = s3-accelerate.amazonaws.com, ap=s3.ap-southeast-1.amazonaws.com",
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Location,
+	})
+	assert.NoError(t, err)
+	regionClients, err := newMinioRegionClients(config)
+	assert.NoError(t, err)
+	m := &MinioStorage{
+		ctx:           context.Background(),
+		client:        client,
+		regionClients: regionClients,
+		bucket:        config.Bucket,
+		basePath:      config.BasePath,
+	}
+
+	u, err := RegionURL(m, "1234", "1234.png", "us")
+	assert.NoError(t, err)
+	assert.Equal(t, "gitea.s3-accelerate.amazonaws.com", u.Host)
+	assert.Equal(t, "/avatars/1234", u.Path)
+	assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+
+	u, err = RegionURL(m, "1234", "1234.png", "AP")
+	assert.NoError(t, err)
+	assert.Equal(t, "gitea.s3.dualstack.ap-southeast-1.amazonaws.com", u.Host)
+
+	// clients of other regions get the default endpoint
+	for _, region := range []string{"sa", ""} {
+		u, err = RegionURL(m, "1234", "1234.png", region)
+		assert.NoError(t, err)
+		assert.Equal(t, "gitea.s3.dualstack.eu-central-1.amazonaws.com", u.Host, region)
+	}
+
+	_, err = newMinioRegionClients(MinioStorageConfig{RegionEndpoints: "us"})
+	assert.True(t, IsErrInvalidConfiguration(err))
+	_, err = newMinioRegionClients(MinioStorageConfig{Endpoint: "localhost:9000", RegionEndpoints: "us=s3-accelerate.amazonaws.com"})
+	assert.True(t, IsErrInvalidConfiguration(err))
+}
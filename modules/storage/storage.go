@@ -42,6 +42,26 @@ func IsErrInvalidConfiguration(err error) bool {
 	return ok
 }
 
+// ErrThrottled is returned when the storage backend rejects a request because too many requests are made to it
+type ErrThrottled struct {
+	err error
+}
+
+func (err ErrThrottled) Error() string {
+	return fmt.Sprintf("Storage request throttled: %v", err.err)
+}
+
+// Unwrap returns the error of the storage backend
+func (err ErrThrottled) Unwrap() error {
+	return err.err
+}
+
+// IsErrThrottled checks if an error is an ErrThrottled
+func IsErrThrottled(err error) bool {
+	var errThrottled ErrThrottled
+	return errors.As(err, &errThrottled)
+}
+
 // Type is a type of Storage
 type Type string
 
@@ -72,6 +92,152 @@ type ObjectStorage interface {
 	IterateObjects(func(path string, obj Object) error) error
 }
 
+// FilenameInfo is implemented by the os.FileInfo of objects stored with the filename they should be
+// downloaded as, which may differ from their path in the storage
+type FilenameInfo interface {
+	Filename() string
+}
+
+// FilenameSaver is implemented by ObjectStorages able to store the filename an object should be downloaded as
+type FilenameSaver interface {
+	SaveWithFilename(path string, r io.Reader, filename string) (int64, error)
+}
+
+// SaveWithFilename saves an object to the ObjectStorage along with the filename it should be downloaded as,
+// if the ObjectStorage cannot store filenames the object is saved without it
+func SaveWithFilename(objStorage ObjectStorage, p string, r io.Reader, filename string) (int64, error) {
+	if saver, ok := objStorage.(FilenameSaver); ok && filename != "" {
+		return saver.SaveWithFilename(p, r, filename)
+	}
+	return objStorage.Save(p, r)
+}
+
+// RegionURLGetter is implemented by ObjectStorages able to serve objects directly from endpoints nearer to
+// the clients of some regions, e.g. accelerated or regional endpoints of S3
+type RegionURLGetter interface {
+	RegionURL(path, name, region string) (*url.URL, error)
+}
+
+// RegionURL gets the redirect URL to an object from the endpoint of the ObjectStorage for the region of the
+// client, if the ObjectStorage has no endpoint for the region the URL of the default endpoint is returned
+func RegionURL(objStorage ObjectStorage, p, name, region string) (*url.URL, error) {
+	if getter, ok := objStorage.(RegionURLGetter); ok && region != "" {
+		return getter.RegionURL(p, name, region)
+	}
+	return objStorage.URL(p, name)
+}
+
+// ContextStorage is implemented by ObjectStorages whose requests can be cancelled through a context, e.g. minio
+type ContextStorage interface {
+	StatContext(ctx context.Context, path string) (os.FileInfo, error)
+	RegionURLContext(ctx context.Context, path, name, region string) (*url.URL, error)
+}
+
+// ContextStater is implemented by Objects whose info can be got within a context
+type ContextStater interface {
+	StatContext(ctx context.Context) (os.FileInfo, error)
+}
+
+// withContext calls call, giving up on it once the context is done, for the storages which do not take a context
+// such as the local one, whose calls cannot be cancelled. The result of a call that is given up on is closed once
+// it returns if it is an io.Closer, so that objects opened too late are not leaked.
+func withContext(ctx context.Context, call func() (interface{}, error)) (interface{}, error) {
+	if ctx.Done() == nil {
+		return call()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := call()
+		done <- result{value, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				if closer, ok := res.value.(io.Closer); ok {
+					_ = closer.Close()
+				}
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// OpenWithContext opens an object from the ObjectStorage, returning the error of the context if it is done first.
+// Storages such as minio only make requests once objects are read or their info is got, so opening never waits.
+func OpenWithContext(ctx context.Context, objStorage ObjectStorage, p string) (Object, error) {
+	obj, err := withContext(ctx, func() (interface{}, error) {
+		return objStorage.Open(p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	object, _ := obj.(Object)
+	return object, nil
+}
+
+// StatWithContext gets the info of an object from the ObjectStorage, returning the error of the context if it is
+// done first
+func StatWithContext(ctx context.Context, objStorage ObjectStorage, p string) (os.FileInfo, error) {
+	if cs, ok := objStorage.(ContextStorage); ok {
+		return cs.StatContext(ctx, p)
+	}
+	fi, err := withContext(ctx, func() (interface{}, error) {
+		return objStorage.Stat(p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, _ := fi.(os.FileInfo)
+	return info, nil
+}
+
+// StatObjectWithContext gets the info of an opened object, returning the error of the context if it is done first.
+// Storages such as minio only fetch objects once their info is got or they are read.
+func StatObjectWithContext(ctx context.Context, obj Object) (os.FileInfo, error) {
+	if stater, ok := obj.(ContextStater); ok {
+		return stater.StatContext(ctx)
+	}
+	fi, err := withContext(ctx, func() (interface{}, error) {
+		return obj.Stat()
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, _ := fi.(os.FileInfo)
+	return info, nil
+}
+
+// RegionURLWithContext gets the redirect URL to an object as RegionURL does, returning the error of the context if
+// it is done first
+func RegionURLWithContext(ctx context.Context, objStorage ObjectStorage, p, name, region string) (*url.URL, error) {
+	if cs, ok := objStorage.(ContextStorage); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return cs.RegionURLContext(ctx, p, name, region)
+	}
+	u, err := withContext(ctx, func() (interface{}, error) {
+		return RegionURL(objStorage, p, name, region)
+	})
+	if err != nil {
+		return nil, err
+	}
+	redirect, _ := u.(*url.URL)
+	return redirect, nil
+}
+
 // Copy copys a file from source ObjectStorage to dest ObjectStorage
 func Copy(dstStorage ObjectStorage, dstPath string, srcStorage ObjectStorage, srcPath string) (int64, error) {
 	f, err := srcStorage.Open(srcPath)
@@ -85,6 +251,12 @@ func Copy(dstStorage ObjectStorage, dstPath string, srcStorage ObjectStorage, sr
 
 // SaveFrom saves data to the ObjectStorage with path p from the callback
 func SaveFrom(objStorage ObjectStorage, p string, callback func(w io.Writer) error) error {
+	return SaveFromWithFilename(objStorage, p, "", callback)
+}
+
+// SaveFromWithFilename saves data to the ObjectStorage with path p from the callback, along with the filename
+// it should be downloaded as
+func SaveFromWithFilename(objStorage ObjectStorage, p, filename string, callback func(w io.Writer) error) error {
 	pr, pw := io.Pipe()
 	defer pr.Close()
 	go func() {
@@ -94,7 +266,7 @@ func SaveFrom(objStorage ObjectStorage, p string, callback func(w io.Writer) err
 		}
 	}()
 
-	_, err := objStorage.Save(p, pr)
+	_, err := SaveWithFilename(objStorage, p, pr, filename)
 	return err
 }
 
@@ -107,8 +279,12 @@ var (
 
 	// Avatars represents user avatars storage
 	Avatars ObjectStorage
+	// AvatarsFallback represents the storage user avatars not found in Avatars are read from, if any
+	AvatarsFallback ObjectStorage
 	// RepoAvatars represents repository avatars storage
 	RepoAvatars ObjectStorage
+	// RepoAvatarsFallback represents the storage repository avatars not found in RepoAvatars are read from, if any
+	RepoAvatarsFallback ObjectStorage
 )
 
 // Init init the stoarge
@@ -141,9 +317,22 @@ func NewStorage(typStr string, cfg interface{}) (ObjectStorage, error) {
 	return fn(context.Background(), cfg)
 }
 
+// newFallbackStorage returns the ObjectStorage for the fallback of a storage, or nil if it has none
+func newFallbackStorage(cfg *setting.Storage) (ObjectStorage, error) {
+	if cfg.Fallback == nil {
+		return nil, nil
+	}
+	log.Info("Initialising fallback storage with type: %s", cfg.Fallback.Type)
+	return NewStorage(cfg.Fallback.Type, cfg.Fallback)
+}
+
 func initAvatars() (err error) {
 	log.Info("Initialising Avatar storage with type: %s", setting.Avatar.Storage.Type)
 	Avatars, err = NewStorage(setting.Avatar.Storage.Type, &setting.Avatar.Storage)
+	if err != nil {
+		return
+	}
+	AvatarsFallback, err = newFallbackStorage(&setting.Avatar.Storage)
 	return
 }
 
@@ -162,5 +351,9 @@ func initLFS() (err error) {
 func initRepoAvatars() (err error) {
 	log.Info("Initialising Repository Avatar storage with type: %s", setting.RepoAvatar.Storage.Type)
 	RepoAvatars, err = NewStorage(setting.RepoAvatar.Storage.Type, &setting.RepoAvatar.Storage)
+	if err != nil {
+		return
+	}
+	RepoAvatarsFallback, err = newFallbackStorage(&setting.RepoAvatar.Storage)
 	return
 }
@@ -0,0 +1,74 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package timing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The phases of handling a request which are timed
+const (
+	PhaseAuth    = "auth"
+	PhaseRender  = "render"
+	PhaseStorage = "storage"
+)
+
+type recorderContextKey struct{}
+
+// recorder holds the time spent in each phase of a request, in the order the phases were first recorded
+type recorder struct {
+	lock      sync.Mutex
+	phases    []string
+	durations map[string]time.Duration
+}
+
+// WithRecorder returns a context in which the time spent in the phases of the request can be recorded with Start
+func WithRecorder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recorderContextKey{}, &recorder{durations: make(map[string]time.Duration)})
+}
+
+// Start starts timing a phase of the request of the context and returns the function to stop it with. The time
+// of a phase that is timed more than once is added up. It does nothing if the context has no recorder.
+func Start(ctx context.Context, phase string) (stop func()) {
+	r, ok := ctx.Value(recorderContextKey{}).(*recorder)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		duration := time.Since(start)
+		r.lock.Lock()
+		if _, ok := r.durations[phase]; !ok {
+			r.phases = append(r.phases, phase)
+		}
+		r.durations[phase] += duration
+		r.lock.Unlock()
+	}
+}
+
+// Header returns the Server-Timing header value of the phases recorded so far for the request of the
+// context, e.g. `auth;dur=1.2, render;dur=15.3`, or "" if there are none
+func Header(ctx context.Context) string {
+	r, ok := ctx.Value(recorderContextKey{}).(*recorder)
+	if !ok {
+		return ""
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries := make([]string, 0, len(r.phases))
+	for _, phase := range r.phases {
+		entries = append(entries, Entry(phase, r.durations[phase]))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// Entry formats a Server-Timing entry for a duration, in milliseconds
+func Entry(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(duration)/float64(time.Millisecond))
+}
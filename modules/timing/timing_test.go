@@ -0,0 +1,41 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package timing
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	// without a recorder nothing is recorded
+	ctx := context.Background()
+	Start(ctx, PhaseAuth)()
+	assert.Empty(t, Header(ctx))
+
+	ctx = WithRecorder(ctx)
+	assert.Empty(t, Header(ctx))
+
+	stop := Start(ctx, PhaseAuth)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	Start(ctx, PhaseRender)()
+	stop = Start(ctx, PhaseAuth)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+
+	header := Header(ctx)
+	assert.Regexp(t, `^auth;dur=\d+\.\d, render;dur=\d+\.\d$`, header)
+	auth, err := strconv.ParseFloat(regexp.MustCompile(`auth;dur=([\d.]+)`).FindStringSubmatch(header)[1], 64)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, auth, 20.0)
+
+	assert.Equal(t, "total;dur=1.5", Entry("total", 1500*time.Microsecond))
+}
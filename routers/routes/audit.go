@@ -0,0 +1,103 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/gobwas/glob"
+)
+
+// auditEntry is an entry of the audit log
+type auditEntry struct {
+	Time     string            `json:"time"`
+	User     string            `json:"user"`
+	Method   string            `json:"method"`
+	Route    string            `json:"route"`
+	Path     string            `json:"path"`
+	Resource map[string]string `json:"resource,omitempty"`
+	Status   int               `json:"status"`
+	Result   string            `json:"result"`
+}
+
+// isMutatingMethod returns whether requests with the method change state
+func isMutatingMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// auditLog writes an entry to the audit logger for every state-changing request to a path matching any of
+// patterns once it has been handled. Requests answered with a 2xx are recorded as a success, 3xx such as the
+// redirects after a submitted form as a redirect and any others as a failure.
+func auditLog(patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(patterns) == 0 {
+			return next
+		}
+		logger := log.GetLogger("audit")
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !isMutatingMethod(req.Method) || !matchesPathGlobs(req.URL.Path, patterns) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			next.ServeHTTP(ww, req)
+
+			entry := auditEntry{
+				Time:   start.UTC().Format(time.RFC3339),
+				User:   SignedUserName(req),
+				Method: req.Method,
+				Route:  RoutePattern(req),
+				Path:   req.URL.Path,
+				Status: ww.Status(),
+				Result: "success",
+			}
+			if entry.User == "" {
+				entry.User = "-"
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			switch {
+			case entry.Status >= 400:
+				entry.Result = "failure"
+			case entry.Status >= 300:
+				entry.Result = "redirect"
+			}
+			if entry.Route == macaronRoutePattern {
+				// the macaron routes record the route they matched themselves
+				if pattern, params := context.GetRoute(req.Context()); pattern != "" {
+					entry.Route, entry.Resource = pattern, params
+				}
+			} else if rctx := chi.RouteContext(req.Context()); rctx != nil && len(rctx.URLParams.Keys) > 0 {
+				entry.Resource = make(map[string]string, len(rctx.URLParams.Keys))
+				for i, key := range rctx.URLParams.Keys {
+					entry.Resource[key] = rctx.URLParams.Values[i]
+				}
+			}
+
+			line, err := json.Marshal(entry)
+			if err != nil {
+				log.Error("Could not marshal audit log entry: %v", err)
+				return
+			}
+			if err := logger.SendLog(log.INFO, "", "", 0, string(line), ""); err != nil {
+				log.Error("Could not write audit log entry: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/context"
+
+	"gitea.com/macaron/macaron"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	read, reset := captureLog(t, "audit")
+	defer reset()
+
+	c := chi.NewRouter()
+	c.Use(auditLog(compilePathGlobs([]string{"/**"})))
+	c.Post("/{username}/{reponame}/settings", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("denied") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, req, req.URL.Path, http.StatusFound)
+	})
+	c.Get("/{username}/{reponame}/settings", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("settings"))
+	})
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user2/repo1/settings", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo1/settings", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo2/settings?denied=1", nil))
+
+	lines := strings.Split(strings.TrimSpace(read()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var entries [2]auditEntry
+	for i, line := range lines {
+		assert.NoError(t, json.Unmarshal([]byte(line), &entries[i]), line)
+	}
+
+	assert.Equal(t, "POST", entries[0].Method)
+	assert.Equal(t, "/{username}/{reponame}/settings", entries[0].Route)
+	assert.Equal(t, "/user2/repo1/settings", entries[0].Path)
+	assert.Equal(t, map[string]string{"username": "user2", "reponame": "repo1"}, entries[0].Resource)
+	assert.Equal(t, "-", entries[0].User)
+	assert.Equal(t, http.StatusFound, entries[0].Status)
+	assert.Equal(t, "redirect", entries[0].Result)
+	assert.NotEmpty(t, entries[0].Time)
+
+	assert.Equal(t, "repo2", entries[1].Resource["reponame"])
+	assert.Equal(t, http.StatusForbidden, entries[1].Status)
+	assert.Equal(t, "failure", entries[1].Result)
+}
+
+func TestAuditLogMacaronRoute(t *testing.T) {
+	read, reset := captureLog(t, "audit")
+	defer reset()
+
+	m := macaron.New()
+	// records the route like context.Contexter does
+	m.Use(func(c *macaron.Context) {
+		context.SetRoute(c.Req.Context(), c.Req.URL.EscapedPath(), c.AllParams())
+	})
+	m.Post("/:username/:reponame/issues/:index/comments", func(c *macaron.Context) {
+		c.Resp.WriteHeader(http.StatusCreated)
+	})
+	m.Post("/:username/:reponame/raw/*", func(c *macaron.Context) {
+		c.Resp.WriteHeader(http.StatusOK)
+	})
+
+	c := chi.NewRouter()
+	c.Use(recordRoute)
+	c.Use(auditLog(compilePathGlobs([]string{"/**"})))
+	c.Get("/api/healthz", func(w http.ResponseWriter, req *http.Request) {})
+	c.NotFound(m.ServeHTTP)
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo1/issues/1/comments", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo1/raw/branch/master/README.md", nil))
+
+	lines := strings.Split(strings.TrimSpace(read()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var entries [2]auditEntry
+	for i, line := range lines {
+		assert.NoError(t, json.Unmarshal([]byte(line), &entries[i]), line)
+	}
+
+	assert.Equal(t, "/:username/:reponame/issues/:index/comments", entries[0].Route)
+	assert.Equal(t, map[string]string{"username": "user2", "reponame": "repo1", "index": "1"}, entries[0].Resource)
+	assert.Equal(t, http.StatusCreated, entries[0].Status)
+	assert.Equal(t, "success", entries[0].Result)
+
+	assert.Equal(t, "/:username/:reponame/raw/*", entries[1].Route)
+	assert.Equal(t, "branch/master/README.md", entries[1].Resource["*"])
+}
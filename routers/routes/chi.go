@@ -6,103 +6,530 @@ package routes
 
 import (
 	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
-	"io"
+	"html"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
 
+	"code.gitea.io/gitea/modules/cache"
+	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/metrics"
 	"code.gitea.io/gitea/modules/public"
 	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/storage"
 
+	"gitea.com/macaron/macaron"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/gobwas/glob"
 )
 
 type routerLoggerOptions struct {
 	req            *http.Request
 	Identity       *string
+	AuthMethod     *string
 	Start          *time.Time
-	ResponseWriter http.ResponseWriter
+	StartFormatted *string
+	Duration       *time.Duration
+	CacheStatus    *string
+	RoutePattern   *string
+	ResponseWriter *accessLogResponseWriter
+}
+
+// IdentityWithAuthMethod returns the Identity followed by how the user authenticated, e.g. "user2 (token)",
+// or "-" if nobody is signed in
+func (opts routerLoggerOptions) IdentityWithAuthMethod() string {
+	if *opts.AuthMethod == "-" {
+		return *opts.Identity
+	}
+	return *opts.Identity + " (" + *opts.AuthMethod + ")"
+}
+
+// Method returns the method of the request
+func (opts routerLoggerOptions) Method() string {
+	return opts.req.Method
+}
+
+// RequestURI returns the request target of the request line, e.g. "/explore/repos?page=2", with the values
+// of the query parameters of ROUTER_LOG_REDACT_PARAMS redacted
+func (opts routerLoggerOptions) RequestURI() string {
+	return RedactURI(opts.req.RequestURI)
+}
+
+// Proto returns the protocol of the request, e.g. "HTTP/1.1"
+func (opts routerLoggerOptions) Proto() string {
+	return opts.req.Proto
+}
+
+// Host returns the host the request was sent to
+func (opts routerLoggerOptions) Host() string {
+	return opts.req.Host
+}
+
+// RemoteAddr returns the address of the client, or of the reverse proxy in front of Gitea
+func (opts routerLoggerOptions) RemoteAddr() string {
+	return opts.req.RemoteAddr
+}
+
+// ClientIP returns the IP address of the RemoteAddr without its port, e.g. "::1" for "[::1]:54321"
+func (opts routerLoggerOptions) ClientIP() string {
+	return clientAddr(opts.req)
+}
+
+// Referer returns the Referer header of the request
+func (opts routerLoggerOptions) Referer() string {
+	return opts.req.Referer()
+}
+
+// UserAgent returns the User-Agent header of the request
+func (opts routerLoggerOptions) UserAgent() string {
+	return opts.req.UserAgent()
+}
+
+// BytesReceived returns the size of the request body from its Content-Length, or 0 if it has none
+func (opts routerLoggerOptions) BytesReceived() int64 {
+	if opts.req.ContentLength > 0 {
+		return opts.req.ContentLength
+	}
+	return 0
+}
+
+// BytesSent returns the number of bytes written to the response body
+func (opts routerLoggerOptions) BytesSent() int {
+	return opts.ResponseWriter.Size()
+}
+
+// RequestID returns the ID of the request, which is also logged with its started line
+func (opts routerLoggerOptions) RequestID() string {
+	return middleware.GetReqID(opts.req.Context())
+}
+
+// ncsaEscape escapes the quotes, backslashes and control characters of a quoted field of an NCSA log line
+// the way Apache does, so that a request cannot forge the fields following it
+func ncsaEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// RedactURI replaces the values of the query parameters of ROUTER_LOG_REDACT_PARAMS in the request URI with ***,
+// e.g. "/api/v1/user?token=***", so that secrets do not end up in the logs. Parameters holding a further URI,
+// e.g. "redirect_to=%2Fuser%2Flogin%3Ftoken%3D...", have that redacted as well.
+func RedactURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 || len(setting.RouterLogRedactParams) == 0 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			key = kv[0]
+		}
+		if isRedactedParam(key) {
+			params[j] = kv[0] + "=***"
+			continue
+		}
+		if value, err := url.QueryUnescape(kv[1]); err == nil && strings.Contains(value, "?") {
+			if redacted := RedactURI(value); redacted != value {
+				params[j] = kv[0] + "=" + url.QueryEscape(redacted)
+			}
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+func isRedactedParam(key string) bool {
+	for _, name := range setting.RouterLogRedactParams {
+		if strings.EqualFold(key, strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ncsaLogLine formats the access log line of a request in the NCSA common log format, i.e.
+// `host ident authuser [date] "request" status bytes`, followed by `"referer" "user-agent"` for the
+// combined log format
+func ncsaLogLine(opts routerLoggerOptions, combined bool) string {
+	host := clientAddr(opts.req)
+	size := "-"
+	if n := opts.BytesSent(); n > 0 {
+		size = strconv.Itoa(n)
+	}
+	line := fmt.Sprintf(`%s - %s %s "%s" %d %s`, host, *opts.Identity, opts.Start.Format("[02/Jan/2006:15:04:05 -0700]"),
+		ncsaEscape(opts.Method()+" "+opts.RequestURI()+" "+opts.Proto()), opts.ResponseWriter.Status(), size)
+	if combined {
+		referer, userAgent := "-", "-"
+		if val := opts.Referer(); val != "" {
+			referer = ncsaEscape(val)
+		}
+		if val := opts.UserAgent(); val != "" {
+			userAgent = ncsaEscape(val)
+		}
+		line += fmt.Sprintf(` "%s" "%s"`, referer, userAgent)
+	}
+	return line
+}
+
+// accessLogResponseWriter exposes the status and size of a response to the access log template
+type accessLogResponseWriter struct {
+	middleware.WrapResponseWriter
+}
+
+// Status returns the status code of the response, handlers that never write a header respond with 200
+func (w *accessLogResponseWriter) Status() int {
+	if status := w.WrapResponseWriter.Status(); status != 0 {
+		return status
+	}
+	return http.StatusOK
+}
+
+// Size returns the number of bytes written to the response body
+func (w *accessLogResponseWriter) Size() int {
+	return w.BytesWritten()
+}
+
+// recordIdentity lets the macaron routes record the signed in user of a request for SignedUserName and
+// SignedUserAuthMethod, which the middlewares wrapping them can only call once they have handled the request
+func recordIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithIdentityRecorder(req.Context())))
+	})
+}
+
+// recordRoute lets the macaron routes record the route handling a request, which the middlewares wrapping them
+// can only get once they have handled the request
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithRouteRecorder(req.Context())))
+	})
 }
 
 // SignedUserName returns signed user's name via context
 // FIXME currently no any data stored on gin.Context but macaron.Context, so this will
-// return "" before we remove macaron totally
+// return "" unless the macaron routes have recorded it before we remove macaron totally
 func SignedUserName(req *http.Request) string {
+	if name, _ := context.GetIdentity(req.Context()); name != "" {
+		return name
+	}
 	if v, ok := req.Context().Value("SignedUserName").(string); ok {
 		return v
 	}
 	return ""
 }
 
-func setupAccessLogger(c chi.Router) {
+// SignedUserAuthMethod returns how the signed in user authenticated, e.g. "session", "token" or "basic", or ""
+// if nobody is signed in
+func SignedUserAuthMethod(req *http.Request) string {
+	_, authMethod := context.GetIdentity(req.Context())
+	return authMethod
+}
+
+// macaronRoutePattern is the route pattern of requests which are handled by the macaron fallback
+const macaronRoutePattern = "(macaron)"
+
+// RoutePattern returns the pattern of the chi route handling the request, e.g. "/avatars/*", or
+// "(macaron)" if it is handled by the macaron fallback. Middlewares only get the pattern once the
+// request has been routed, i.e. after calling the next handler.
+func RoutePattern(req *http.Request) string {
+	rctx := chi.RouteContext(req.Context())
+	if rctx == nil {
+		return ""
+	}
+	if pattern := rctx.RoutePattern(); pattern != "" {
+		return pattern
+	}
+	return macaronRoutePattern
+}
+
+// hasPathPrefix returns whether p is prefix or begins with the path segments of prefix
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || p == prefix+"/" || strings.HasPrefix(p, prefix+"/")
+}
+
+// matchesRequestPrefixes returns whether the request matches any of the path prefixes, which may be
+// restricted to a single method by preceding them with the method, e.g. "HEAD /"
+func matchesRequestPrefixes(req *http.Request, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if idx := strings.IndexByte(prefix, ' '); idx > 0 {
+			if !strings.EqualFold(prefix[:idx], req.Method) {
+				continue
+			}
+			prefix = strings.TrimSpace(prefix[idx+1:])
+		}
+		if hasPathPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogTemplate holds the parsed ACCESS_LOG_TEMPLATE, it is swapped by ReloadAccessLogTemplate whilst
+// requests are being logged
+var accessLogTemplate atomic.Value
+
+// ReloadAccessLogTemplate reads the ACCESS_LOG_TEMPLATE from app.ini again and writes the access log with it
+// from now on. If it cannot be read or parsed the current template is kept.
+func ReloadAccessLogTemplate() error {
+	source, err := setting.ReadAccessLogTemplate()
+	if err != nil {
+		log.Error("Unable to reload the ACCESS_LOG_TEMPLATE, keeping the current one: %v", err)
+		return err
+	}
+	logTemplate, err := template.New("log").Parse(source)
+	if err != nil {
+		log.Error("Unable to parse the ACCESS_LOG_TEMPLATE, keeping the current one: %v", err)
+		return fmt.Errorf("unable to parse the ACCESS_LOG_TEMPLATE: %v", err)
+	}
+	accessLogTemplate.Store(logTemplate)
+	log.Info("Reloaded the ACCESS_LOG_TEMPLATE")
+	return nil
+}
+
+// setupAccessLogger adds the access logger to the router, writing the lines in the preset format of
+// setting.AccessLogFormat or else with tmpl. It has to be added before Recovery() so that requests which panic are
+// logged with the 500 written by Recovery() and their full duration.
+func setupAccessLogger(c chi.Router, tmpl string) {
 	logger := log.GetLogger("access")
 
-	logTemplate, _ := template.New("log").Parse(setting.AccessLogTemplate)
+	logTemplate, err := template.New("log").Parse(tmpl)
+	if err != nil {
+		log.Error("Unable to parse the ACCESS_LOG_TEMPLATE: %v", err)
+	} else {
+		accessLogTemplate.Store(logTemplate)
+	}
 	c.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if matchesRequestPrefixes(req, setting.AccessLogExcludePaths) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
 			start := time.Now()
-			next.ServeHTTP(w, req)
-			identity := "-"
+			if matchesRequestPrefixes(req, setting.AccessLogTraceStartPaths) {
+				// long running requests such as clones are otherwise only seen once they are done
+				line := fmt.Sprintf(`%s "%s" started, request %s`, clientAddr(req), ncsaEscape(req.Method+" "+RedactURI(req.RequestURI)+" "+req.Proto), middleware.GetReqID(req.Context()))
+				if err := logger.SendLog(log.DEBUG, "", "", 0, line, ""); err != nil {
+					log.Error("Could not set up macaron access logger: %v", err.Error())
+				}
+			}
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			req = req.WithContext(cache.WithStatusRecorder(req.Context()))
+			var aborted interface{}
+			func() {
+				// responses aborted by Recovery() or a handler are logged before the connection is closed
+				defer func() {
+					aborted = recover()
+				}()
+				next.ServeHTTP(ww, req)
+			}()
+			duration := time.Since(start)
+			identity, authMethod := "-", "-"
 			if val := SignedUserName(req); val != "" {
 				identity = val
+				if val := SignedUserAuthMethod(req); val != "" {
+					authMethod = val
+				}
 			}
-			rw := w
+			cacheStatus := "-"
+			if val := cache.GetStatus(req.Context()); val != "" {
+				cacheStatus = val
+			}
+			routePattern := RoutePattern(req)
+			logStart := start
+			if setting.AccessLogUseUTC {
+				logStart = logStart.UTC()
+			}
+			startFormatted := logStart.Format(setting.AccessLogTimeFormat)
 
-			buf := bytes.NewBuffer([]byte{})
-			err := logTemplate.Execute(buf, routerLoggerOptions{
+			opts := routerLoggerOptions{
 				req:            req,
 				Identity:       &identity,
-				Start:          &start,
-				ResponseWriter: rw,
-			})
-			if err != nil {
-				log.Error("Could not set up macaron access logger: %v", err.Error())
+				AuthMethod:     &authMethod,
+				Start:          &logStart,
+				StartFormatted: &startFormatted,
+				Duration:       &duration,
+				CacheStatus:    &cacheStatus,
+				RoutePattern:   &routePattern,
+				ResponseWriter: &accessLogResponseWriter{ww},
+			}
+			var line string
+			switch setting.AccessLogFormat {
+			case "combined", "common":
+				line = ncsaLogLine(opts, setting.AccessLogFormat == "combined")
+			default:
+				buf := bytes.NewBuffer([]byte{})
+				// there is none if the ACCESS_LOG_TEMPLATE could not be parsed
+				if logTemplate, ok := accessLogTemplate.Load().(*template.Template); ok {
+					if err := logTemplate.Execute(buf, opts); err != nil {
+						log.Error("Could not set up macaron access logger: %v", err.Error())
+					}
+				}
+				line = buf.String()
 			}
 
-			err = logger.SendLog(log.INFO, "", "", 0, buf.String(), "")
+			err := logger.SendLog(log.INFO, "", "", 0, line, "")
 			if err != nil {
 				log.Error("Could not set up macaron access logger: %v", err.Error())
 			}
+			if aborted != nil {
+				panic(aborted)
+			}
 		})
 	})
 }
 
+// routerLogSampler picks 1 in rate of the requests with a path matching its patterns to be logged by the router
+type routerLogSampler struct {
+	// count is first so that it is aligned for the atomic operations on 32-bit platforms
+	count    uint64
+	rate     uint64
+	patterns []glob.Glob
+}
+
+// sample returns whether the next request is to be logged, which is the first of every rate requests
+func (s *routerLogSampler) sample() bool {
+	return s.rate <= 1 || atomic.AddUint64(&s.count, 1)%s.rate == 1
+}
+
+// compileRouterLogSamplers returns a sampler for each of the rates, in order, followed by one for any other path
+// with the defaultRate
+func compileRouterLogSamplers(defaultRate int, rates []setting.LogSampleRate) []*routerLogSampler {
+	samplers := make([]*routerLogSampler, 0, len(rates)+1)
+	for _, rate := range rates {
+		if patterns := compilePathGlobs([]string{rate.Path}); len(patterns) > 0 && rate.Rate > 0 {
+			samplers = append(samplers, &routerLogSampler{rate: uint64(rate.Rate), patterns: patterns})
+		}
+	}
+	if defaultRate < 1 {
+		defaultRate = 1
+	}
+	return append(samplers, &routerLogSampler{rate: uint64(defaultRate)})
+}
+
+// samplerFor returns the first of the samplers whose patterns match p, or the last sampler
+func samplerFor(samplers []*routerLogSampler, p string) *routerLogSampler {
+	for _, s := range samplers[:len(samplers)-1] {
+		if matchesPathGlobs(p, s.patterns) {
+			return s
+		}
+	}
+	return samplers[len(samplers)-1]
+}
+
 // LoggerHandler is a handler that will log the routing to the default gitea log
 func LoggerHandler(level log.Level) func(next http.Handler) http.Handler {
+	return sampledLoggerHandler(level, compileRouterLogSamplers(setting.RouterLogSampleRate, setting.RouterLogSampleRates), setting.RouterLogSlowThreshold)
+}
+
+// sampledLoggerHandler logs the routing like LoggerHandler, but only of the requests picked by the first sampler
+// whose patterns match their path, or the last sampler. The completion of the other requests is still logged if
+// they fail with a 5xx or take at least slow, so that no errors are lost. A slow of 0 or less disables the latter.
+func sampledLoggerHandler(level log.Level, samplers []*routerLogSampler, slow time.Duration) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			start := time.Now()
 
-			_ = log.GetLogger("router").Log(0, level, "Started %s %s for %s", log.ColoredMethod(req.Method), req.RequestURI, req.RemoteAddr)
+			sampled := samplerFor(samplers, req.URL.Path).sample()
 
-			next.ServeHTTP(w, req)
+			if sampled {
+				_ = log.GetLogger("router").Log(0, level, "Started %s %s for %s", log.ColoredMethod(req.Method), RedactURI(req.RequestURI), clientAddr(req))
+			}
 
 			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
 
+			next.ServeHTTP(ww, req)
+
 			status := ww.Status()
-			_ = log.GetLogger("router").Log(0, level, "Completed %s %s %v %s in %v", log.ColoredMethod(req.Method), req.RequestURI, log.ColoredStatus(status), log.ColoredStatus(status, http.StatusText(status)), log.ColoredTime(time.Since(start)))
+			if status == 0 {
+				status = http.StatusOK
+			}
+			duration := time.Since(start)
+			if !sampled && status < http.StatusInternalServerError && (slow <= 0 || duration < slow) {
+				return
+			}
+			_ = log.GetLogger("router").Log(0, level, "Completed %s %s %v %s in %v", log.ColoredMethod(req.Method), RedactURI(req.RequestURI), log.ColoredStatus(status), log.ColoredStatus(status, http.StatusText(status)), log.ColoredTime(duration))
 		})
 	}
 }
 
+// OnPanic, if set, is called by Recovery() with the request, the recovered value and the stack trace
+// whenever a handler panics, e.g. to send an alert. A panic within OnPanic is logged and ignored.
+var OnPanic func(req *http.Request, err interface{}, stack []byte)
+
+// callOnPanic calls OnPanic if it is set, protecting the request from any panic within it
+func callOnPanic(req *http.Request, err interface{}, stack []byte) {
+	if OnPanic == nil {
+		return
+	}
+	defer func() {
+		if hookErr := recover(); hookErr != nil {
+			log.Error("PANIC in OnPanic hook: %v\n%s", hookErr, string(log.Stack(2)))
+		}
+	}()
+	OnPanic(req, err, stack)
+}
+
 // Recovery returns a middleware that recovers from any panics and writes a 500 and a log if so.
 // Although similar to macaron.Recovery() the main difference is that this error will be created
-// with the gitea 500 page.
+// with the gitea 500 page. API clients get a JSON error body instead of the page. The panic and its
+// stack are only logged, the client just gets a generic error with the request ID to report. Panics with
+// http.ErrAbortHandler are passed on so that the server closes the connection. If the response
+// has already been started the 500 would only be appended to it, so the panic is logged and the
+// connection closed instead, letting the client know that the response is incomplete.
 func Recovery() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			committed := false
+			w = onWriteHeader(w, func(int) {
+				committed = true
+			})
 			defer func() {
 				if err := recover(); err != nil {
-					combinedErr := fmt.Sprintf("PANIC: %v\n%s", err, string(log.Stack(2)))
-					http.Error(w, combinedErr, 500)
+					if err == http.ErrAbortHandler {
+						// the connection is to be closed without a response, which the server does for us
+						panic(err)
+					}
+					stack := log.Stack(2)
+					if p, ok := err.(*handlerPanic); ok {
+						// the handler panicked in a goroutine of its own, whose stack tells where
+						err, stack = p.value, p.stack
+					}
+					callOnPanic(req, err, []byte(stack))
+					combinedErr := fmt.Sprintf("PANIC: %v\n%s", err, stack)
+					if committed {
+						log.Error("%s panicked after its response was started: %s", panicContext(req), combinedErr)
+						panic(http.ErrAbortHandler)
+					}
+					log.Error("%s panicked: %s", panicContext(req), combinedErr)
+					writeRecoveryError(w, req)
 				}
 			}()
 
@@ -111,116 +538,424 @@ func Recovery() func(next http.Handler) http.Handler {
 	}
 }
 
-func storageHandler(storageSetting setting.Storage, prefix string, objStore storage.ObjectStorage) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		if storageSetting.ServeDirect {
-			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				if req.Method != "GET" && req.Method != "HEAD" {
-					next.ServeHTTP(w, req)
-					return
-				}
+// panicContext describes the request which panicked for the log, e.g.
+// `GET /api/v1/user?token=*** from 192.0.2.1, request host/abc-000001`, so that the panic can be related to it
+func panicContext(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	description := fmt.Sprintf("%s %s from %s", req.Method, RedactURI(uri), clientAddr(req))
+	if id := middleware.GetReqID(req.Context()); id != "" {
+		description += ", request " + id
+	}
+	return description
+}
 
-				if !strings.HasPrefix(req.RequestURI, "/"+prefix) {
-					next.ServeHTTP(w, req)
-					return
-				}
+// isAPIRequest returns whether the request is for the API, whose clients expect JSON error bodies
+func isAPIRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/api/")
+}
 
-				rPath := strings.TrimPrefix(req.RequestURI, "/"+prefix)
-				u, err := objStore.URL(rPath, path.Base(rPath))
-				if err != nil {
-					if os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) {
-						log.Warn("Unable to find %s %s", prefix, rPath)
-						http.Error(w, "file not found", 404)
-						return
-					}
-					log.Error("Error whilst getting URL for %s %s. Error: %v", prefix, rPath, err)
-					http.Error(w, fmt.Sprintf("Error whilst getting URL for %s %s", prefix, rPath), 500)
-					return
-				}
-				http.Redirect(
-					w,
-					req,
-					u.String(),
-					301,
-				)
-			})
-		}
+// prefersJSON returns whether the request is for the API or only accepts JSON rather than HTML
+func prefersJSON(req *http.Request) bool {
+	if isAPIRequest(req) {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeRecoveryError writes a generic 500 in the format the client expects: problem details if it asks for
+// them, the usual {"message": "...", "url": "..."} error body of the API for API clients, and an HTML page for
+// browsers. The message only tells the request ID, if there is one, never what went wrong.
+func writeRecoveryError(w http.ResponseWriter, req *http.Request) {
+	message := http.StatusText(http.StatusInternalServerError)
+	if id := middleware.GetReqID(req.Context()); id != "" {
+		message += ", request " + id
+	}
+	if context.WantsProblemDetails(req) {
+		context.WriteProblemDetails(w, req, http.StatusInternalServerError, message)
+		return
+	}
+	if prefersJSON(req) {
+		writeJSONError(w, http.StatusInternalServerError, message)
+		return
+	}
 
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%[1]s</title></head><body><h1>%[1]s</h1><p>%[2]s</p></body></html>\n",
+		http.StatusText(http.StatusInternalServerError), html.EscapeString(message))
+}
+
+// writeJSONError writes the usual {"message": "...", "url": "..."} error body of the API with the status
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{
+		"message": message,
+		"url":     setting.API.SwaggerURL,
+	})
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// rootGitPathNotFound returns a 404 for requests for a git directory on the web root, e.g. /.git/config,
+// without passing them on to the rest of the handlers. Repository git endpoints such as
+// /owner/repo.git/info/refs are not affected.
+func rootGitPathNotFound() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			if req.Method != "GET" && req.Method != "HEAD" {
-				next.ServeHTTP(w, req)
+			if req.URL.Path == "/.git" || strings.HasPrefix(req.URL.Path, "/.git/") {
+				http.NotFound(w, req)
 				return
 			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
 
-			if !strings.HasPrefix(req.RequestURI, "/"+prefix) {
-				next.ServeHTTP(w, req)
-				return
-			}
+// writeErrorPage answers a request without going through Macaron: with the usual JSON error body for API
+// clients, with the first of the pages which exists for anybody else and with a plain text error otherwise. The
+// pages are read for every request so that they can be changed without restarting.
+func writeErrorPage(w http.ResponseWriter, req *http.Request, status int, message string, pages ...string) {
+	if prefersJSON(req) {
+		writeJSONError(w, status, message)
+		return
+	}
 
-			rPath := strings.TrimPrefix(req.RequestURI, "/"+prefix)
-			rPath = strings.TrimPrefix(rPath, "/")
-			//If we have matched and access to release or issue
-			fr, err := objStore.Open(rPath)
-			if err != nil {
-				if os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) {
-					log.Warn("Unable to find %s %s", prefix, rPath)
-					http.Error(w, "file not found", 404)
-					return
-				}
-				log.Error("Error whilst opening %s %s. Error: %v", prefix, rPath, err)
-				http.Error(w, fmt.Sprintf("Error whilst opening %s %s", prefix, rPath), 500)
-				return
+	for _, page := range pages {
+		body, err := ioutil.ReadFile(page)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("Unable to read the %d page %s: %v", status, page, err)
 			}
-			defer fr.Close()
+			continue
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+		return
+	}
+	http.Error(w, message, status)
+}
 
-			_, err = io.Copy(w, fr)
-			if err != nil {
-				log.Error("Error whilst rendering %s %s. Error: %v", prefix, rPath, err)
-				http.Error(w, fmt.Sprintf("Error whilst rendering %s %s", prefix, rPath), 500)
-				return
-			}
-		})
+// statusPage returns the path of the custom page for the status, custom/public/<status>.html
+func statusPage(status int) string {
+	return path.Join(setting.CustomPath, "public", strconv.Itoa(status)+".html")
+}
+
+// renderStatus answers a request rejected with the status, e.g. 413, 429 or 503 by one of the limits, the same
+// way whichever middleware rejected it: with custom/public/<status>.html if it exists and the request is not from
+// an API client. Headers already set for the response, such as Retry-After, are kept.
+func renderStatus(w http.ResponseWriter, req *http.Request, status int) {
+	writeErrorPage(w, req, status, http.StatusText(status), statusPage(status))
+}
+
+// staticNotFound answers requests for missing static assets with a 404, using the page if it exists
+func staticNotFound(page string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeErrorPage(w, req, http.StatusNotFound, http.StatusText(http.StatusNotFound), page)
+	}
+}
+
+// allowedMethods returns the methods routes has a route for the path with
+func allowedMethods(routes chi.Routes, path string) []string {
+	var allowed []string
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		if routes.Match(chi.NewRouteContext(), method, path) {
+			allowed = append(allowed, method)
+		} else if method == "HEAD" && len(allowed) > 0 && allowed[0] == "GET" {
+			// GET routes also answer HEAD requests through middleware.GetHead
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// methodNotAllowedResponseWriter replaces a 404 from the fallback handler with a 405 listing the allowed methods
+type methodNotAllowedResponseWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	allowed     []string
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *methodNotAllowedResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
 	}
+	w.wroteHeader = true
+	if status != http.StatusNotFound {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.replaced = true
+	// only drop the headers describing the 404 body, headers set earlier in the chain such as
+	// Strict-Transport-Security or Set-Cookie still apply to the 405
+	header := w.ResponseWriter.Header()
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Encoding", "ETag", "Last-Modified"} {
+		header.Del(key)
+	}
+	header.Set("Allow", strings.Join(w.allowed, ", "))
+	if context.WantsProblemDetails(w.req) {
+		context.WriteProblemDetails(w.ResponseWriter, w.req, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if isAPIRequest(w.req) {
+		writeJSONError(w.ResponseWriter, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	http.Error(w.ResponseWriter, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func (w *methodNotAllowedResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// methodNotAllowed handles requests for a path chi has routes for, but not with the request method.
+// These are passed on to fallback, which handles the rest of the routes, and if it cannot find a route
+// either they are answered with a 405 and an Allow header listing the methods chi has routes for.
+func methodNotAllowed(fallback http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rctx := chi.RouteContext(req.Context())
+		if rctx == nil || rctx.Routes == nil {
+			fallback.ServeHTTP(w, req)
+			return
+		}
+		routePath := rctx.RoutePath
+		if routePath == "" {
+			routePath = req.URL.Path
+		}
+		allowed := allowedMethods(rctx.Routes, routePath)
+		if len(allowed) == 0 {
+			fallback.ServeHTTP(w, req)
+			return
+		}
+
+		mw := &methodNotAllowedResponseWriter{ResponseWriter: w, req: req, allowed: allowed}
+		fallback.ServeHTTP(mw, req)
+		if !mw.wroteHeader {
+			mw.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// checkStaticAssets warns that the static assets are missing from dir, as without them every page is rendered
+// without its styles and scripts, or refuses to start if they are required
+func checkStaticAssets(dir string, required bool) {
+	err := public.CheckAssets(dir)
+	if err == nil {
+		return
+	}
+	if required {
+		log.Fatal("The static assets are missing: %v. Set STATIC_ROOT_PATH in [server] to the directory containing the public directory, or build Gitea with the bindata tag", err)
+		return
+	}
+	log.Warn("The static assets are missing: %v. Pages will be rendered without their styles and scripts. Set STATIC_ROOT_PATH in [server] to the directory containing the public directory, or build Gitea with the bindata tag", err)
+}
+
+// ChiOptions are the settings NewChiWithOptions builds the router with, so that a router with particular middlewares
+// and storages can be built without changing the settings. The middlewares not covered by them read the settings.
+type ChiOptions struct {
+	// RouterLogLevel is the level the router logger logs the requests at, log.NONE disables it
+	RouterLogLevel log.Level
+	// AccessLog adds the access logger, writing the lines with AccessLogTemplate unless an ACCESS_LOG_FORMAT is set
+	AccessLog         bool
+	AccessLogTemplate string
+	// AuditLog adds the audit logger for the requests to AuditLogPaths
+	AuditLog      bool
+	AuditLogPaths []string
+	// Gzip compresses the responses with CompressionAlgorithms
+	Gzip                  bool
+	CompressionAlgorithms []string
+	ForceHTTPS            bool
+	EnforceTrustedHosts   bool
+	// TrustedProxies are the reverse proxies whose forwarded client addresses and protocols are believed
+	TrustedProxies []string
+	// Maintenance switches the router into maintenance mode, letting through the requests from MaintenanceBypassIPs.
+	// Without one the router is never in maintenance mode.
+	Maintenance          *MaintenanceSwitch
+	MaintenanceBypassIPs []string
+	// DisableWebUI leaves out the static assets
+	DisableWebUI bool
+	// AvatarStorage and RepoAvatarStorage are the settings the avatars are served from Avatars and RepoAvatars with,
+	// the stores after the first are the fallbacks of the first
+	AvatarStorage     setting.Storage
+	Avatars           []storage.ObjectStorage
+	RepoAvatarStorage setting.Storage
+	RepoAvatars       []storage.ObjectStorage
 }
 
 // NewChi creates a chi Router
 func NewChi() chi.Router {
+	SetMaintenanceMode(setting.MaintenanceMode)
+	trustedProxies = parseTrustedProxies(setting.Proxy.TrustedProxies)
+	routerLogLevel := setting.RouterLogLevel
+	if setting.DisableRouterLog {
+		routerLogLevel = log.NONE
+	}
+	return NewChiWithOptions(ChiOptions{
+		RouterLogLevel:        routerLogLevel,
+		AccessLog:             setting.EnableAccessLog,
+		AccessLogTemplate:     setting.AccessLogTemplate,
+		AuditLog:              setting.EnableAuditLog,
+		AuditLogPaths:         setting.AuditLogPaths,
+		Gzip:                  setting.EnableGzip,
+		CompressionAlgorithms: setting.CompressionAlgorithms,
+		ForceHTTPS:            setting.ForceHTTPS,
+		EnforceTrustedHosts:   setting.EnforceTrustedHosts,
+		TrustedProxies:        setting.Proxy.TrustedProxies,
+		Maintenance:           maintenance,
+		MaintenanceBypassIPs:  setting.MaintenanceBypassIPs,
+		DisableWebUI:          setting.DisableWebUI,
+		AvatarStorage:         setting.Avatar.Storage,
+		Avatars:               []storage.ObjectStorage{storage.Avatars, storage.AvatarsFallback},
+		RepoAvatarStorage:     setting.RepoAvatar.Storage,
+		RepoAvatars:           []storage.ObjectStorage{storage.RepoAvatars, storage.RepoAvatarsFallback},
+	})
+}
+
+// NewChiWithOptions creates a chi Router with the middlewares set up by opts
+func NewChiWithOptions(opts ChiOptions) chi.Router {
 	c := chi.NewRouter()
-	if !setting.DisableRouterLog && setting.RouterLogLevel != log.NONE {
-		if log.GetLogger("router").GetLevel() <= setting.RouterLogLevel {
-			c.Use(LoggerHandler(setting.RouterLogLevel))
+	// first so that every middleware after it sees the clients behind the proxies
+	c.Use(trustProxies(parseTrustedProxies(opts.TrustedProxies)))
+	// the request ID joins the started and the completed line of a request in the access log, and is logged with
+	// any panic whether or not the access log is on
+	c.Use(middleware.RequestID)
+	c.Use(inFlight.track)
+	c.Use(recordIdentity)
+	c.Use(recordRoute)
+	// before the loggers so that they do not have to write out enormous paths
+	c.Use(maxURLLength(setting.MaxURLLength))
+	c.Use(rejectAmbiguousFraming())
+	// The loggers must wrap Recovery() so that they see the 500 it writes for a panic
+	if opts.RouterLogLevel != log.NONE {
+		if log.GetLogger("router").GetLevel() <= opts.RouterLogLevel {
+			c.Use(LoggerHandler(opts.RouterLogLevel))
 		}
 	}
+	if opts.AccessLog {
+		setupAccessLogger(c, opts.AccessLogTemplate)
+	}
+	if opts.AuditLog {
+		c.Use(auditLog(compilePathGlobs(opts.AuditLogPaths)))
+	}
+	// before Recovery() so that the 500 it writes for a panic tells the instance too
+	version := ""
+	if setting.ShowVersionHeader {
+		version = setting.AppVer
+	}
+	c.Use(instanceHeaders(setting.InstanceName, version))
 	c.Use(Recovery())
-	if setting.EnableAccessLog {
-		setupAccessLogger(c)
+	if setting.EnableServerTiming {
+		if setting.ProdMode {
+			log.Warn("ENABLE_SERVER_TIMING is ignored in production, as the timings could leak information")
+		} else {
+			c.Use(serverTiming())
+		}
+	}
+	if opts.EnforceTrustedHosts {
+		c.Use(trustedHostGuard(trustedHostSet(setting.Domain, setting.TrustedHosts)))
+	}
+	if opts.ForceHTTPS {
+		c.Use(forceHTTPS(setting.HSTSMaxAge, setting.HSTSIncludeSubdomains))
 	}
+	if opts.Maintenance != nil {
+		c.Use(maintenanceGuard(opts.Maintenance, parseTrustedProxies(opts.MaintenanceBypassIPs), setting.MaintenanceRetryAfter, path.Join(setting.CustomPath, "public", "maintenance.html")))
+	}
+	c.Use(liftTransferDeadlines(setting.ReadTimeout, setting.WriteTimeout, compilePathGlobs(setting.LongTransferPaths)))
+	c.Use(middleware.GetHead)
+	c.Use(autoOptions())
+	c.Use(canonicalPathHandler(setting.RedirectToCanonicalPath, []string{"/avatars", "/repo-avatars"}))
+	c.Use(maxRequestHeaderCount(setting.MaxHeaderCount))
+	c.Use(maxRequestBodySize(setting.MaxRequestBodySize, bodySizeOverrides()))
+	c.Use(maxDecompressedBodySize(setting.MaxDecompressedBodySize, acceptsCompressedBody))
+	c.Use(maxUploadParts(setting.MaxUploadParts))
+	c.Use(maxResponseHeaderSize(setting.MaxResponseHeaderSize))
+	c.Use(paginationLimits(setting.API.DefaultPagingNum, setting.API.MaxResponseItems, setting.API.MaxPage, compilePaginationCaps(setting.API.PaginationCaps)))
+	c.Use(expensiveRequestLimiter(setting.MaxConcurrentExpensiveRequests, compilePathGlobs(setting.ExpensiveRequestPaths)))
+	c.Use(renderTimeout(setting.RenderTimeout, compilePathGlobs(setting.RenderRequestPaths)))
+	c.Use(rootGitPathNotFound())
+	c.Use(redirectPortGuard(allowedRedirectPorts()))
+	c.Use(robotsNoIndex(compilePathGlobs(setting.RobotsNoIndexPaths)))
+	c.Use(stripHopByHopHeaders())
+	c.Use(secureCookies(setting.SessionConfig.SameSite))
+	if opts.Gzip {
+		// the objects of the storages are sent as stored, so that their Content-Length and ranges are kept
+		c.Use(compressResponses(opts.CompressionAlgorithms, []string{"/avatars", "/repo-avatars"}))
+	}
+	c.Use(deduplicateDeliveries(setting.Webhook.DeduplicationTTL, setting.Webhook.DeduplicationHeaders, compilePathGlobs(setting.Webhook.DeduplicationPaths)))
+	usePreRoutingMiddlewares(c)
+	c.Use(guardPaths())
 	if setting.ProdMode {
 		log.Warn("ProdMode ignored")
 	}
 
+	if opts.DisableWebUI {
+		// without the web UI there is nothing to serve the static assets to
+		c.Use(storageHandler(opts.AvatarStorage, "avatars", opts.Avatars...))
+		c.Use(storageHandler(opts.RepoAvatarStorage, "repo-avatars", opts.RepoAvatars...))
+		return c
+	}
+
+	checkStaticAssets(path.Join(setting.StaticRootPath, "public"), setting.RequireStaticAssets)
+
+	immutablePaths := compilePathGlobs(setting.ImmutableStaticPaths)
+	immutable := func(file string) bool {
+		return matchesPathGlobs(file, immutablePaths)
+	}
 	c.Use(public.Custom(
 		&public.Options{
-			SkipLogging:  setting.DisableRouterLog,
-			ExpiresAfter: time.Hour * 6,
+			SkipLogging:   setting.DisableRouterLog,
+			ExpiresAfter:  setting.CustomStaticCacheTime,
+			Immutable:     immutable,
+			Precompressed: setting.ServePrecompressed,
 		},
 	))
 	c.Use(public.Static(
 		&public.Options{
-			Directory:    path.Join(setting.StaticRootPath, "public"),
-			SkipLogging:  setting.DisableRouterLog,
-			ExpiresAfter: time.Hour * 6,
+			Directory:     path.Join(setting.StaticRootPath, "public"),
+			SkipLogging:   setting.DisableRouterLog,
+			ExpiresAfter:  setting.StaticCacheTime,
+			Immutable:     immutable,
+			Precompressed: setting.ServePrecompressed,
+			NotFound:      staticNotFound(path.Join(setting.CustomPath, "public", "404.html")),
 		},
 	))
 
-	c.Use(storageHandler(setting.Avatar.Storage, "avatars", storage.Avatars))
-	c.Use(storageHandler(setting.RepoAvatar.Storage, "repo-avatars", storage.RepoAvatars))
+	c.Use(storageHandler(opts.AvatarStorage, "avatars", opts.Avatars...))
+	c.Use(storageHandler(opts.RepoAvatarStorage, "repo-avatars", opts.RepoAvatars...))
 
 	return c
 }
 
 // RegisterInstallRoute registers the install routes
 func RegisterInstallRoute(c chi.Router) {
+	// the installer is still running so the startup probe will not succeed yet
+	c.Get("/-/startupz", startupProbe)
+	c.Head("/-/startupz", startupProbe)
+
+	if setting.DisableWebUI {
+		// there is no web installer without the web UI
+		c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+			writeJSONError(w, http.StatusServiceUnavailable, "Gitea is not installed yet and DISABLE_WEB_UI disables the web installer, configure it in app.ini and set INSTALL_LOCK instead")
+		})
+		return
+	}
+
 	m := NewMacaron()
 	RegisterMacaronInstallRoute(m)
 
@@ -228,17 +963,23 @@ func RegisterInstallRoute(c chi.Router) {
 		m.ServeHTTP(w, req)
 	})
 
-	c.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) {
-		m.ServeHTTP(w, req)
-	})
+	c.MethodNotAllowed(methodNotAllowed(m))
 }
 
 // RegisterRoutes registers gin routes
 func RegisterRoutes(c chi.Router) {
 	// for health check
-	c.Head("/", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	c.Head("/", rootHealthCheck)
+
+	// the startup probe, health check and metrics are served on a listener of their own if it is set up
+	if setting.Metrics.ListenAddress == "" {
+		RegisterMonitoringRoutes(c)
+	}
+
+	registerDebugRoutes(c)
+
+	// the requests for missing routes are logged as sampled for the router log
+	notFoundSamplers := compileRouterLogSamplers(setting.RouterLogSampleRate, setting.RouterLogSampleRates)
 
 	// robots.txt
 	if setting.HasRobotsTxt {
@@ -247,14 +988,216 @@ func RegisterRoutes(c chi.Router) {
 		})
 	}
 
+	if setting.DisableWebUI {
+		m := NewMacaron()
+		RegisterMacaronAPIRoutes(m)
+
+		fallback := apiOnlyFallback(macaronAutoOptions(newMacaronRouteTable(m), m))
+		c.NotFound(countNotFound(notFoundSamplers, fallback))
+		c.MethodNotAllowed(methodNotAllowed(fallback))
+		return
+	}
+
+	// browsers ask for it whatever the pages link to, so it is answered without going through Macaron
+	c.Get("/favicon.ico", favicon())
+
+	// for password managers, see https://w3c.github.io/webappsec-change-password-url/
+	c.Get("/.well-known/change-password", changePassword)
+
 	m := NewMacaron()
 	RegisterMacaronRoutes(m)
 
-	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
-		m.ServeHTTP(w, req)
-	})
+	c.NotFound(countNotFound(notFoundSamplers, apiNotFound(macaronAutoOptions(newMacaronRouteTable(m), m))))
 
-	c.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) {
-		m.ServeHTTP(w, req)
+	c.MethodNotAllowed(methodNotAllowed(m))
+}
+
+// registerDebugRoutes registers the routes for debugging the routing, which are only registered in development
+// as they would expose the route map
+func registerDebugRoutes(c chi.Router) {
+	if macaron.Env != macaron.DEV {
+		return
+	}
+	c.Get("/-/routes", listRoutes(c))
+}
+
+type chiRoute struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+}
+
+// listRoutes returns the methods and patterns of the routes registered on the router when requested
+func listRoutes(c chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		routes := []chiRoute{}
+		if err := chi.Walk(c, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+			routes = append(routes, chiRoute{Method: method, Pattern: route})
+			return nil
+		}); err != nil {
+			log.Error("Unable to walk the routes: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(struct {
+			Routes []chiRoute `json:"routes"`
+			Note   string     `json:"note"`
+		}{
+			Routes: routes,
+			Note:   "requests not matching any of these routes are passed on to the Macaron routes",
+		})
+	}
+}
+
+// changePassword redirects to the page for changing the password of CHANGE_PASSWORD_URL
+func changePassword(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, setting.ChangePasswordURL, http.StatusFound)
+}
+
+// favicon serves img/favicon.png for /favicon.ico, from the custom public directory if it is overridden there,
+// and answers with 204 No Content if there is none. A favicon.ico of the custom public directory is served by
+// public.Custom before this is reached.
+func favicon() http.HandlerFunc {
+	noIcon := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
 	})
+	handler := public.Custom(&public.Options{
+		SkipLogging:  true,
+		ExpiresAfter: setting.CustomStaticCacheTime,
+	})(public.Static(&public.Options{
+		Directory:    path.Join(setting.StaticRootPath, "public"),
+		SkipLogging:  true,
+		ExpiresAfter: setting.StaticCacheTime,
+		NotFound:     noIcon,
+	})(noIcon))
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		icon := new(http.Request)
+		*icon = *req
+		icon.URL = &url.URL{Path: "/img/favicon.png"}
+		handler.ServeHTTP(w, icon)
+	}
+}
+
+// apiNotFoundResponseWriter replaces a 404 page from the fallback handler with the usual JSON error body of the API
+type apiNotFoundResponseWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *apiNotFoundResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.ResponseWriter.Header()
+	if status != http.StatusNotFound || strings.Contains(header.Get("Content-Type"), "json") {
+		// the API routes answer missing resources with JSON themselves
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.replaced = true
+	header.Del("Content-Length")
+	if context.WantsProblemDetails(w.req) {
+		context.WriteProblemDetails(w.ResponseWriter, w.req, http.StatusNotFound, "")
+		return
+	}
+	writeJSONError(w.ResponseWriter, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
+
+func (w *apiNotFoundResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming the responses of the API, e.g. of raw files, to the client
+func (w *apiNotFoundResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.replaced {
+		flusher.Flush()
+	}
+}
+
+// apiNotFound passes the requests no chi route matches on to fallback, replacing the HTML 404 page it renders for
+// unknown API paths with the usual {"message": "Not Found", "url": "..."} error body of the API
+func apiNotFound(fallback http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAPIRequest(req) {
+			fallback.ServeHTTP(w, req)
+			return
+		}
+		fallback.ServeHTTP(&apiNotFoundResponseWriter{ResponseWriter: w, req: req}, req)
+	}
+}
+
+// notFoundPrefixes are the first segments of the paths of the routes which the requests for missing routes are
+// counted by. Any other segment, e.g. a user name or what a scanner probes for, is counted as other so that the
+// number of series stays bounded.
+var notFoundPrefixes = map[string]bool{
+	".well-known":   true,
+	"admin":         true,
+	"api":           true,
+	"assets":        true,
+	"attachments":   true,
+	"avatar":        true,
+	"avatars":       true,
+	"explore":       true,
+	"issues":        true,
+	"login":         true,
+	"milestones":    true,
+	"notifications": true,
+	"org":           true,
+	"pulls":         true,
+	"repo":          true,
+	"repo-avatars":  true,
+	"user":          true,
+}
+
+// notFoundPrefix returns the prefix label of the not found requests for p
+func notFoundPrefix(p string) string {
+	segment := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	if segment == "" || notFoundPrefixes[segment] {
+		return segment
+	}
+	return "other"
+}
+
+// countNotFound counts the requests next answers with 404 Not Found in metrics.NotFoundRequests, e.g. to spot
+// scanners and broken links, and logs those picked by the samplers of their paths at INFO
+func countNotFound(samplers []*routerLogSampler, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(onWriteHeader(w, func(status int) {
+			if status != http.StatusNotFound {
+				return
+			}
+			metrics.NotFoundRequests.WithLabelValues(notFoundPrefix(req.URL.Path)).Inc()
+			if samplerFor(samplers, req.URL.Path).sample() {
+				log.Info("%s %s from %s was not found", req.Method, RedactURI(req.RequestURI), clientAddr(req))
+			}
+		}), req)
+	}
+}
+
+// apiOnlyFallback passes the requests for the routes of RegisterMacaronAPIRoutes on to m and answers any
+// other request with a JSON 404 without going through Macaron
+func apiOnlyFallback(m http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case hasPathPrefix(req.URL.Path, "/api"),
+			req.URL.Path == "/login/oauth/access_token",
+			req.URL.Path == "/swagger.v1.json":
+			m.ServeHTTP(w, req)
+		default:
+			writeJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+	}
 }
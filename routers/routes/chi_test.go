@@ -0,0 +1,1147 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/metrics"
+	"code.gitea.io/gitea/modules/public"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/storage"
+
+	"gitea.com/macaron/macaron"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLog adds a sublogger writing to a temporary file to the named logger and returns a function
+// reading back everything logged so far, and a function removing the sublogger again.
+func captureLog(t *testing.T, name string) (read func() string, reset func()) {
+	_, existed := log.NamedLoggers.Load(name)
+
+	dir, err := ioutil.TempDir("", "routes-log")
+	assert.NoError(t, err)
+	filename := filepath.Join(dir, "capture.log")
+	config := fmt.Sprintf(`{"filename":%q,"level":"trace","flags":-1,"rotate":false}`, filename)
+	assert.NoError(t, log.NewNamedLogger(name, 0, "capture", "file", config))
+
+	read = func() string {
+		// the loggers are unbuffered so once Flush has been received every earlier event has been passed on to
+		// the sublogger, and removing the sublogger waits for it to finish writing them
+		log.GetLogger(name).Flush()
+		_, _ = log.GetLogger(name).DelLogger("capture")
+		content, err := ioutil.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.NoError(t, log.NewNamedLogger(name, 0, "capture", "file", config))
+		return string(content)
+	}
+	reset = func() {
+		if existed {
+			_, _ = log.GetLogger(name).DelLogger("capture")
+		} else {
+			log.DelNamedLogger(name)
+		}
+		_ = os.RemoveAll(dir)
+	}
+	return read, reset
+}
+
+// captureAccessLog enables the access log with the given template, capturing it as captureLog does
+func captureAccessLog(t *testing.T, logTemplate string) (read func() string, reset func()) {
+	oldEnabled, oldTemplate := setting.EnableAccessLog, setting.AccessLogTemplate
+	setting.EnableAccessLog, setting.AccessLogTemplate = true, logTemplate
+
+	read, resetLog := captureLog(t, "access")
+	reset = func() {
+		resetLog()
+		setting.EnableAccessLog, setting.AccessLogTemplate = oldEnabled, oldTemplate
+	}
+	return read, reset
+}
+
+func TestRootGitPathNotFound(t *testing.T) {
+	var fallbackHit bool
+	c := chi.NewRouter()
+	c.Use(rootGitPathNotFound())
+	c.Head("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		fallbackHit = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, p := range []string{"/.git", "/.git/config", "/.git/HEAD"} {
+		fallbackHit = false
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusNotFound, resp.Code, p)
+		assert.False(t, fallbackHit, p)
+	}
+
+	for _, p := range []string{"/owner/repo.git/info/refs", "/owner/.github/config"} {
+		fallbackHit = false
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, p)
+		assert.True(t, fallbackHit, p)
+	}
+}
+
+func TestStaticNotFound(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "static")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	// only the public directory 404s its known entries
+	dir := filepath.Join(tmp, "public")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	page := filepath.Join(tmp, "404.html")
+
+	var fallbackHit bool
+	handler := public.StaticHandler(dir, &public.Options{
+		Directory:   dir,
+		SkipLogging: true,
+		NotFound:    staticNotFound(page),
+	})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fallbackHit = true
+	}))
+	serve := func(p, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// without a page a plain 404 is returned
+	resp := serve("/js/missing.js", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+
+	assert.NoError(t, ioutil.WriteFile(page, []byte("<h1>Lost</h1>"), 0644))
+	resp = serve("/img/missing.png", "text/html,*/*")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>Lost</h1>", resp.Body.String())
+
+	// clients only accepting JSON get the usual error body of the API
+	resp = serve("/css/missing.css", "application/json")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), `"message":"Not Found"`)
+
+	// anything but the known entries of the public directory is left to the other routes
+	resp = serve("/user/missing", "")
+	assert.True(t, fallbackHit)
+}
+
+func TestRenderStatus(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "custom")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	assert.NoError(t, os.Mkdir(filepath.Join(tmp, "public"), 0755))
+	defer func(customPath string) { setting.CustomPath = customPath }(setting.CustomPath)
+	setting.CustomPath = tmp
+
+	serve := func(p string, status int) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		resp.Header().Set("Retry-After", "1")
+		renderStatus(resp, httptest.NewRequest("GET", p, nil), status)
+		return resp
+	}
+
+	// without a page a plain text error is returned
+	resp := serve("/user2/repo1", http.StatusTooManyRequests)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "Too Many Requests\n", resp.Body.String())
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "public", "429.html"), []byte("<h1>Slow down</h1>"), 0644))
+	resp = serve("/user2/repo1", http.StatusTooManyRequests)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>Slow down</h1>", resp.Body.String())
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+
+	// the page is only used for its status
+	resp = serve("/user2/repo1", http.StatusRequestEntityTooLarge)
+	assert.Equal(t, "Request Entity Too Large\n", resp.Body.String())
+
+	// API clients get a JSON error
+	resp = serve("/api/v1/repos/search", http.StatusTooManyRequests)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), `"message":"Too Many Requests"`)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+
+	// the limits answer with it
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "public", "413.html"), []byte("<h1>Too big</h1>"), 0644))
+	handler := maxRequestBodySize(8, nil)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/user2/repo1/issues/new", strings.NewReader("far too large")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(t, "<h1>Too big</h1>", resp.Body.String())
+}
+
+func TestCheckStaticAssets(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+
+	tmp, err := ioutil.TempDir("", "static")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "public")
+
+	checkStaticAssets(dir, false)
+	assert.Contains(t, read(), "The static assets are missing: stat "+dir)
+
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "css"), 0755))
+	checkStaticAssets(dir, false)
+	assert.Contains(t, read(), dir+" lacks img, js")
+
+	for _, name := range []string{"img", "js"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+	before := read()
+	checkStaticAssets(dir, false)
+	assert.Equal(t, before, read())
+}
+
+func TestFavicon(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "favicon")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	defer func(static, custom string, cacheTime time.Duration) {
+		setting.StaticRootPath, setting.CustomPath, setting.StaticCacheTime = static, custom, cacheTime
+	}(setting.StaticRootPath, setting.CustomPath, setting.StaticCacheTime)
+	setting.StaticRootPath = filepath.Join(tmp, "static")
+	setting.CustomPath = filepath.Join(tmp, "custom")
+	setting.StaticCacheTime = 6 * time.Hour
+	assert.NoError(t, os.MkdirAll(filepath.Join(setting.StaticRootPath, "public"), 0755))
+
+	serve := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		favicon().ServeHTTP(resp, httptest.NewRequest("GET", "/favicon.ico", nil))
+		return resp
+	}
+
+	// without any icon nothing is returned
+	resp := serve()
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Empty(t, resp.Body.String())
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(setting.StaticRootPath, "public", "img"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(setting.StaticRootPath, "public", "img", "favicon.png"), []byte("static"), 0644))
+	resp = serve()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "image/png", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=21600", resp.Header().Get("Cache-Control"))
+	assert.Equal(t, "static", resp.Body.String())
+
+	// an icon of the custom public directory overrides the shipped one
+	assert.NoError(t, os.MkdirAll(filepath.Join(setting.CustomPath, "public", "img"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(setting.CustomPath, "public", "img", "favicon.png"), []byte("custom"), 0644))
+	resp = serve()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "custom", resp.Body.String())
+}
+
+func TestChangePassword(t *testing.T) {
+	defer func(u string) { setting.ChangePasswordURL = u }(setting.ChangePasswordURL)
+
+	c := chi.NewRouter()
+	c.Get("/.well-known/change-password", changePassword)
+	// like the Macaron fallback of RegisterRoutes
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	})
+
+	for _, target := range []string{"/gitea/user/settings/account", "https://id.example.com/account/password"} {
+		setting.ChangePasswordURL = target
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest("GET", "/.well-known/change-password", nil))
+		assert.Equal(t, http.StatusFound, resp.Code)
+		assert.Equal(t, target, resp.Header().Get("Location"))
+	}
+}
+
+func TestMatchesRequestPrefixes(t *testing.T) {
+	prefixes := []string{"HEAD /", "/metrics", "/avatars/", "/css"}
+	for _, tc := range []struct {
+		method, path string
+		expected     bool
+	}{
+		{"HEAD", "/", true},
+		{"GET", "/", false},
+		{"GET", "/metrics", true},
+		{"GET", "/metricsfoo", false},
+		{"GET", "/avatars/1234", true},
+		{"HEAD", "/avatars", true},
+		{"GET", "/css/index.css", true},
+		{"GET", "/user/login", false},
+	} {
+		assert.Equal(t, tc.expected, matchesRequestPrefixes(httptest.NewRequest(tc.method, tc.path, nil), prefixes), "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestAccessLogExcludePaths(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.Identity}} logged")
+	defer reset()
+	oldExcludes := setting.AccessLogExcludePaths
+	defer func() {
+		setting.AccessLogExcludePaths = oldExcludes
+	}()
+	setting.AccessLogExcludePaths = []string{"HEAD /", "/metrics"}
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Head("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	assert.Empty(t, read())
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/explore/repos", nil))
+	assert.Equal(t, "- logged\n", read())
+}
+
+func TestAccessLogTimeFormat(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.StartFormatted}} {{.Start.Format \"-0700\"}}")
+	defer reset()
+	oldFormat, oldUseUTC, oldLocal := setting.AccessLogTimeFormat, setting.AccessLogUseUTC, time.Local
+	defer func() {
+		setting.AccessLogTimeFormat, setting.AccessLogUseUTC, time.Local = oldFormat, oldUseUTC, oldLocal
+	}()
+	time.Local = time.FixedZone("UTC+9", 9*60*60)
+	setting.AccessLogTimeFormat = "2006-01-02T15:04:05Z07:00"
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/", func(w http.ResponseWriter, req *http.Request) {})
+	serve := func() (time.Time, string) {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		lines := strings.Split(strings.TrimSpace(read()), "\n")
+		fields := strings.Fields(lines[len(lines)-1])
+		if !assert.Len(t, fields, 2) {
+			return time.Time{}, ""
+		}
+		start, err := time.Parse(setting.AccessLogTimeFormat, fields[0])
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), start, time.Minute)
+		return start, fields[1]
+	}
+
+	start, offset := serve()
+	_, zoneOffset := start.Zone()
+	assert.Equal(t, 9*60*60, zoneOffset)
+	assert.Equal(t, "+0900", offset)
+
+	setting.AccessLogUseUTC = true
+	start, offset = serve()
+	_, zoneOffset = start.Zone()
+	assert.Equal(t, 0, zoneOffset)
+	assert.Equal(t, "+0000", offset)
+}
+
+func TestRouterLogSampling(t *testing.T) {
+	read, reset := captureLog(t, "router")
+	defer reset()
+
+	samplers := compileRouterLogSamplers(1, []setting.LogSampleRate{{Path: "/api/v1/**", Rate: 1000}})
+	c := chi.NewRouter()
+	c.Use(sampledLoggerHandler(log.INFO, samplers, 50*time.Millisecond))
+	c.Get("/api/v1/version", func(w http.ResponseWriter, req *http.Request) {})
+	c.Get("/api/v1/broken", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	c.Get("/api/v1/slow", func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	c.Get("/explore/repos", func(w http.ResponseWriter, req *http.Request) {})
+	serve := func(p string, times int) {
+		for i := 0; i < times; i++ {
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+		}
+	}
+
+	// only the first of the sampled requests is logged
+	serve("/api/v1/version", 10)
+	logged := read()
+	assert.Equal(t, 1, strings.Count(logged, "Started GET /api/v1/version"))
+	assert.Equal(t, 1, strings.Count(logged, "Completed GET /api/v1/version"))
+
+	// errors and slow requests are never dropped
+	serve("/api/v1/broken", 10)
+	logged = read()
+	assert.Equal(t, 10, strings.Count(logged, "Completed GET /api/v1/broken"))
+	serve("/api/v1/slow", 2)
+	logged = read()
+	assert.Equal(t, 2, strings.Count(logged, "Completed GET /api/v1/slow"))
+
+	// other paths are all logged
+	serve("/explore/repos", 3)
+	logged = read()
+	assert.Equal(t, 3, strings.Count(logged, "Started GET /explore/repos"))
+	assert.Equal(t, 3, strings.Count(logged, "Completed GET /explore/repos"))
+}
+
+func TestAccessLogPanic(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.ResponseWriter.Status}} {{.Duration.Milliseconds}}")
+	defer reset()
+
+	c := NewChi()
+	c.Get("/panic", func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		panic("oops")
+	})
+	c.Get("/ok", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+
+	lines := strings.Split(strings.TrimSpace(read()), "\n")
+	if assert.Len(t, lines, 1) {
+		var status int
+		var duration int64
+		_, err := fmt.Sscanf(lines[0], "%d %d", &status, &duration)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.GreaterOrEqual(t, duration, int64(50))
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	lines = strings.Split(strings.TrimSpace(read()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[1], "200 "), lines[1])
+	}
+}
+
+func TestAccessLogCacheStatus(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.ResponseWriter.Status}} {{.CacheStatus}}")
+	defer reset()
+
+	objStore := newMemoryStorage(map[string]string{"1234": "0123456789"})
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Use(storageHandler(setting.Storage{}, "avatars", objStore, nil))
+	c.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("If-None-Match", resp.Header().Get("ETag"))
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, "200 miss\n304 hit\n200 -\n", read())
+}
+
+func TestAccessLogRequestFields(t *testing.T) {
+	read, reset := captureAccessLog(t, `{{.Host}} "{{.Method}} {{.RequestURI}} {{.Proto}}" {{.ResponseWriter.Status}} {{.BytesReceived}} {{.BytesSent}} "{{.Referer}}" "{{.UserAgent}}"`)
+	defer reset()
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Post("/api/v1/markdown", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("<p>rendered</p>"))
+	})
+
+	req := httptest.NewRequest("POST", "/api/v1/markdown?mode=gfm", strings.NewReader(`{"text":"rendered"}`))
+	req.Host = "try.gitea.io"
+	req.Header.Set("Referer", "https://try.gitea.io/user2/repo1")
+	req.Header.Set("User-Agent", "curl/7.68.0")
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, `try.gitea.io "POST /api/v1/markdown?mode=gfm HTTP/1.1" 200 19 15 "https://try.gitea.io/user2/repo1" "curl/7.68.0"`+"\n", read())
+}
+
+func TestAccessLogAuthMethod(t *testing.T) {
+	read, reset := captureAccessLog(t, `{{.Identity}} {{.AuthMethod}} {{.IdentityWithAuthMethod}}`)
+	defer reset()
+
+	c := chi.NewRouter()
+	c.Use(recordIdentity)
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/api/v1/user", func(w http.ResponseWriter, req *http.Request) {
+		if user := req.URL.Query().Get("user"); user != "" {
+			context.SetIdentity(req.Context(), user, req.URL.Query().Get("method"))
+		}
+	})
+
+	for _, target := range []string{"/api/v1/user?user=user2&method=token", "/api/v1/user?user=user2&method=basic", "/api/v1/user"} {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	assert.Equal(t, "user2 token user2 (token)\nuser2 basic user2 (basic)\n- - -\n", read())
+}
+
+func TestRedactURI(t *testing.T) {
+	defer func(params []string) { setting.RouterLogRedactParams = params }(setting.RouterLogRedactParams)
+	setting.RouterLogRedactParams = []string{"token", " access_token"}
+
+	for uri, expected := range map[string]string{
+		"/api/v1/user":           "/api/v1/user",
+		"/api/v1/user?token=abc": "/api/v1/user?token=***",
+		"/api/v1/user?page=2&access_token=abc&limit=10":   "/api/v1/user?page=2&access_token=***&limit=10",
+		"/api/v1/user?Access_Token=abc&token=":            "/api/v1/user?Access_Token=***&token=***",
+		"/api/v1/user?access%5Ftoken=abc":                 "/api/v1/user?access%5Ftoken=***",
+		"/api/v1/user?tokens=abc&token":                   "/api/v1/user?tokens=abc&token",
+		"/explore/repos?q=gitea%20token%3Dabc":            "/explore/repos?q=gitea%20token%3Dabc",
+		"/user/login?redirect_to=%2Fapi%3Ftoken%3Dabc":    "/user/login?redirect_to=%2Fapi%3Ftoken%3D%2A%2A%2A",
+		"/user/login?redirect_to=%2Fexplore%3Fpage%3D2":   "/user/login?redirect_to=%2Fexplore%3Fpage%3D2",
+		"/user/login?redirect_to=%2Fapi%3Ftoken%3Dabc%zz": "/user/login?redirect_to=%2Fapi%3Ftoken%3Dabc%zz",
+	} {
+		assert.Equal(t, expected, RedactURI(uri), uri)
+	}
+
+	// nothing is redacted without any parameters
+	setting.RouterLogRedactParams = nil
+	assert.Equal(t, "/api/v1/user?token=abc", RedactURI("/api/v1/user?token=abc"))
+}
+
+func TestAccessLogRedactParams(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.Method}} {{.RequestURI}}")
+	defer reset()
+	defer func(params []string) { setting.RouterLogRedactParams = params }(setting.RouterLogRedactParams)
+	setting.RouterLogRedactParams = []string{"token"}
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/api/v1/user", func(w http.ResponseWriter, req *http.Request) {})
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/user?token=abc&page=2", nil))
+	assert.Equal(t, "GET /api/v1/user?token=***&page=2\n", read())
+}
+
+func TestAccessLogTraceStart(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.RequestID}} {{.Method}} {{.RequestURI}} {{.ResponseWriter.Status}}")
+	defer reset()
+	defer func(paths []string) { setting.AccessLogTraceStartPaths = paths }(setting.AccessLogTraceStartPaths)
+	setting.AccessLogTraceStartPaths = []string{"POST /user2/repo1.git"}
+
+	c := chi.NewRouter()
+	c.Use(middleware.RequestID)
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	var started string
+	c.HandleFunc("/*", func(w http.ResponseWriter, req *http.Request) {
+		// the started line is written before the request is handled
+		started = read()
+	})
+
+	req := httptest.NewRequest("POST", "/user2/repo1.git/git-upload-pack", nil)
+	req.Header.Set("X-Request-Id", "clone-1")
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, `192.0.2.1 "POST /user2/repo1.git/git-upload-pack HTTP/1.1" started, request clone-1`+"\n", started)
+	assert.Equal(t, started+"clone-1 POST /user2/repo1.git/git-upload-pack 200\n", read())
+
+	// other requests are only logged once they are done, with a request ID of their own
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user2/repo1.git/info/refs", nil))
+	lines := strings.Split(strings.TrimSuffix(read(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	assert.Regexp(t, `^\S+/\S+-\d+ GET /user2/repo1.git/info/refs 200$`, lines[2])
+}
+
+func TestDefaultAccessLogTemplate(t *testing.T) {
+	defer func(conf string) { setting.CustomConf = conf }(setting.CustomConf)
+	setting.CustomConf = filepath.Join(os.TempDir(), "routes-missing", "app.ini")
+	tmpl, err := setting.ReadAccessLogTemplate()
+	assert.NoError(t, err)
+	read, reset := captureAccessLog(t, tmpl)
+	defer reset()
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/explore/repos", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("repos"))
+	})
+	req := httptest.NewRequest("GET", "/explore/repos?page=2", nil)
+	req.Header.Set("Referer", "https://try.gitea.io/")
+	req.Header.Set("User-Agent", "curl/7.68.0")
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[[^]]+\] "GET /explore/repos\?page=2 HTTP/1\.1" 200 5 "https://try\.gitea\.io/" "curl/7\.68\.0"\n$`, read())
+}
+
+func TestReloadAccessLogTemplate(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.Method}}")
+	defer reset()
+
+	dir, err := ioutil.TempDir("", "routes-conf")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(conf string) { setting.CustomConf = conf }(setting.CustomConf)
+	setting.CustomConf = filepath.Join(dir, "app.ini")
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/", func(w http.ResponseWriter, req *http.Request) {})
+	// returns the line logged for the request, the captured log holds all of them
+	request := func() string {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/explore/repos", nil))
+		lines := strings.Split(strings.TrimSuffix(read(), "\n"), "\n")
+		return lines[len(lines)-1]
+	}
+	assert.Equal(t, "GET", request())
+
+	assert.NoError(t, ioutil.WriteFile(setting.CustomConf, []byte("[log]\nACCESS_LOG_TEMPLATE = {{.Method}} {{.RequestURI}}\n"), 0644))
+	assert.NoError(t, ReloadAccessLogTemplate())
+	assert.Equal(t, "GET /explore/repos", request())
+
+	// a template which cannot be parsed is not used
+	assert.NoError(t, ioutil.WriteFile(setting.CustomConf, []byte("[log]\nACCESS_LOG_TEMPLATE = {{.Method\n"), 0644))
+	assert.Error(t, ReloadAccessLogTemplate())
+	assert.Equal(t, "GET /explore/repos", request())
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.Method}}")
+	defer reset()
+	defer func(format string) { setting.AccessLogFormat = format }(setting.AccessLogFormat)
+
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/user2/repo1", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("repo1"))
+	})
+	c.Get("/empty", func(w http.ResponseWriter, req *http.Request) {})
+
+	newRequest := func(target string) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "10.0.0.1:52314"
+		req.Header.Set("User-Agent", `curl/7.68.0 "quoted"`)
+		return req.WithContext(gocontext.WithValue(req.Context(), "SignedUserName", "user2"))
+	}
+	dateRe := `\[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\]`
+
+	setting.AccessLogFormat = "combined"
+	c.ServeHTTP(httptest.NewRecorder(), newRequest("/user2/repo1?tab=1"))
+	setting.AccessLogFormat = "common"
+	c.ServeHTTP(httptest.NewRecorder(), newRequest("/empty"))
+
+	lines := strings.Split(read(), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	assert.Regexp(t, `^10\.0\.0\.1 - user2 `+dateRe+` "GET /user2/repo1\?tab=1 HTTP/1\.1" 200 5 "-" "curl/7\.68\.0 \\"quoted\\""$`, lines[0])
+	assert.Regexp(t, `^10\.0\.0\.1 - user2 `+dateRe+` "GET /empty HTTP/1\.1" 200 -$`, lines[1])
+}
+
+func TestRoutePattern(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.RoutePattern}}")
+	defer reset()
+
+	var pattern string
+	c := chi.NewRouter()
+	setupAccessLogger(c, setting.AccessLogTemplate)
+	c.Get("/avatars/*", func(w http.ResponseWriter, req *http.Request) {
+		pattern = RoutePattern(req)
+	})
+	c.Get("/api/v1/users/{username}", func(w http.ResponseWriter, req *http.Request) {
+		pattern = RoutePattern(req)
+	})
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		pattern = RoutePattern(req)
+	})
+
+	var logged string
+	for _, tc := range []struct{ target, pattern string }{
+		{"/avatars/1234", "/avatars/*"},
+		{"/api/v1/users/user2", "/api/v1/users/{username}"},
+		{"/user2/repo1/issues/", macaronRoutePattern},
+	} {
+		pattern = ""
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.target, nil))
+		assert.Equal(t, tc.pattern, pattern, tc.target)
+		logged += tc.pattern + "\n"
+	}
+	assert.Equal(t, logged, read())
+
+	assert.Empty(t, RoutePattern(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestRecoveryOnPanic(t *testing.T) {
+	defer func(onPanic func(req *http.Request, err interface{}, stack []byte)) {
+		OnPanic = onPanic
+	}(OnPanic)
+
+	handler := Recovery()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}))
+
+	var hookPath string
+	var hookErr interface{}
+	var hookStack []byte
+	OnPanic = func(req *http.Request, err interface{}, stack []byte) {
+		hookPath, hookErr, hookStack = req.URL.Path, err, stack
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user2/repo1", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "/user2/repo1", hookPath)
+	assert.Equal(t, "oops", hookErr)
+	assert.NotEmpty(t, hookStack)
+
+	// a faulty hook must not stop the error page from being written
+	OnPanic = func(req *http.Request, err interface{}, stack []byte) {
+		panic("faulty hook")
+	}
+	resp = httptest.NewRecorder()
+	assert.NotPanics(t, func() {
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user2/repo1", nil))
+	})
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), http.StatusText(http.StatusInternalServerError))
+
+	OnPanic = nil
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user2/repo1", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
+
+func TestRecoveryLogsRequest(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+	defer func(params []string) {
+		setting.RouterLogRedactParams = params
+	}(setting.RouterLogRedactParams)
+	setting.RouterLogRedactParams = []string{"token"}
+
+	handler := middleware.RequestID(Recovery()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	})))
+	req := httptest.NewRequest("POST", "/api/v1/repos/user2/repo1/issues?token=secret", nil)
+	req.RemoteAddr = "192.0.2.1:41234"
+	req.Header.Set("X-Request-Id", "req-42")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	// the client only gets the request ID to report
+	assert.Contains(t, resp.Body.String(), "request req-42")
+	assert.NotContains(t, resp.Body.String(), "oops")
+
+	logged := read()
+	assert.Contains(t, logged, "POST /api/v1/repos/user2/repo1/issues?token=*** from 192.0.2.1, request req-42 panicked: PANIC: oops")
+	assert.NotContains(t, logged, "secret")
+}
+
+func TestRecoveryCommittedResponse(t *testing.T) {
+	read, reset := captureAccessLog(t, "{{.ResponseWriter.Status}} {{.BytesSent}}")
+	defer reset()
+
+	c := NewChi()
+	c.Get("/archive.zip", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		panic("oops")
+	})
+
+	// the 500 is not appended to the started response, the connection is closed instead
+	resp := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		c.ServeHTTP(resp, httptest.NewRequest("GET", "/archive.zip", nil))
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/zip", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "partial", resp.Body.String())
+
+	// which is still logged
+	assert.Equal(t, "200 7\n", read())
+
+	// through a server the client gets a truncated response
+	server := httptest.NewServer(c)
+	defer server.Close()
+	res, err := http.Get(server.URL + "/archive.zip")
+	if err == nil {
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestRecoveryResponseFormat(t *testing.T) {
+	defer func(paths []string) {
+		setting.ProblemDetailsPaths = paths
+	}(setting.ProblemDetailsPaths)
+	setting.ProblemDetailsPaths = []string{"/api/"}
+
+	handler := Recovery()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("<oops>")
+	}))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/repos/user2/repo1", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	var apiErr struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr))
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError), apiErr.Message)
+	assert.Equal(t, setting.API.SwaggerURL, apiErr.URL)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user2/repo1", nil))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), http.StatusText(http.StatusInternalServerError))
+	assert.NotContains(t, resp.Body.String(), "oops")
+	assert.NotContains(t, resp.Body.String(), "goroutine")
+
+	// clients asking for problem details get them
+	req := httptest.NewRequest("GET", "/api/v1/repos/user2/repo1", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), `"status":500`)
+	assert.NotContains(t, resp.Body.String(), "oops")
+
+	// clients only accepting JSON get it outside of the API too
+	req = httptest.NewRequest("GET", "/user2/repo1", nil)
+	req.Header.Set("Accept", "application/json")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	var fallbackHit bool
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fallbackHit = true
+		if req.URL.Path == "/" && req.Method == "GET" {
+			_, _ = w.Write([]byte("home"))
+			return
+		}
+		http.NotFound(w, req)
+	})
+
+	c := chi.NewRouter()
+	c.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+			w.Header().Add("Set-Cookie", "i_like_gitea=abc; Path=/")
+			next.ServeHTTP(w, req)
+		})
+	})
+	c.Use(middleware.GetHead)
+	c.Head("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	c.Get("/robots.txt", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("User-agent: *"))
+	})
+	c.Get("/api/v1/version", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"version":"1.13"}`))
+	})
+	c.NotFound(fallback)
+	c.MethodNotAllowed(methodNotAllowed(fallback))
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		fallbackHit = false
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest(method, target, nil))
+		return resp
+	}
+
+	resp := serve("POST", "/robots.txt")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, "GET, HEAD", resp.Header().Get("Allow"))
+	assert.Equal(t, "max-age=31536000", resp.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "i_like_gitea=abc; Path=/", resp.Header().Get("Set-Cookie"))
+	assert.True(t, fallbackHit)
+
+	resp = serve("HEAD", "/robots.txt")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.False(t, fallbackHit)
+
+	resp = serve("DELETE", "/api/v1/version")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, "GET, HEAD", resp.Header().Get("Allow"))
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"Method Not Allowed","url":"`+setting.API.SwaggerURL+`"}`, resp.Body.String())
+	assert.Equal(t, "max-age=31536000", resp.Header().Get("Strict-Transport-Security"))
+
+	// routes the fallback handles are not affected
+	resp = serve("GET", "/")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "home", resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Allow"))
+}
+
+func TestAPINotFound(t *testing.T) {
+	c := chi.NewRouter()
+	c.NotFound(apiNotFound(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/version":
+			_, _ = w.Write([]byte(`{"version":"1.13.0"}`))
+		case "/api/v1/repos/user2/missing":
+			// the API routes answer missing resources with JSON themselves
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"repository does not exist"}`))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("<h1>Page Not Found</h1>"))
+		}
+	})))
+	serve := func(p string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		return resp
+	}
+
+	resp := serve("/api/v1/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	var apiErr struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr))
+	assert.Equal(t, "Not Found", apiErr.Message)
+	assert.Equal(t, setting.API.SwaggerURL, apiErr.URL)
+
+	resp = serve("/api/v1/repos/user2/missing")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, `{"message":"repository does not exist"}`, resp.Body.String())
+
+	resp = serve("/api/v1/version")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `{"version":"1.13.0"}`, resp.Body.String())
+
+	// the web paths keep the 404 page
+	resp = serve("/user2/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>Page Not Found</h1>", resp.Body.String())
+}
+
+func TestAPIOnlyFallback(t *testing.T) {
+	var macaronPaths []string
+	fallback := apiOnlyFallback(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		macaronPaths = append(macaronPaths, req.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, p := range []string{"/api/v1/version", "/api/internal/serv/none/1", "/login/oauth/access_token", "/swagger.v1.json"} {
+		resp := httptest.NewRecorder()
+		fallback.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, p)
+	}
+	assert.Equal(t, []string{"/api/v1/version", "/api/internal/serv/none/1", "/login/oauth/access_token", "/swagger.v1.json"}, macaronPaths)
+
+	macaronPaths = nil
+	for _, p := range []string{"/", "/user/login", "/user2/repo1", "/user2/repo1.git/info/refs", "/apifoo", "/metrics"} {
+		resp := httptest.NewRecorder()
+		fallback.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusNotFound, resp.Code, p)
+		assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), p)
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr), p)
+		assert.Equal(t, "Not Found", apiErr.Message, p)
+	}
+	assert.Empty(t, macaronPaths)
+}
+
+func TestListRoutes(t *testing.T) {
+	defer func(env string) { macaron.Env = env }(macaron.Env)
+	newRouter := func() *chi.Mux {
+		c := chi.NewRouter()
+		c.Head("/", func(w http.ResponseWriter, req *http.Request) {})
+		c.Get("/api/healthz", func(w http.ResponseWriter, req *http.Request) {})
+		registerDebugRoutes(c)
+		return c
+	}
+
+	macaron.Env = macaron.DEV
+	resp := httptest.NewRecorder()
+	newRouter().ServeHTTP(resp, httptest.NewRequest("GET", "/-/routes", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	var list struct {
+		Routes []chiRoute
+		Note   string
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	assert.Contains(t, list.Routes, chiRoute{Method: "HEAD", Pattern: "/"})
+	assert.Contains(t, list.Routes, chiRoute{Method: "GET", Pattern: "/api/healthz"})
+	assert.Contains(t, list.Routes, chiRoute{Method: "GET", Pattern: "/-/routes"})
+	assert.Contains(t, list.Note, "Macaron")
+
+	macaron.Env = macaron.PROD
+	resp = httptest.NewRecorder()
+	newRouter().ServeHTTP(resp, httptest.NewRequest("GET", "/-/routes", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestRegisterInstallRouteWithoutWebUI(t *testing.T) {
+	defer func(disabled bool) { setting.DisableWebUI = disabled }(setting.DisableWebUI)
+	setting.DisableWebUI = true
+
+	c := chi.NewRouter()
+	RegisterInstallRoute(c)
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Contains(t, resp.Body.String(), "INSTALL_LOCK")
+
+	resp = httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/-/startupz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+}
+
+func TestNewChiWithOptions(t *testing.T) {
+	read, reset := captureLog(t, "access")
+	defer reset()
+
+	// neither the access log nor the storage are set up in the settings
+	c := NewChiWithOptions(ChiOptions{
+		RouterLogLevel:    log.NONE,
+		AccessLog:         true,
+		AccessLogTemplate: "{{.ResponseWriter.Status}} {{.ResponseWriter.BytesWritten}}",
+		DisableWebUI:      true,
+		Avatars:           []storage.ObjectStorage{newMemoryStorage(map[string]string{"1234": "avatar"})},
+	})
+	// chi only runs the middlewares once a route has been registered
+	c.Get("/", func(w http.ResponseWriter, req *http.Request) {})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "avatar", resp.Body.String())
+	lines := strings.Split(strings.TrimSpace(read()), "\n")
+	assert.Equal(t, "200 6", lines[len(lines)-1])
+
+	resp = httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/avatars/5678", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	lines = strings.Split(strings.TrimSpace(read()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[1], "404 "))
+}
+
+func TestNewChiWithOptionsIndependent(t *testing.T) {
+	defer func(depth int) { setting.Proxy.ForwardedForDepth = depth }(setting.Proxy.ForwardedForDepth)
+	setting.Proxy.ForwardedForDepth = 1
+
+	// routers built with different options do not change each other
+	newRouter := func(opts ChiOptions) chi.Router {
+		opts.RouterLogLevel = log.NONE
+		opts.DisableWebUI = true
+		c := NewChiWithOptions(opts)
+		c.Get("/ip", func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(clientAddr(req)))
+		})
+		c.Get("/request-id", func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(middleware.GetReqID(req.Context())))
+		})
+		return c
+	}
+	proxiedMaintenance := NewMaintenanceSwitch(false)
+	proxied := newRouter(ChiOptions{TrustedProxies: []string{"loopback"}, Maintenance: proxiedMaintenance})
+	direct := newRouter(ChiOptions{})
+
+	serve := func(c chi.Router) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = "127.0.0.1:41234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+	assert.Equal(t, "198.51.100.7", serve(proxied).Body.String())
+	assert.Equal(t, "127.0.0.1", serve(direct).Body.String())
+
+	// requests have an ID to be logged with panics even without the access log
+	resp := httptest.NewRecorder()
+	direct.ServeHTTP(resp, httptest.NewRequest("GET", "/request-id", nil))
+	assert.NotEmpty(t, resp.Body.String())
+
+	maintained := newRouter(ChiOptions{Maintenance: NewMaintenanceSwitch(true)})
+	assert.Equal(t, http.StatusServiceUnavailable, serve(maintained).Code)
+	assert.Equal(t, http.StatusOK, serve(proxied).Code)
+	assert.False(t, IsMaintenanceMode())
+
+	proxiedMaintenance.Set(true)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(proxied).Code)
+	assert.Equal(t, http.StatusOK, serve(direct).Code)
+}
+
+func TestCountNotFound(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+
+	notFoundRequests := func(prefix string) float64 {
+		var metric dto.Metric
+		assert.NoError(t, metrics.NotFoundRequests.WithLabelValues(prefix).Write(&metric))
+		return metric.GetCounter().GetValue()
+	}
+
+	// every second of the probes is logged
+	handler := countNotFound(compileRouterLogSamplers(1, []setting.LogSampleRate{{Path: "/wp-*", Rate: 2}}), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/explore/repos" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	serve := func(p string) int {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		return resp.Code
+	}
+
+	api, other := notFoundRequests("api"), notFoundRequests("other")
+	assert.Equal(t, http.StatusNotFound, serve("/api/v1/nothing"))
+	assert.Equal(t, api+1, notFoundRequests("api"))
+	assert.Contains(t, read(), "GET /api/v1/nothing from 192.0.2.1 was not found")
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusNotFound, serve("/wp-login.php"))
+	}
+	assert.Equal(t, other+4, notFoundRequests("other"))
+	assert.Equal(t, 2, strings.Count(read(), "GET /wp-login.php from"))
+
+	explore := notFoundRequests("explore")
+	assert.Equal(t, http.StatusOK, serve("/explore/repos"))
+	assert.Equal(t, explore, notFoundRequests("explore"))
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+)
+
+// compressMinSize is the size in bytes below which responses are sent uncompressed, as compressing them hardly
+// makes them any smaller
+const compressMinSize = 1400
+
+// compressLevel is the compression level of the encoders, which gives most of the gain of the higher levels for
+// a fraction of their CPU time
+const compressLevel = 4
+
+// encoder is a compressing writer which can be flushed to send what has been written so far
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encoders are the encodings responses can be compressed with, by their Accept-Encoding name
+var encoders = map[string]func(w io.Writer) encoder{
+	"br": func(w io.Writer) encoder {
+		return brotli.NewWriterLevel(w, compressLevel)
+	},
+	"gzip": func(w io.Writer) encoder {
+		gw, _ := gzip.NewWriterLevel(w, compressLevel)
+		return gw
+	},
+	"deflate": func(w io.Writer) encoder {
+		fw, _ := flate.NewWriter(w, compressLevel)
+		return fw
+	},
+}
+
+// negotiateEncoding returns the encoding of algorithms with the highest quality value in the Accept-Encoding of the
+// client, or an empty string if the client accepts none of them. Encodings of the same quality are chosen in the
+// order of algorithms, so that e.g. br is preferred over gzip by clients supporting both.
+func negotiateEncoding(acceptEncoding string, algorithms []string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, algorithm := range algorithms {
+		quality, ok := qualities[algorithm]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = algorithm, quality
+		}
+	}
+	return best
+}
+
+// isCompressedContentType returns whether responses of the content type are already compressed, so that compressing
+// them again would only waste CPU time
+func isCompressedContentType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2", "application/x-xz",
+		"application/x-7z-compressed", "application/zstd", "font/woff", "font/woff2":
+		return true
+	case "image/svg+xml":
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/")
+}
+
+// compressResponseWriter compresses the response with the encoding once compressMinSize bytes have been written,
+// unless the response turns out to be unsuitable for it
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	buf     []byte
+	encoder encoder
+	plain   bool
+}
+
+// WriteHeader holds back the status until it is known whether the response is compressed, responses which cannot
+// be compressed are started straight away
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if cw.plain {
+		// the response has been flushed before it was started
+		cw.status = status
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status < 200 {
+		// informational responses such as 103 Early Hints precede the actual one
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.status = status
+	header := cw.Header()
+	contentLength, err := strconv.Atoi(header.Get("Content-Length"))
+	if status == http.StatusNoContent || status == http.StatusNotModified || header.Get("Content-Encoding") != "" ||
+		(err == nil && contentLength < compressMinSize) || isCompressedContentType(header.Get("Content-Type")) {
+		_ = cw.startPlain()
+	}
+}
+
+// Write buffers the response until enough of it has been written to decide whether it is worth compressing
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.encoder != nil:
+		return cw.encoder.Write(p)
+	case cw.plain:
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) < compressMinSize {
+		return len(p), nil
+	}
+	if cw.Header().Get("Content-Type") == "" {
+		cw.Header().Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	var err error
+	if isCompressedContentType(cw.Header().Get("Content-Type")) {
+		err = cw.startPlain()
+	} else {
+		err = cw.startEncoder()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cw *compressResponseWriter) startPlain() error {
+	cw.plain = true
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressResponseWriter) startEncoder() error {
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Add("Vary", "Accept-Encoding")
+	// the length of the compressed response is not known in advance
+	header.Del("Content-Length")
+	// a strong ETag must differ between the encodings, a weak one is still matched by the If-None-Match the
+	// handler checks against its own ETag
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	cw.encoder = encoders[cw.encoding](cw.ResponseWriter)
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.encoder.Write(buf)
+	return err
+}
+
+// Flush sends what has been written so far, a response which has not been compressed yet is sent as is
+func (cw *compressResponseWriter) Flush() {
+	if cw.encoder == nil && !cw.plain {
+		if err := cw.startPlain(); err != nil {
+			return
+		}
+	}
+	if cw.encoder != nil {
+		if err := cw.encoder.Flush(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends the rest of the response
+func (cw *compressResponseWriter) Close() error {
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	if !cw.plain && cw.status != 0 {
+		return cw.startPlain()
+	}
+	return nil
+}
+
+// compressResponses compresses the responses with the first of algorithms, e.g. br, gzip or deflate, that the client
+// prefers. Responses already encoded, smaller than compressMinSize or of a compressed type such as images are sent
+// as they are, as are the responses to requests for a range, HEAD requests, WebSocket upgrades and the requests below
+// any of excludePrefixes, e.g. the storages, whose objects are sent as stored.
+func compressResponses(algorithms, excludePrefixes []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(algorithms) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "HEAD" || req.Header.Get("Range") != "" || IsWebSocketUpgrade(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			for _, prefix := range excludePrefixes {
+				if hasPathPrefix(req.URL.Path, prefix) {
+					next.ServeHTTP(w, req)
+					return
+				}
+			}
+			encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"), algorithms)
+			if encoding == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+			// not deferred, so that nothing is sent for a panic before Recovery() has responded to it
+			next.ServeHTTP(cw, req)
+			if err := cw.Close(); err != nil && req.Context().Err() == nil {
+				log.Debug("Unable to finish the %s response of %s %s: %v", encoding, req.Method, req.URL.Path, err)
+			}
+		})
+	}
+}
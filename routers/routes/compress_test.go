@@ -0,0 +1,127 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	algorithms := []string{"br", "gzip", "deflate"}
+	for acceptEncoding, expected := range map[string]string{
+		"":                              "",
+		"identity":                      "",
+		"gzip":                          "gzip",
+		"gzip, deflate, br":             "br",
+		"GZIP;q=1.0, br;q=0.5":          "gzip",
+		"br;q=0, gzip;q=0.2":            "gzip",
+		"deflate;q=0.8, gzip;q=0.8":     "gzip",
+		"*":                             "br",
+		"*;q=0.1, deflate":              "deflate",
+		"br;q=0, gzip;q=0, deflate;q=0": "",
+	} {
+		assert.Equal(t, expected, negotiateEncoding(acceptEncoding, algorithms), acceptEncoding)
+	}
+
+	// brotli can be disabled
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br", []string{"gzip", "deflate"}))
+	assert.Equal(t, "", negotiateEncoding("br", []string{"gzip", "deflate"}))
+}
+
+func TestCompressResponses(t *testing.T) {
+	page := strings.Repeat("<p>Gitea - Git with a cup of tea</p>\n", 100)
+	handler := compressResponses([]string{"br", "gzip", "deflate"}, []string{"/avatars"})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/small":
+			_, _ = w.Write([]byte("<p>small</p>"))
+		case "/img/logo.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(page))
+		case "/js/index.js":
+			// precompressed
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write([]byte(page))
+		case "/etag":
+			w.Header().Set("ETag", `"1b2c3d"`)
+			_, _ = w.Write([]byte(page))
+		case "/weak":
+			w.Header().Set("ETag", `W/"1b2c3d"`)
+			_, _ = w.Write([]byte(page))
+		case "/missing":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(page))
+		default:
+			_, _ = w.Write([]byte(page[:1000]))
+			_, _ = w.Write([]byte(page[1000:]))
+		}
+	}))
+	serve := func(method, p, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// brotli is preferred for clients supporting it
+	resp := serve("GET", "/", "gzip, deflate, br")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "br", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header().Get("Vary"))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, page, string(body))
+
+	resp = serve("GET", "/missing", "br;q=0.5, gzip")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	gr, err := gzip.NewReader(resp.Body)
+	if assert.NoError(t, err) {
+		body, err = ioutil.ReadAll(gr)
+		assert.NoError(t, err)
+		assert.Equal(t, page, string(body))
+	}
+
+	for _, tc := range []struct {
+		method, path, acceptEncoding, contentEncoding string
+	}{
+		{"GET", "/", "", ""},
+		{"GET", "/", "identity", ""},
+		{"HEAD", "/", "br", ""},
+		{"GET", "/small", "br", ""},
+		{"GET", "/img/logo.png", "br", ""},
+		{"GET", "/js/index.js", "gzip", "br"},
+		{"GET", "/avatars/1234", "br", ""},
+	} {
+		resp = serve(tc.method, tc.path, tc.acceptEncoding)
+		assert.Equal(t, http.StatusOK, resp.Code, "%s %s", tc.method, tc.path)
+		assert.Equal(t, tc.contentEncoding, resp.Header().Get("Content-Encoding"), "%s %s", tc.method, tc.path)
+		if tc.method == "GET" && tc.path != "/small" {
+			assert.Equal(t, page, resp.Body.String(), "%s %s", tc.method, tc.path)
+		}
+	}
+	assert.Equal(t, "<p>small</p>", serve("GET", "/small", "br").Body.String())
+
+	// the compressed representations must not share the strong ETag of the uncompressed one
+	for _, acceptEncoding := range []string{"br", "gzip"} {
+		resp = serve("GET", "/etag", acceptEncoding)
+		assert.Equal(t, acceptEncoding, resp.Header().Get("Content-Encoding"))
+		assert.Equal(t, `W/"1b2c3d"`, resp.Header().Get("ETag"), acceptEncoding)
+	}
+	assert.Equal(t, `"1b2c3d"`, serve("GET", "/etag", "").Header().Get("ETag"))
+	assert.Equal(t, `W/"1b2c3d"`, serve("GET", "/weak", "br").Header().Get("ETag"))
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/gobwas/glob"
+)
+
+// maxDeliveryResponseSize is the largest response body that is kept to answer duplicate deliveries with
+const maxDeliveryResponseSize = 64 << 10
+
+// maxDeliveryBodySize is the largest request body of a delivery which is hashed to recognise its duplicates, larger
+// deliveries are never deduplicated
+const maxDeliveryBodySize = 1 << 20
+
+// deliveryClientHeaders are the response headers which are only meant for the client that got the response, so they
+// are not replayed to the senders of duplicates
+var deliveryClientHeaders = []string{"Set-Cookie", "Date", "Server-Timing"}
+
+// deliveryResponse is the response to a delivery, which is replayed for its duplicates
+type deliveryResponse struct {
+	done     chan struct{}
+	expires  time.Time
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	complete bool
+}
+
+// deliveryResponseWriter records the response to a delivery whilst writing it
+type deliveryResponseWriter struct {
+	http.ResponseWriter
+	resp        *deliveryResponse
+	wroteHeader bool
+}
+
+func (w *deliveryResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.resp.status = status
+	w.resp.header = w.ResponseWriter.Header().Clone()
+	for _, key := range deliveryClientHeaders {
+		w.resp.header.Del(key)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deliveryResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.resp.complete {
+		if w.resp.body.Len()+len(p) > maxDeliveryResponseSize {
+			w.resp.complete = false
+			w.resp.body = bytes.Buffer{}
+		} else {
+			w.resp.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// deliveryDeduplicator remembers the responses to deliveries for a time to live
+type deliveryDeduplicator struct {
+	ttl       time.Duration
+	headers   []string
+	patterns  []glob.Glob
+	lock      sync.Mutex
+	responses map[string]*deliveryResponse
+	nextSweep time.Time
+}
+
+// deliveryID returns the delivery ID of a request, or "" if it does not have one
+func (d *deliveryDeduplicator) deliveryID(req *http.Request) string {
+	for _, header := range d.headers {
+		if id := req.Header.Get(header); id != "" {
+			return header + ":" + id
+		}
+	}
+	return ""
+}
+
+// readCloser reads from a reader but closes the original body of a request
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// deliveryKey returns the key a delivery is remembered by, which covers its method, path and ID as well as its
+// body and credentials, so that a sender repeating or guessing the ID of someone else's delivery does not get its
+// response. The body of req is replaced by one reading the same bytes. ok is false if the body is too large or
+// cannot be read, then the delivery is not deduplicated.
+func deliveryKey(req *http.Request, id string) (key string, ok bool) {
+	hash := sha256.New()
+	// the principal is not known before the routes authenticate it, so its credentials stand in for it
+	_, _ = io.WriteString(hash, req.Header.Get("Authorization")+"\n")
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDeliveryBodySize+1))
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		if err != nil || len(body) > maxDeliveryBodySize {
+			return "", false
+		}
+		_, _ = hash.Write(body)
+	}
+	return req.Method + " " + req.URL.Path + " " + id + " " + hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// claim returns the response for a delivery key, and whether the caller is the first to claim it and
+// so has to handle the delivery
+func (d *deliveryDeduplicator) claim(key string, now time.Time) (*deliveryResponse, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if now.After(d.nextSweep) {
+		for k, resp := range d.responses {
+			if resp.expires.Before(now) {
+				delete(d.responses, k)
+			}
+		}
+		d.nextSweep = now.Add(d.ttl)
+	}
+
+	if resp, ok := d.responses[key]; ok && resp.expires.After(now) {
+		return resp, false
+	}
+	resp := &deliveryResponse{
+		done:     make(chan struct{}),
+		expires:  now.Add(d.ttl),
+		complete: true,
+	}
+	d.responses[key] = resp
+	return resp, true
+}
+
+// forget removes the response for a delivery key, so that the delivery can be retried
+func (d *deliveryDeduplicator) forget(key string, resp *deliveryResponse) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.responses[key] == resp {
+		delete(d.responses, key)
+	}
+}
+
+// deduplicateDeliveries answers repeated deliveries to the callback endpoints matching patterns, identified by
+// the first of the delivery ID headers present along with their body and credentials, with the response to the
+// first delivery for ttl, leaving out the deliveryClientHeaders. Deliveries which are still being handled are
+// waited for, failed deliveries (5xx) are not remembered so they can be retried.
+func deduplicateDeliveries(ttl time.Duration, headers []string, patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if ttl <= 0 || len(headers) == 0 || len(patterns) == 0 {
+			return next
+		}
+		d := &deliveryDeduplicator{
+			ttl:       ttl,
+			headers:   headers,
+			patterns:  patterns,
+			responses: make(map[string]*deliveryResponse),
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			id := d.deliveryID(req)
+			if id == "" || !matchesPathGlobs(req.URL.Path, d.patterns) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			key, ok := deliveryKey(req, id)
+			if !ok {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			resp, first := d.claim(key, time.Now())
+			if !first {
+				select {
+				case <-resp.done:
+				case <-req.Context().Done():
+					return
+				}
+				if resp.complete {
+					log.Debug("Answering duplicate delivery %s to %s %s with the original response", id, req.Method, req.URL.Path)
+					header := w.Header()
+					for k, v := range resp.header {
+						header[k] = v
+					}
+					w.WriteHeader(resp.status)
+					_, _ = w.Write(resp.body.Bytes())
+					return
+				}
+				// the original response could not be kept so all that can be done is to handle it again
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			dw := &deliveryResponseWriter{ResponseWriter: w, resp: resp}
+			handled := false
+			defer func() {
+				// a panic leaves the delivery unhandled
+				if !handled || resp.status >= 500 {
+					resp.complete = false
+					d.forget(key, resp)
+				}
+				close(resp.done)
+			}()
+			next.ServeHTTP(dw, req)
+			if !dw.wroteHeader {
+				dw.WriteHeader(http.StatusOK)
+			}
+			handled = true
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicateDeliveries(t *testing.T) {
+	handled := 0
+	handler := deduplicateDeliveries(time.Hour, []string{"X-Gitea-Delivery", "X-GitHub-Delivery"}, compilePathGlobs([]string{"/api/v1/callbacks/*"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled++
+		if req.URL.Query().Get("fail") != "" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Handled", fmt.Sprint(handled))
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, "delivery %d", handled)
+	}))
+
+	deliver := func(target, header, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, nil)
+		if id != "" {
+			req.Header.Set(header, id)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := deliver("/api/v1/callbacks/ci", "X-Gitea-Delivery", "a")
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Equal(t, "delivery 1", resp.Body.String())
+
+	// the duplicate is answered with the original response
+	resp = deliver("/api/v1/callbacks/ci", "X-Gitea-Delivery", "a")
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("X-Handled"))
+	assert.Equal(t, "delivery 1", resp.Body.String())
+
+	// a new delivery is handled
+	resp = deliver("/api/v1/callbacks/ci", "X-Gitea-Delivery", "b")
+	assert.Equal(t, 2, handled)
+	assert.Equal(t, "delivery 2", resp.Body.String())
+	resp = deliver("/api/v1/callbacks/ci", "X-GitHub-Delivery", "a")
+	assert.Equal(t, 3, handled)
+
+	// failed deliveries can be retried
+	deliver("/api/v1/callbacks/ci?fail=1", "X-Gitea-Delivery", "c")
+	deliver("/api/v1/callbacks/ci?fail=1", "X-Gitea-Delivery", "c")
+	assert.Equal(t, 5, handled)
+
+	// requests without a delivery ID or to other paths are not deduplicated
+	deliver("/api/v1/callbacks/ci", "", "")
+	deliver("/api/v1/callbacks/ci", "", "")
+	deliver("/api/v1/repos/migrate", "X-Gitea-Delivery", "a")
+	deliver("/api/v1/repos/migrate", "X-Gitea-Delivery", "a")
+	assert.Equal(t, 9, handled)
+}
+
+func TestDeduplicateDeliveriesOfOthers(t *testing.T) {
+	handled := 0
+	handler := deduplicateDeliveries(time.Hour, []string{"X-Gitea-Delivery"}, compilePathGlobs([]string{"/callback"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled++
+		body, _ := ioutil.ReadAll(req.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(handled)})
+		_, _ = w.Write(body)
+	}))
+
+	deliver := func(authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/callback", strings.NewReader(body))
+		req.Header.Set("X-Gitea-Delivery", "a")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := deliver("token 0123", `{"status":"success"}`)
+	assert.Equal(t, `{"status":"success"}`, resp.Body.String())
+	assert.NotEmpty(t, resp.Header().Get("Set-Cookie"))
+
+	// the duplicate gets the original body, but not the cookies meant for the original sender
+	resp = deliver("token 0123", `{"status":"success"}`)
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, `{"status":"success"}`, resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Set-Cookie"))
+
+	// reusing the ID with another body or other credentials is another delivery
+	assert.Equal(t, `{"status":"failure"}`, deliver("token 0123", `{"status":"failure"}`).Body.String())
+	assert.Equal(t, 2, handled)
+	deliver("token 4567", `{"status":"success"}`)
+	deliver("", `{"status":"success"}`)
+	assert.Equal(t, 4, handled)
+
+	// bodies too large to be hashed are passed on whole without being deduplicated
+	large := strings.Repeat("x", maxDeliveryBodySize+1)
+	assert.Equal(t, large, deliver("", large).Body.String())
+	assert.Equal(t, large, deliver("", large).Body.String())
+	assert.Equal(t, 6, handled)
+}
+
+func TestDeduplicateDeliveriesExpire(t *testing.T) {
+	handled := 0
+	handler := deduplicateDeliveries(10*time.Millisecond, []string{"X-Gitea-Delivery"}, compilePathGlobs([]string{"/callback"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled++
+	}))
+
+	deliver := func() {
+		req := httptest.NewRequest("POST", "/callback", nil)
+		req.Header.Set("X-Gitea-Delivery", "a")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	deliver()
+	deliver()
+	assert.Equal(t, 1, handled)
+	time.Sleep(20 * time.Millisecond)
+	deliver()
+	assert.Equal(t, 2, handled)
+}
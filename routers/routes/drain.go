@@ -0,0 +1,116 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// drainProgressInterval is how often the number of requests still in flight is logged whilst draining them
+const drainProgressInterval = 5 * time.Second
+
+// requestTracker tracks the requests being handled, so that a shutdown can wait for them to finish. Unlike with a
+// sync.WaitGroup, requests may still start whilst it is waited for, e.g. on connections kept alive.
+type requestTracker struct {
+	lock  sync.Mutex
+	count int64
+	// idle is closed once no requests are in flight, if anything is waiting for that
+	idle chan struct{}
+}
+
+// draining is set to 1 once the shutdown has begun and the requests in flight are being drained
+var draining int32
+
+// inFlight tracks the requests handled by the routers of NewChi
+var inFlight = &requestTracker{}
+
+func (t *requestTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.lock.Lock()
+		t.count++
+		t.lock.Unlock()
+		defer func() {
+			t.lock.Lock()
+			t.count--
+			if t.count == 0 && t.idle != nil {
+				close(t.idle)
+				t.idle = nil
+			}
+			t.lock.Unlock()
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// InFlight returns the number of requests being handled
+func (t *requestTracker) InFlight() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.count
+}
+
+// drain waits up to timeout for the requests in flight to finish, logging how many are left every
+// drainProgressInterval, and returns whether they did. Requests still running once the timeout has passed are
+// cut off with hammer.
+func (t *requestTracker) drain(timeout time.Duration, hammer func()) bool {
+	t.lock.Lock()
+	if t.count == 0 {
+		t.lock.Unlock()
+		return true
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	done := t.idle
+	t.lock.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	progress := time.NewTicker(drainProgressInterval)
+	defer progress.Stop()
+	for {
+		select {
+		case <-done:
+			log.Info("All requests in flight have finished")
+			return true
+		case <-progress.C:
+			log.Info("Waiting for %d requests in flight to finish", t.InFlight())
+		case <-deadline.C:
+			log.Warn("%d requests still in flight after %v, cutting them off", t.InFlight(), timeout)
+			hammer()
+			return false
+		}
+	}
+}
+
+// InFlightRequests returns the number of requests being handled, e.g. to follow the progress of a shutdown
+func InFlightRequests() int64 {
+	return inFlight.InFlight()
+}
+
+// IsDraining returns whether the shutdown has begun, from which point the health check answers 503 so that load
+// balancers stop sending requests
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// BeginShutdown waits up to setting.GracefulShutdownTimeout for the requests in flight, such as long running git
+// pushes and clones, to finish once the server has stopped accepting new ones, and then cuts off any still
+// running. Without a timeout it does nothing, leaving it to the GRACEFUL_HAMMER_TIME to cut them off.
+func BeginShutdown() {
+	atomic.StoreInt32(&draining, 1)
+	if setting.GracefulShutdownTimeout <= 0 {
+		return
+	}
+	log.Info("Draining %d requests in flight for up to %v", InFlightRequests(), setting.GracefulShutdownTimeout)
+	inFlight.drain(setting.GracefulShutdownTimeout, graceful.GetManager().DoImmediateHammer)
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTrackerDrain(t *testing.T) {
+	tracker := &requestTracker{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := tracker.track(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/user2/repo1.git/git-receive-pack" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+
+	// finished requests are not waited for
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.EqualValues(t, 0, tracker.InFlight())
+	assert.True(t, tracker.drain(time.Second, func() { t.Error("hammered without requests in flight") }))
+
+	// a push outlasting the timeout is cut off
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo1.git/git-receive-pack", nil))
+		close(done)
+	}()
+	<-started
+	assert.EqualValues(t, 1, tracker.InFlight())
+	hammered := false
+	start := time.Now()
+	assert.False(t, tracker.drain(50*time.Millisecond, func() {
+		hammered = true
+		release <- struct{}{}
+	}))
+	assert.True(t, hammered)
+	assert.True(t, time.Since(start) < time.Second)
+	<-done
+	assert.EqualValues(t, 0, tracker.InFlight())
+
+	// whereas one finishing within it is waited for
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/user2/repo1.git/git-receive-pack", nil))
+	<-started
+	time.AfterFunc(20*time.Millisecond, func() { release <- struct{}{} })
+	assert.True(t, tracker.drain(time.Second, func() { t.Error("hammered although the push finished in time") }))
+	assert.EqualValues(t, 0, tracker.InFlight())
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"strings"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// ambiguousFraming returns why the length of the body of the request is ambiguous, or an empty string if it is
+// not. A request whose body length a proxy in front of Gitea may work out differently than Gitea can be used to
+// smuggle another request past the proxy.
+func ambiguousFraming(req *http.Request) string {
+	var lengths []string
+	for _, value := range req.Header["Content-Length"] {
+		for _, length := range strings.Split(value, ",") {
+			length = strings.TrimSpace(length)
+			if len(lengths) > 0 && length != lengths[0] {
+				return "conflicting Content-Length values"
+			}
+			lengths = append(lengths, length)
+		}
+	}
+
+	transferEncoding := len(req.TransferEncoding) > 0 || len(req.Header["Transfer-Encoding"]) > 0
+	if transferEncoding && (len(lengths) > 0 || req.ContentLength > 0) {
+		return "both Content-Length and Transfer-Encoding"
+	}
+	return ""
+}
+
+// rejectAmbiguousFraming answers requests with both a Content-Length and a Transfer-Encoding or with conflicting
+// Content-Length values with 400 Bad Request before anything reads their bodies, logging them as possible request
+// smuggling attempts. The HTTP/1.1 server of Go already rejects conflicting lengths and lets Transfer-Encoding
+// override Content-Length, but front ends such as FastCGI pass the headers on as the client sent them.
+func rejectAmbiguousFraming() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if reason := ambiguousFraming(req); reason != "" {
+				log.Warn("Rejected %s %s from %s with %s, possibly an attempt to smuggle a request", req.Method, req.URL.Path, clientAddr(req), reason)
+				w.Header().Set("Connection", "close")
+				renderStatus(w, req, http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fcgiRecord encodes a FastCGI record of request 1
+func fcgiRecord(recordType byte, content []byte) []byte {
+	record := []byte{1, recordType, 0, 1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(record[4:], uint16(len(content)))
+	return append(record, content...)
+}
+
+// fcgiRequest sends a request with the params and body over a raw FastCGI connection to addr, as a web server
+// would, and returns the response
+func fcgiRequest(t *testing.T, addr string, params [][2]string, body string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	var encoded []byte
+	for _, param := range params {
+		encoded = append(encoded, byte(len(param[0])), byte(len(param[1])))
+		encoded = append(encoded, param[0]+param[1]...)
+	}
+	var msg []byte
+	msg = append(msg, fcgiRecord(1, []byte{0, 1, 0, 0, 0, 0, 0, 0})...) // begin request as a responder
+	msg = append(msg, fcgiRecord(4, encoded)...)
+	msg = append(msg, fcgiRecord(4, nil)...)
+	if body != "" {
+		msg = append(msg, fcgiRecord(5, []byte(body))...)
+	}
+	msg = append(msg, fcgiRecord(5, nil)...)
+	_, err = conn.Write(msg)
+	assert.NoError(t, err)
+
+	// collect the stdout records until the end of the request
+	var stdout bytes.Buffer
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(conn, header)
+		assert.NoError(t, err)
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+		_, err = io.ReadFull(conn, content)
+		assert.NoError(t, err)
+		if header[1] == 3 {
+			break
+		}
+		if header[1] == 6 {
+			stdout.Write(content[:binary.BigEndian.Uint16(header[4:])])
+		}
+	}
+	// the response is CGI style, with a Status header instead of a status line
+	resp, err := http.ReadResponse(bufio.NewReader(io.MultiReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\n"), &stdout)), nil)
+	assert.NoError(t, err)
+	if status := resp.Header.Get("Status"); len(status) >= 3 {
+		resp.StatusCode, err = strconv.Atoi(status[:3])
+		assert.NoError(t, err)
+	}
+	return resp
+}
+
+func TestRejectAmbiguousFraming(t *testing.T) {
+	var bodies []string
+	handler := rejectAmbiguousFraming()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+	}))
+
+	t.Run("HTTP", func(t *testing.T) {
+		bodies = nil
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		send := func(raw string) *http.Response {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(raw))
+			assert.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		resp := send("POST /user2/repo1.git/git-receive-pack HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nConnection: close\r\n\r\nabcd")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"abcd"}, bodies)
+
+		resp = send("POST /user2/repo1.git/git-receive-pack HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nContent-Length: 40\r\n\r\nabcd")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Len(t, bodies, 1)
+
+		// the server reads the body as chunked and drops the Content-Length, so that it cannot be misread
+		resp = send("POST /user2/repo1.git/git-receive-pack HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n3\r\nabc\r\n0\r\n\r\n")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"abcd", "abc"}, bodies)
+	})
+
+	t.Run("FastCGI", func(t *testing.T) {
+		bodies = nil
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			_ = fcgi.Serve(listener, handler)
+		}()
+		params := func(extra ...[2]string) [][2]string {
+			return append([][2]string{
+				{"REQUEST_METHOD", "POST"},
+				{"SERVER_PROTOCOL", "HTTP/1.1"},
+				{"REQUEST_URI", "/user2/repo1.git/git-receive-pack"},
+				{"HTTP_HOST", "localhost"},
+			}, extra...)
+		}
+
+		resp := fcgiRequest(t, listener.Addr().String(), params([2]string{"CONTENT_LENGTH", "4"}), "abcd")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"abcd"}, bodies)
+
+		resp = fcgiRequest(t, listener.Addr().String(), params([2]string{"CONTENT_LENGTH", "4"}, [2]string{"HTTP_TRANSFER_ENCODING", "chunked"}), "3\r\nabc\r\n0\r\n\r\n")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Len(t, bodies, 1)
+
+		resp = fcgiRequest(t, listener.Addr().String(), params([2]string{"CONTENT_LENGTH", "4"}, [2]string{"HTTP_CONTENT_LENGTH", "4, 40"}), "abcd")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Len(t, bodies, 1)
+
+		// repeating the same length is not ambiguous
+		resp = fcgiRequest(t, listener.Addr().String(), params([2]string{"CONTENT_LENGTH", "4"}, [2]string{"HTTP_CONTENT_LENGTH", "4, 4"}), "abcd")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"abcd", "abcd"}, bodies)
+	})
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/timing"
+
+	"github.com/gobwas/glob"
+)
+
+// robotsNoIndex adds an "X-Robots-Tag: noindex" header to the responses to requests with a path matching
+// any of patterns, so that search engines do not index them even if they are not HTML
+func robotsNoIndex(patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(patterns) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if matchesPathGlobs(req.URL.Path, patterns) {
+				w.Header().Set("X-Robots-Tag", "noindex")
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// hopByHopHeaders are the hop-by-hop headers of RFC 7230 which only apply to a single connection. Trailer is
+// left out as net/http uses it to announce the trailers of a response.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers and the headers named by the Connection header from h.
+// A "Connection: close" is kept as net/http closes the connection after the response for it.
+func removeHopByHopHeaders(h http.Header) {
+	closeConnection := false
+	for _, connection := range h.Values("Connection") {
+		for _, name := range strings.Split(connection, ",") {
+			name = strings.TrimSpace(name)
+			if strings.EqualFold(name, "close") {
+				closeConnection = true
+			} else if name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+	if closeConnection {
+		h.Set("Connection", "close")
+	}
+}
+
+// IsWebSocketUpgrade returns whether the request asks to upgrade its connection to a WebSocket, i.e. it has
+// an Upgrade token in its Connection header and an Upgrade of websocket. The connection of such a request is
+// long lived and hijacked by the handler, so RENDER_TIMEOUT, MAX_REQUEST_BODY_SIZE and ENABLE_GZIP do not
+// apply to it.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(strings.TrimSpace(req.Header.Get("Upgrade")), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instanceHeaders adds X-Gitea-Instance with the name of this instance, if it has one, and X-Gitea-Version with the
+// version of Gitea, if version is not empty, to the responses. Any of these headers already set by the handler is
+// left as it is.
+func instanceHeaders(name, version string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if name == "" && version == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(onWriteHeader(w, func(status int) {
+				if name != "" && w.Header().Get("X-Gitea-Instance") == "" {
+					w.Header().Set("X-Gitea-Instance", name)
+				}
+				if version != "" && w.Header().Get("X-Gitea-Version") == "" {
+					w.Header().Set("X-Gitea-Version", version)
+				}
+			}), req)
+		})
+	}
+}
+
+// stripHopByHopHeaders removes hop-by-hop headers set by handlers, e.g. passed on from another service,
+// from the responses so that they cannot confuse the intermediaries between Gitea and the client.
+// Responses to upgrade requests such as WebSockets are left alone as they need these headers.
+func stripHopByHopHeaders() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			next.ServeHTTP(onWriteHeader(w, func(status int) {
+				removeHopByHopHeaders(w.Header())
+			}), req)
+		})
+	}
+}
+
+// secureCookies adds the Secure attribute and, unless sameSite is http.SameSiteDefaultMode, the SameSite one to the
+// cookies set by the responses to secure requests which do not have them, so that they are consistent whichever
+// handler set them. The attributes already there are kept as they are. Responses to OPTIONS and insecure requests
+// are left alone.
+func secureCookies(sameSite http.SameSite) func(next http.Handler) http.Handler {
+	var sameSiteAttr string
+	switch sameSite {
+	case http.SameSiteLaxMode:
+		sameSiteAttr = "SameSite=Lax"
+	case http.SameSiteStrictMode:
+		sameSiteAttr = "SameSite=Strict"
+	case http.SameSiteNoneMode:
+		sameSiteAttr = "SameSite=None"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions || !RequestIsSecure(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			next.ServeHTTP(onWriteHeader(w, func(int) {
+				cookies := w.Header()["Set-Cookie"]
+				for i, cookie := range cookies {
+					cookies[i] = addCookieAttributes(cookie, sameSiteAttr)
+				}
+			}), req)
+		})
+	}
+}
+
+// addCookieAttributes appends Secure and sameSiteAttr, if not empty, to the Set-Cookie header value cookie unless
+// it already has them, whatever their case or values
+func addCookieAttributes(cookie, sameSiteAttr string) string {
+	hasSecure, hasSameSite := false, false
+	// the first part is the name and value of the cookie
+	for _, attr := range strings.Split(cookie, ";")[1:] {
+		name := strings.TrimSpace(attr)
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		switch {
+		case strings.EqualFold(name, "Secure"):
+			hasSecure = true
+		case strings.EqualFold(name, "SameSite"):
+			hasSameSite = true
+		}
+	}
+	if hasSecure && (hasSameSite || sameSiteAttr == "") {
+		return cookie
+	}
+	cookie = strings.TrimRight(cookie, "; ")
+	if !hasSecure {
+		cookie += "; Secure"
+	}
+	if !hasSameSite && sameSiteAttr != "" {
+		cookie += "; " + sameSiteAttr
+	}
+	return cookie
+}
+
+// serverTiming adds a Server-Timing header to the responses listing the time spent in the phases of the request
+// recorded with the timing package, e.g. auth, render and storage, followed by the total time until the headers
+// were sent. Phases still running at that point, such as a streamed render, are left out.
+func serverTiming() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			req = req.WithContext(timing.WithRecorder(req.Context()))
+			next.ServeHTTP(onWriteHeader(w, func(int) {
+				value := timing.Entry("total", time.Since(start))
+				if phases := timing.Header(req.Context()); phases != "" {
+					value = phases + ", " + value
+				}
+				w.Header().Set("Server-Timing", value)
+			}), req)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/timing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRobotsNoIndex(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	storageHandler := storageHandler(setting.Storage{}, "avatars", objStore, nil)
+	handler := robotsNoIndex(compilePathGlobs([]string{"/avatars/**", "/*/*/raw/**"}))(storageHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("page"))
+	})))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+		return resp
+	}
+
+	resp := serve("/avatars/1234")
+	assert.Equal(t, "avatar", resp.Body.String())
+	assert.Equal(t, "noindex", resp.Header().Get("X-Robots-Tag"))
+	assert.Equal(t, "noindex", serve("/user2/repo1/raw/branch/master/README.md").Header().Get("X-Robots-Tag"))
+
+	assert.Empty(t, serve("/user2/repo1/src/branch/master/README.md").Header().Get("X-Robots-Tag"))
+	assert.Empty(t, serve("/explore/repos").Header().Get("X-Robots-Tag"))
+}
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	handler := stripHopByHopHeaders()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", req.URL.Query().Get("connection"))
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Upgrade", "h2c")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+	}))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user/events?connection=keep-alive,+X-Backend-Hop", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	for _, name := range []string{"Connection", "Keep-Alive", "Upgrade", "X-Backend-Hop"} {
+		assert.Empty(t, resp.Header().Get(name), name)
+	}
+	assert.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
+	assert.True(t, resp.Flushed)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user/events?connection=close", nil))
+	assert.Equal(t, "close", resp.Header().Get("Connection"))
+	assert.Empty(t, resp.Header().Get("Keep-Alive"))
+
+	// upgrade requests need their hop-by-hop headers
+	req := httptest.NewRequest("GET", "/user/events?connection=Upgrade", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "Upgrade", resp.Header().Get("Connection"))
+	assert.Equal(t, "h2c", resp.Header().Get("Upgrade"))
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		connection, upgrade string
+		expected            bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "WebSocket", true},
+		{"Upgrade", "h2c", false},
+		{"keep-alive", "websocket", false},
+		{"", "websocket", false},
+		{"Upgrade", "", false},
+	} {
+		req := httptest.NewRequest("GET", "/user/events", nil)
+		if tc.connection != "" {
+			req.Header.Set("Connection", tc.connection)
+		}
+		if tc.upgrade != "" {
+			req.Header.Set("Upgrade", tc.upgrade)
+		}
+		assert.Equal(t, tc.expected, IsWebSocketUpgrade(req), "Connection: %s Upgrade: %s", tc.connection, tc.upgrade)
+	}
+}
+
+func TestInstanceHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/proxied" {
+			w.Header().Set("X-Gitea-Instance", "upstream")
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	serve := func(handler http.Handler, p string) http.Header {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", p, nil))
+		return resp.Header()
+	}
+
+	header := serve(instanceHeaders("node-3", "1.13.0")(next), "/")
+	assert.Equal(t, "node-3", header.Get("X-Gitea-Instance"))
+	assert.Equal(t, "1.13.0", header.Get("X-Gitea-Version"))
+
+	// headers set by the handler are kept
+	header = serve(instanceHeaders("node-3", "1.13.0")(next), "/proxied")
+	assert.Equal(t, []string{"upstream"}, header.Values("X-Gitea-Instance"))
+
+	header = serve(instanceHeaders("node-3", "")(next), "/")
+	assert.Equal(t, "node-3", header.Get("X-Gitea-Instance"))
+	assert.NotContains(t, header, "X-Gitea-Version")
+
+	header = serve(instanceHeaders("", "")(next), "/")
+	assert.NotContains(t, header, "X-Gitea-Instance")
+	assert.NotContains(t, header, "X-Gitea-Version")
+}
+
+func TestSecureCookies(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "i_like_gitea", Value: "abc", Path: "/", HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "en-US", Secure: true, SameSite: http.SameSiteStrictMode})
+		w.Header().Add("Set-Cookie", "_csrf=xyz; path=/; secure; samesite=none;")
+		_, _ = w.Write([]byte("ok"))
+	})
+	serve := func(sameSite http.SameSite, method string, secure bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		resp := httptest.NewRecorder()
+		secureCookies(sameSite)(next).ServeHTTP(resp, req)
+		return resp
+	}
+	cookies := func(resp *httptest.ResponseRecorder) map[string]*http.Cookie {
+		parsed := map[string]*http.Cookie{}
+		for _, cookie := range (&http.Response{Header: resp.Header()}).Cookies() {
+			parsed[cookie.Name] = cookie
+		}
+		return parsed
+	}
+
+	resp := serve(http.SameSiteLaxMode, "GET", true)
+	assert.Equal(t, []string{
+		"i_like_gitea=abc; Path=/; HttpOnly; Secure; SameSite=Lax",
+		"lang=en-US; Secure; SameSite=Strict",
+		"_csrf=xyz; path=/; secure; samesite=none;",
+	}, resp.Header().Values("Set-Cookie"))
+	parsed := cookies(resp)
+	assert.True(t, parsed["i_like_gitea"].Secure)
+	assert.True(t, parsed["i_like_gitea"].HttpOnly)
+	assert.Equal(t, "/", parsed["i_like_gitea"].Path)
+	assert.Equal(t, http.SameSiteLaxMode, parsed["i_like_gitea"].SameSite)
+	// attributes already there are kept
+	assert.Equal(t, http.SameSiteStrictMode, parsed["lang"].SameSite)
+	assert.Equal(t, http.SameSiteNoneMode, parsed["_csrf"].SameSite)
+
+	// with the default mode only Secure is added
+	resp = serve(http.SameSiteDefaultMode, "GET", true)
+	assert.Equal(t, "i_like_gitea=abc; Path=/; HttpOnly; Secure", resp.Header().Values("Set-Cookie")[0])
+
+	// cookies of OPTIONS and insecure requests are left alone
+	for _, resp := range []*httptest.ResponseRecorder{serve(http.SameSiteLaxMode, "OPTIONS", true), serve(http.SameSiteLaxMode, "GET", false)} {
+		parsed = cookies(resp)
+		assert.False(t, parsed["i_like_gitea"].Secure)
+		assert.Equal(t, http.SameSite(0), parsed["i_like_gitea"].SameSite)
+		assert.Equal(t, "i_like_gitea=abc; Path=/; HttpOnly", resp.Header().Values("Set-Cookie")[0])
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "0123456789"})
+	c := chi.NewRouter()
+	c.Use(serverTiming())
+	c.Use(storageHandler(setting.Storage{}, "avatars", objStore, nil))
+	c.Get("/user2", func(w http.ResponseWriter, req *http.Request) {
+		stop := timing.Start(req.Context(), timing.PhaseAuth)
+		time.Sleep(5 * time.Millisecond)
+		stop()
+		defer timing.Start(req.Context(), timing.PhaseRender)()
+		_, _ = w.Write([]byte("user2"))
+	})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/user2", nil))
+	// the render is still running when the response is started
+	assert.Regexp(t, `^auth;dur=\d+\.\d, total;dur=\d+\.\d$`, resp.Header().Get("Server-Timing"))
+
+	resp = httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Regexp(t, `^storage;dur=\d+\.\d, total;dur=\d+\.\d$`, resp.Header().Get("Server-Timing"))
+}
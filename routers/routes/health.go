@@ -0,0 +1,131 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/time/rate"
+)
+
+// startupComplete is set to 1 once the initial boot tasks have completed
+var startupComplete int32
+
+// MarkStartupComplete records that the initial boot tasks (migrations, template compilation, cache setup)
+// have completed, from which point the startup probe succeeds
+func MarkStartupComplete() {
+	atomic.StoreInt32(&startupComplete, 1)
+}
+
+// IsStartupComplete returns whether the initial boot tasks have completed
+func IsStartupComplete() bool {
+	return atomic.LoadInt32(&startupComplete) == 1
+}
+
+// startupProbe responds with 503 until startup has completed and 200 afterwards,
+// so that it can be used as a Kubernetes startup probe
+func startupProbe(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !IsStartupComplete() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("starting\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// rootHealthCheck answers HEAD / for load balancers and uptime monitors with an empty 200, or 503 once the server is
+// draining requests to shut down. It is kept cheap and checks nothing else, /api/healthz checks the components.
+func rootHealthCheck(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", "0")
+	if setting.InstanceName != "" {
+		w.Header().Set("X-Gitea-Instance", setting.InstanceName)
+	}
+	if IsDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// healthChecks are the checks of the components that /api/healthz reports on, keyed by component name
+var healthChecks = map[string]func() error{
+	"database:ping": models.Ping,
+}
+
+// healthCheckResult is the result of a single check of the health check response
+type healthCheckResult struct {
+	Status string `json:"status"`
+	Time   string `json:"time"`
+}
+
+// healthResponse is a health check response as per draft-inadarei-api-health-check
+type healthResponse struct {
+	Status string                         `json:"status"`
+	Checks map[string][]healthCheckResult `json:"checks,omitempty"`
+}
+
+// newHealthCheckLimiter returns the limiter for health checks allowing limit requests per second,
+// or nil if limit is 0 or less and the health checks are not limited
+func newHealthCheckLimiter(limit float64) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// healthCheck runs the health checks and responds with "pass" and a 200 if all of them succeed, and
+// with "fail" and a 503 otherwise. It does not require authentication, so requests beyond the limit of
+// limiter are answered with a 429 to stop the checks from being used to overload the instance.
+func healthCheck(limiter *rate.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if limiter != nil && !limiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			renderStatus(w, req, http.StatusTooManyRequests)
+			return
+		}
+
+		resp := healthResponse{
+			Status: "pass",
+			Checks: make(map[string][]healthCheckResult, len(healthChecks)),
+		}
+		if !IsStartupComplete() {
+			resp.Status = "fail"
+		}
+		for name, check := range healthChecks {
+			result := healthCheckResult{Status: "pass", Time: time.Now().UTC().Format(time.RFC3339)}
+			if err := check(); err != nil {
+				// the error is only logged as the response is public
+				log.Error("Health check %s failed: %v", name, err)
+				result.Status = "fail"
+				resp.Status = "fail"
+			}
+			resp.Checks[name] = []healthCheckResult{result}
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/health+json")
+		if resp.Status != "pass" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartupProbe(t *testing.T) {
+	defer atomic.StoreInt32(&startupComplete, atomic.LoadInt32(&startupComplete))
+	atomic.StoreInt32(&startupComplete, 0)
+
+	c := chi.NewRouter()
+	c.Get("/-/startupz", startupProbe)
+	c.Head("/-/startupz", startupProbe)
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest(method, "/-/startupz", nil))
+		return resp
+	}
+
+	resp := serve("GET")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve("HEAD").Code)
+
+	MarkStartupComplete()
+	assert.True(t, IsStartupComplete())
+
+	resp = serve("GET")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "ok\n", resp.Body.String())
+	assert.Equal(t, http.StatusOK, serve("HEAD").Code)
+}
+
+func TestRootHealthCheck(t *testing.T) {
+	defer atomic.StoreInt32(&draining, atomic.LoadInt32(&draining))
+	defer func(name string, timeout time.Duration) {
+		setting.InstanceName, setting.GracefulShutdownTimeout = name, timeout
+	}(setting.InstanceName, setting.GracefulShutdownTimeout)
+	setting.InstanceName = ""
+	setting.GracefulShutdownTimeout = 0
+
+	c := chi.NewRouter()
+	c.Head("/", rootHealthCheck)
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	head := func() *http.Response {
+		resp, err := http.Head(server.URL + "/")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := head()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Empty(t, resp.Header.Get("X-Gitea-Instance"))
+
+	setting.InstanceName = "node-3"
+	assert.Equal(t, "node-3", head().Header.Get("X-Gitea-Instance"))
+
+	// load balancers are told to stop sending requests once the shutdown has begun
+	BeginShutdown()
+	assert.True(t, IsDraining())
+	resp = head()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+}
+
+func TestHealthCheck(t *testing.T) {
+	defer atomic.StoreInt32(&startupComplete, atomic.LoadInt32(&startupComplete))
+	defer func(checks map[string]func() error) {
+		healthChecks = checks
+	}(healthChecks)
+
+	var dbErr error
+	healthChecks = map[string]func() error{
+		"database:ping": func() error { return dbErr },
+	}
+	MarkStartupComplete()
+
+	serve := func(handler http.HandlerFunc) (*httptest.ResponseRecorder, healthResponse) {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/api/healthz", nil))
+		var health healthResponse
+		if resp.Code != http.StatusTooManyRequests {
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &health))
+		}
+		return resp, health
+	}
+
+	handler := healthCheck(nil)
+	resp, health := serve(handler)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/health+json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "pass", health.Status)
+	if assert.Len(t, health.Checks["database:ping"], 1) {
+		assert.Equal(t, "pass", health.Checks["database:ping"][0].Status)
+	}
+
+	dbErr = errors.New("connection refused")
+	resp, health = serve(handler)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "fail", health.Status)
+	assert.NotContains(t, resp.Body.String(), "connection refused")
+
+	dbErr = nil
+	atomic.StoreInt32(&startupComplete, 0)
+	resp, health = serve(handler)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "fail", health.Status)
+
+	// a flood of health checks is cut off
+	MarkStartupComplete()
+	handler = healthCheck(newHealthCheckLimiter(2))
+	for i := 0; i < 2; i++ {
+		resp, _ = serve(handler)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+	resp, _ = serve(handler)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+}
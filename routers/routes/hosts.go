@@ -0,0 +1,61 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isHealthCheck returns whether the request is one of the health checks, which load balancers and
+// orchestrators commonly send with the address of the instance as Host
+func isHealthCheck(req *http.Request) bool {
+	switch req.URL.Path {
+	case "/api/healthz", "/-/startupz":
+		return true
+	case "/":
+		return req.Method == "HEAD"
+	}
+	return false
+}
+
+// trustedHostSet returns the lower cased host names of the domain and the trusted hosts, any port of
+// them is ignored
+func trustedHostSet(domain string, hosts []string) map[string]bool {
+	set := make(map[string]bool, len(hosts)+1)
+	for _, host := range append([]string{domain}, hosts...) {
+		if host = strings.ToLower(hostname(strings.TrimSpace(host))); host != "" {
+			set[host] = true
+		}
+	}
+	return set
+}
+
+// requestHost returns the host the client sent the request to, which is the first X-Forwarded-Host
+// for requests from trusted proxies which set it and the Host otherwise
+func requestHost(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		if isTrustedProxy(req, remoteIP(req)) {
+			return strings.TrimSpace(strings.SplitN(forwarded, ",", 2)[0])
+		}
+	}
+	return req.Host
+}
+
+// trustedHostGuard answers requests for any host but the trusted ones with 421 Misdirected Request, so
+// that a forged Host cannot end up in generated links or cached responses. The port of the host is not
+// checked. Health checks and the internal API, which the hooks and `gitea manager` call on the LOCAL_ROOT_URL,
+// e.g. http://localhost:3000/, are let through whatever their host.
+func trustedHostGuard(trusted map[string]bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if isHealthCheck(req) || hasPathPrefix(req.URL.Path, "/api/internal") || trusted[strings.ToLower(hostname(requestHost(req)))] {
+				next.ServeHTTP(w, req)
+				return
+			}
+			renderStatus(w, req, http.StatusMisdirectedRequest)
+		})
+	}
+}
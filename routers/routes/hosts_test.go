@@ -0,0 +1,68 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedHostGuard(t *testing.T) {
+	c := chi.NewRouter()
+	c.Use(trustProxies(parseTrustedProxies([]string{"loopback"})))
+	c.Use(trustedHostGuard(trustedHostSet("try.gitea.io", []string{" Git.Example.com:3000", "192.0.2.10", "[2001:db8::10]", "::1"})))
+	for _, p := range []string{"/", "/api/healthz", "/-/startupz", "/api/internal/hook/pre-receive/user2/repo1"} {
+		c.Get(p, func(w http.ResponseWriter, req *http.Request) {})
+		c.Head(p, func(w http.ResponseWriter, req *http.Request) {})
+	}
+
+	for _, tc := range []struct {
+		method, path, host, remote, forwarded string
+		status                                int
+	}{
+		{"GET", "/", "try.gitea.io", "", "", http.StatusOK},
+		{"GET", "/", "TRY.gitea.io:3000", "", "", http.StatusOK},
+		{"GET", "/", "git.example.com", "", "", http.StatusOK},
+		{"GET", "/", "git.example.com:443", "", "", http.StatusOK},
+		{"GET", "/", "192.0.2.10:3000", "", "", http.StatusOK},
+		{"GET", "/", "[2001:db8::10]", "", "", http.StatusOK},
+		{"GET", "/", "[2001:DB8::10]:3000", "", "", http.StatusOK},
+		{"GET", "/", "[::1]:3000", "", "", http.StatusOK},
+		{"GET", "/", "evil.example.com", "", "", http.StatusMisdirectedRequest},
+		{"GET", "/", "try.gitea.io.evil.example.com", "", "", http.StatusMisdirectedRequest},
+		{"GET", "/", "[2001:db8::11]:3000", "", "", http.StatusMisdirectedRequest},
+		{"GET", "/", "", "", "", http.StatusMisdirectedRequest},
+
+		// health checks are let through whatever their host
+		{"HEAD", "/", "10.0.0.5:3000", "", "", http.StatusOK},
+		{"GET", "/api/healthz", "10.0.0.5:3000", "", "", http.StatusOK},
+		{"HEAD", "/-/startupz", "10.0.0.5:3000", "", "", http.StatusOK},
+
+		// so is the internal API, which is called on the LOCAL_ROOT_URL
+		{"GET", "/api/internal/hook/pre-receive/user2/repo1", "localhost:3000", "", "", http.StatusOK},
+
+		// the forwarded host is only checked for trusted proxies
+		{"GET", "/", "gitea:3000", "127.0.0.1:41234", "try.gitea.io, gitea:3000", http.StatusOK},
+		{"GET", "/", "try.gitea.io", "127.0.0.1:41234", "evil.example.com", http.StatusMisdirectedRequest},
+		{"GET", "/", "gitea:3000", "203.0.113.7:41234", "try.gitea.io", http.StatusMisdirectedRequest},
+		{"GET", "/", "try.gitea.io", "203.0.113.7:41234", "evil.example.com", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Host = tc.host
+		if tc.remote != "" {
+			req.RemoteAddr = tc.remote
+		}
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-Host", tc.forwarded)
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		assert.Equal(t, tc.status, resp.Code, "%s %s Host: %s X-Forwarded-Host: %s from %s", tc.method, tc.path, tc.host, tc.forwarded, tc.remote)
+	}
+}
@@ -0,0 +1,785 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/gobwas/glob"
+)
+
+// bodySizeOverride allows requests matching a path to carry a different body size limit
+type bodySizeOverride struct {
+	match func(path string) bool
+	limit int64
+}
+
+// multipartOverhead is the allowance made on top of an attachment's size for the multipart framing
+const multipartOverhead = 1 << 20
+
+// bodySizeOverrides returns the endpoints which are allowed larger bodies than setting.MaxRequestBodySize
+func bodySizeOverrides() []bodySizeOverride {
+	var attachmentLimit int64
+	if setting.Attachment.MaxSize > 0 {
+		attachmentLimit = setting.Attachment.MaxSize<<20 + multipartOverhead
+	}
+	return []bodySizeOverride{
+		{
+			// git smart http pushes are only limited by the repository size
+			match: func(p string) bool {
+				return strings.HasSuffix(p, "/git-receive-pack") || strings.HasSuffix(p, "/git-upload-pack")
+			},
+		},
+		{
+			match: func(p string) bool {
+				return strings.Contains(p, ".git/info/lfs/")
+			},
+			limit: setting.LFS.MaxFileSize,
+		},
+		{
+			match: func(p string) bool {
+				return strings.HasSuffix(p, "/attachments") || strings.HasSuffix(p, "/assets")
+			},
+			limit: attachmentLimit,
+		},
+	}
+}
+
+// limitedRequestBody records whether the wrapped http.MaxBytesReader hit its limit
+type limitedRequestBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitResponseWriter replaces the response of a handler with an error if the handler
+// has failed because the request body exceeded one of its limits
+type bodyLimitResponseWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	exceeded    func() bool
+	status      int
+	wroteHeader bool
+	rejected    bool
+}
+
+func (w *bodyLimitResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.exceeded() {
+		w.rejected = true
+		renderStatus(w.ResponseWriter, w.req, w.status)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyLimitResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (w *bodyLimitResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.rejected {
+		f.Flush()
+	}
+}
+
+// maxRequestBodySize limits the size of request bodies to limit bytes, or the limit of the first
+// matching override. A limit of 0 or less means the body is not limited. WebSocket upgrades are not limited.
+func maxRequestBodySize(limit int64, overrides []bodySizeOverride) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if IsWebSocketUpgrade(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			max := limit
+			for _, override := range overrides {
+				if override.match(req.URL.Path) {
+					max = override.limit
+					break
+				}
+			}
+			if max <= 0 || req.Body == nil || req.Body == http.NoBody {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			if req.ContentLength > max {
+				renderStatus(w, req, http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			body := &limitedRequestBody{
+				ReadCloser: http.MaxBytesReader(w, req.Body, max),
+				limit:      max,
+			}
+			req.Body = body
+			lw := &bodyLimitResponseWriter{
+				ResponseWriter: w,
+				req:            req,
+				exceeded:       func() bool { return body.exceeded },
+				status:         http.StatusRequestEntityTooLarge,
+			}
+
+			next.ServeHTTP(lw, req)
+
+			if body.exceeded && !lw.wroteHeader {
+				lw.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+// acceptsCompressedBody returns whether the endpoint at p decompresses request bodies sent with a Content-Encoding,
+// which only the git smart HTTP endpoints do
+func acceptsCompressedBody(p string) bool {
+	return strings.HasSuffix(p, "/git-upload-pack") || strings.HasSuffix(p, "/git-receive-pack")
+}
+
+// gzipRequestBody is a gzip encoded request body being decompressed
+type gzipRequestBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipRequestBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
+}
+
+// maxDecompressedBodySize decompresses the gzip encoded request bodies of the endpoints accepting them, limiting
+// them to limit bytes once decompressed so that a small body cannot expand into an enormous one. Larger requests are
+// answered with 413 Request Entity Too Large. The handlers are passed the decompressed body without its
+// Content-Encoding. A limit of 0 or less means the bodies are left for the handlers to decompress.
+func maxDecompressedBodySize(limit int64, accepts func(p string) bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Content-Encoding") != "gzip" || req.Body == nil || req.Body == http.NoBody || !accepts(req.URL.Path) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				log.Debug("Rejecting %s %s from %s with a malformed gzip body: %v", req.Method, req.URL.Path, clientAddr(req), err)
+				renderStatus(w, req, http.StatusBadRequest)
+				return
+			}
+			body := &limitedRequestBody{
+				ReadCloser: http.MaxBytesReader(w, &gzipRequestBody{Reader: zr, body: req.Body}, limit),
+				limit:      limit,
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+			req.ContentLength = -1
+			req.Header.Del("Content-Encoding")
+			req.Header.Del("Content-Length")
+			lw := &bodyLimitResponseWriter{
+				ResponseWriter: w,
+				req:            req,
+				exceeded:       func() bool { return body.exceeded },
+				status:         http.StatusRequestEntityTooLarge,
+			}
+
+			next.ServeHTTP(lw, req)
+
+			if body.exceeded && !lw.wroteHeader {
+				lw.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+// maxRequestHeaderCount rejects requests with more than limit header fields, counting each value of repeated
+// headers, with 431 Request Header Fields Too Large. The server only limits the size of the headers, which still
+// allows for many thousands of tiny ones. Health checks are not limited. A limit of 0 or less disables the check.
+func maxRequestHeaderCount(limit int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			count := 0
+			for _, values := range req.Header {
+				count += len(values)
+			}
+			if count > limit && !isHealthCheck(req) {
+				log.Debug("Rejecting %s %s from %s with %d header fields", req.Method, req.URL.Path, clientAddr(req), count)
+				renderStatus(w, req, http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// maxURLLength rejects requests whose path is longer than limit with 414 URI Too Long, before the loggers and
+// handlers have to deal with it. Unlike the other limits it applies to the health checks too, their paths are
+// short anyway. A limit of 0 or less disables the check.
+func maxURLLength(limit int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if len(req.URL.Path) > limit {
+				log.Debug("Rejecting %s request from %s with a path of %d bytes", req.Method, clientAddr(req), len(req.URL.Path))
+				renderStatus(w, req, http.StatusRequestURITooLong)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// errTooManyParts is returned when reading a multipart body with more parts than allowed
+var errTooManyParts = errors.New("multipart body has too many parts")
+
+// partCountingBody counts the parts of a multipart body as it is read by looking for the boundary
+// delimiters, failing once there are more than limit parts
+type partCountingBody struct {
+	io.ReadCloser
+	delimiter  []byte
+	tail       []byte
+	delimiters int
+	limit      int
+	exceeded   bool
+}
+
+func (b *partCountingBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errTooManyParts
+	}
+	n, err := b.ReadCloser.Read(p)
+
+	// a delimiter may be split over two reads so the end of the previous read is searched again
+	buf := append(b.tail, p[:n]...)
+	b.delimiters += bytes.Count(buf, b.delimiter)
+	keep := len(b.delimiter) - 1
+	if keep > len(buf) {
+		keep = len(buf)
+	}
+	b.tail = append(b.tail[:0], buf[len(buf)-keep:]...)
+
+	// every part is preceded by a delimiter and the last one is followed by the closing delimiter
+	if b.delimiters > b.limit+1 {
+		b.exceeded = true
+		return 0, errTooManyParts
+	}
+	return n, err
+}
+
+// maxUploadParts rejects multipart/form-data requests with more than limit parts with a 400.
+// A limit of 0 or less means the number of parts is not limited.
+func maxUploadParts(limit int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Body == nil || req.Body == http.NoBody {
+				next.ServeHTTP(w, req)
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			body := &partCountingBody{
+				ReadCloser: req.Body,
+				delimiter:  []byte("\r\n--" + params["boundary"]),
+				// the first delimiter may start the body without a preceding line break
+				tail:  []byte("\r\n"),
+				limit: limit,
+			}
+			req.Body = body
+			lw := &bodyLimitResponseWriter{
+				ResponseWriter: w,
+				req:            req,
+				exceeded:       func() bool { return body.exceeded },
+				status:         http.StatusBadRequest,
+			}
+
+			next.ServeHTTP(lw, req)
+
+			if body.exceeded && !lw.wroteHeader {
+				lw.WriteHeader(http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// paginationCap is the maximum page size of the API endpoints matching patterns
+type paginationCap struct {
+	patterns []glob.Glob
+	limit    int
+}
+
+// compilePaginationCaps compiles the configured pagination caps of the API
+func compilePaginationCaps(caps []setting.PaginationCap) []paginationCap {
+	compiled := make([]paginationCap, 0, len(caps))
+	for _, c := range caps {
+		compiled = append(compiled, paginationCap{
+			patterns: compilePathGlobs([]string{c.Path}),
+			limit:    c.MaxResponseItems,
+		})
+	}
+	return compiled
+}
+
+// paginationLimits clamps the limit and page query parameters of API requests to maxLimit, or the limit of
+// the first matching cap, and maxPage. Requests without a limit are clamped as if they asked for
+// defaultLimit. Clamped values are sent back in the X-Pagination-Limit and X-Pagination-Page headers
+// so that clients know that they did not get what they asked for. Limits of 0 or less are not applied.
+func paginationLimits(defaultLimit, maxLimit, maxPage int, caps []paginationCap) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !isAPIRequest(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			max := maxLimit
+			for _, c := range caps {
+				if matchesPathGlobs(req.URL.Path, c.patterns) {
+					max = c.limit
+					break
+				}
+			}
+
+			query := req.URL.Query()
+			clamped := false
+			if max > 0 {
+				limit, _ := strconv.Atoi(query.Get("limit"))
+				if limit <= 0 {
+					limit = defaultLimit
+				}
+				if limit > max {
+					query.Set("limit", strconv.Itoa(max))
+					w.Header().Set("X-Pagination-Limit", strconv.Itoa(max))
+					clamped = true
+				}
+			}
+			if maxPage > 0 {
+				if page, _ := strconv.Atoi(query.Get("page")); page > maxPage {
+					query.Set("page", strconv.Itoa(maxPage))
+					w.Header().Set("X-Pagination-Page", strconv.Itoa(maxPage))
+					clamped = true
+				}
+			}
+			if clamped {
+				req.URL.RawQuery = query.Encode()
+				req.RequestURI = req.URL.RequestURI()
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// essentialResponseHeaders are never dropped when trimming oversized response headers
+// as the response cannot be interpreted without them
+var essentialResponseHeaders = map[string]bool{
+	"Content-Type":     true,
+	"Content-Length":   true,
+	"Content-Encoding": true,
+	"Content-Range":    true,
+	"Location":         true,
+	"Set-Cookie":       true,
+}
+
+// headerSize returns the size of a header on the wire
+func headerSize(key string, values []string) int {
+	size := 0
+	for _, v := range values {
+		size += len(key) + len(": ") + len(v) + len("\r\n")
+	}
+	return size
+}
+
+// trimResponseHeaders drops the largest non-essential headers from h until their total size
+// is no more than limit, returning the names of the headers that were dropped
+func trimResponseHeaders(h http.Header, limit int) []string {
+	total := 0
+	keys := make([]string, 0, len(h))
+	for key, values := range h {
+		total += headerSize(key, values)
+		if !essentialResponseHeaders[key] {
+			keys = append(keys, key)
+		}
+	}
+	if total <= limit {
+		return nil
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		si, sj := headerSize(keys[i], h[keys[i]]), headerSize(keys[j], h[keys[j]])
+		if si != sj {
+			return si > sj
+		}
+		return keys[i] < keys[j]
+	})
+
+	var dropped []string
+	for _, key := range keys {
+		if total <= limit {
+			break
+		}
+		total -= headerSize(key, h[key])
+		h.Del(key)
+		dropped = append(dropped, key)
+	}
+	return dropped
+}
+
+// maxResponseHeaderSize drops the largest response headers, logging a warning, whenever the
+// response headers add up to more than limit bytes. A limit of 0 or less disables the check.
+func maxResponseHeaderSize(limit int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(onWriteHeader(w, func(status int) {
+				if dropped := trimResponseHeaders(w.Header(), limit); len(dropped) > 0 {
+					log.Warn("Response headers for %s %s exceed %d bytes, dropped: %s", req.Method, req.URL.Path, limit, strings.Join(dropped, ", "))
+				}
+			}), req)
+		})
+	}
+}
+
+// compilePathGlobs compiles glob patterns matching request paths, invalid patterns are logged and skipped
+func compilePathGlobs(patterns []string) []glob.Glob {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		g, err := glob.Compile(pattern, '/')
+		if err != nil {
+			log.Error("Invalid path pattern %q: %v", pattern, err)
+			continue
+		}
+		globs = append(globs, g)
+	}
+	return globs
+}
+
+// matchesPathGlobs returns whether p matches any of the patterns
+func matchesPathGlobs(p string, patterns []glob.Glob) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// expensiveRequestLimiter handles at most limit requests with a path matching any of patterns at once,
+// answering further requests to them with 429. A limit of 0 or less disables the check.
+func expensiveRequestLimiter(limit int, patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 || len(patterns) == 0 {
+			return next
+		}
+		inFlight := make(chan struct{}, limit)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !matchesPathGlobs(req.URL.Path, patterns) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			select {
+			case inFlight <- struct{}{}:
+				defer func() {
+					<-inFlight
+				}()
+				next.ServeHTTP(w, req)
+			default:
+				log.Debug("Too many expensive requests in flight, rejecting %s %s", req.Method, req.URL.Path)
+				w.Header().Set("Retry-After", "1")
+				renderStatus(w, req, http.StatusTooManyRequests)
+			}
+		})
+	}
+}
+
+// renderTimeoutWriter passes the response of a handler with a render timeout on as it is written, until the
+// timeout has passed after which anything the handler still writes is discarded
+type renderTimeoutWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	lock        sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *renderTimeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *renderTimeoutWriter) writeHeaderLocked(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	// the handler keeps its own header map so that it cannot race with the 503 sent once the timeout has passed
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *renderTimeoutWriter) WriteHeader(status int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(status)
+}
+
+func (tw *renderTimeoutWriter) Write(p []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+// Flush sends the response written so far, so that streamed responses reach the client before the timeout
+func (tw *renderTimeoutWriter) Flush() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// timeOut stops anything further the handler writes from being sent, returning whether the response was started
+func (tw *renderTimeoutWriter) timeOut() (started bool) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.timedOut = true
+	return tw.wroteHeader
+}
+
+// bufferedResponse is a response written to memory, so that it can be sent with its Content-Length
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// sendComplete sends the response with its Content-Length and flushes it, so that the client has all of it even
+// though the handler has not returned yet
+func (b *bufferedResponse) sendComplete(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.body.Len()))
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// handlerPanic is a panic of a handler run in a goroutine of its own, with the stack of that goroutine, which is
+// raised again by the goroutine serving the request so that Recovery() handles it
+type handlerPanic struct {
+	value interface{}
+	stack string
+}
+
+func (p *handlerPanic) String() string {
+	return fmt.Sprintf("%v", p.value)
+}
+
+// renderTimeout answers requests with a path matching any of patterns with 503 if they take longer than timeout in
+// wall clock time, as the CPU time used by a single request cannot be measured. The context of the handler is
+// cancelled then, so that a render checking it stops early, and the request is only finished once the handler has
+// returned, so that it does not keep running unaccounted for. The 503 is sent in full straight away, but if the
+// response has already been started by then the connection is closed once the handler has returned instead, which
+// tells the client that the response is incomplete. A timeout of 0 or less disables the check. WebSocket upgrades
+// are let through as they stay open for as long as the client is connected.
+func renderTimeout(timeout time.Duration, patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 || len(patterns) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if IsWebSocketUpgrade(req) || !matchesPathGlobs(req.URL.Path, patterns) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			// the context is only cancelled once the writer has been stopped, so that nothing the handler writes
+			// once it notices can get through
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+
+			tw := &renderTimeoutWriter{w: w, header: make(http.Header)}
+			done := make(chan struct{})
+			var panicked interface{}
+			go func() {
+				defer close(done)
+				defer func() {
+					if err := recover(); err != nil {
+						if err == http.ErrAbortHandler {
+							panicked = err
+							return
+						}
+						panicked = &handlerPanic{value: err, stack: log.Stack(2)}
+					}
+				}()
+				next.ServeHTTP(tw, req.WithContext(ctx))
+			}()
+
+			select {
+			case <-done:
+				if panicked != nil {
+					// let Recovery() handle it as if the handler had not been run in its own goroutine
+					panic(panicked)
+				}
+				return
+			case <-req.Context().Done():
+				// the client has gone away, which has cancelled the context of the handler too
+				tw.timeOut()
+				<-done
+				return
+			case <-timer.C:
+			}
+
+			started := tw.timeOut()
+			cancel()
+			select {
+			case <-done:
+				// the handler finished whilst the timeout passed
+				if panicked != nil {
+					panic(panicked)
+				}
+				return
+			default:
+			}
+			if started {
+				log.Warn("Closing the connection of %s %s as it exceeded the render timeout of %v after its response was started", req.Method, req.URL.Path, timeout)
+			} else {
+				log.Warn("Aborted %s %s as it exceeded the render timeout of %v", req.Method, req.URL.Path, timeout)
+				unavailable := &bufferedResponse{header: make(http.Header)}
+				renderStatus(unavailable, req, http.StatusServiceUnavailable)
+				unavailable.sendComplete(w)
+			}
+
+			// the handler stops once it notices that its context has been cancelled
+			<-done
+			if p, ok := panicked.(*handlerPanic); ok {
+				log.Error("%s panicked after exceeding the render timeout: PANIC: %v\n%s", panicContext(req), p.value, p.stack)
+			}
+			if started {
+				panic(http.ErrAbortHandler)
+			}
+		})
+	}
+}
+
+// liftConnDeadlines clears the read and/or the write deadline of the connection conn the request req was received on
+func liftConnDeadlines(conn net.Conn, req *http.Request, read, write bool) {
+	if conn == nil {
+		log.Trace("Unable to lift the deadlines of %s: the connection is not known", req.URL.Path)
+		return
+	}
+	if read {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			log.Trace("Unable to lift the read deadline of %s: %v", req.URL.Path, err)
+		}
+	}
+	if write {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			log.Trace("Unable to lift the write deadline of %s: %v", req.URL.Path, err)
+		}
+	}
+}
+
+// liftTransferDeadlines lifts the read and write deadlines the server set from READ_TIMEOUT and WRITE_TIMEOUT
+// for requests with a path matching any of patterns, such as git clones and pushes, which may legitimately take
+// longer. The headers have been read by then, so READ_HEADER_TIMEOUT still applies to them. It does nothing if
+// neither timeout is set. The connection is found through graceful.ConnContext.
+func liftTransferDeadlines(readTimeout, writeTimeout time.Duration, patterns []glob.Glob) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if (readTimeout <= 0 && writeTimeout <= 0) || len(patterns) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if matchesPathGlobs(req.URL.Path, patterns) {
+				liftConnDeadlines(graceful.RequestConn(req.Context()), req, readTimeout > 0, writeTimeout > 0)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
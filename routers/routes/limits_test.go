@@ -0,0 +1,468 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxRequestBodySize(t *testing.T) {
+	overrides := []bodySizeOverride{
+		{
+			match: func(p string) bool { return strings.HasSuffix(p, "/attachments") },
+			limit: 32,
+		},
+	}
+	handler := maxRequestBodySize(8, overrides)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path, body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/api/v1/markdown", "small", false).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("/api/v1/markdown", "far too large", false).Code)
+
+	resp := serve("/api/v1/markdown", "far too large", true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"message":"`+http.StatusText(http.StatusRequestEntityTooLarge)+`"`)
+
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1/issues/attachments", "far too large", false).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("/user2/repo1/issues/attachments", strings.Repeat("x", 33), true).Code)
+}
+
+func TestMaxDecompressedBodySize(t *testing.T) {
+	var received []byte
+	handler := maxDecompressedBodySize(64<<10, acceptsCompressedBody)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Empty(t, req.Header.Get("Content-Encoding"))
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		received = body
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	compress := func(content []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(content)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	serve := func(path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	request := []byte("0032want 0123456789abcdef0123456789abcdef01234567\n00000009done\n")
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1.git/git-upload-pack", compress(request)).Code)
+	assert.Equal(t, request, received)
+
+	// a few kilobytes expanding into a megabyte are cut off at the limit
+	bomb := compress(make([]byte, 1<<20))
+	assert.Less(t, len(bomb), 4<<10)
+	received = nil
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("/user2/repo1.git/git-upload-pack", bomb).Code)
+	assert.Nil(t, received)
+
+	assert.Equal(t, http.StatusBadRequest, serve("/user2/repo1.git/git-upload-pack", []byte("not gzip")).Code)
+
+	// the bodies of endpoints which do not decompress them are passed on as they are
+	handler = maxDecompressedBodySize(64<<10, acceptsCompressedBody)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+		received, _ = ioutil.ReadAll(req.Body)
+	}))
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1/issues/attachments", bomb).Code)
+	assert.Equal(t, bomb, received)
+}
+
+func TestMaxUploadParts(t *testing.T) {
+	var files int
+	handler := maxUploadParts(3)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		files = len(req.MultipartForm.File["file"])
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	upload := func(parts int) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for i := 0; i < parts; i++ {
+			part, err := writer.CreateFormFile("file", fmt.Sprintf("part%d.txt", i))
+			assert.NoError(t, err)
+			_, _ = part.Write([]byte(strings.Repeat("x", 10)))
+		}
+		assert.NoError(t, writer.Close())
+
+		req := httptest.NewRequest("POST", "/user2/repo1/upload-file", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	files = 0
+	assert.Equal(t, http.StatusOK, upload(3).Code)
+	assert.Equal(t, 3, files)
+
+	files = 0
+	resp := upload(4)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, http.StatusText(http.StatusBadRequest)+"\n", resp.Body.String())
+	assert.Equal(t, 0, files)
+
+	// other bodies are not affected
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/api/v1/markdown", strings.NewReader(strings.Repeat("--", 100))))
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
+
+func TestPaginationLimits(t *testing.T) {
+	caps := compilePaginationCaps([]setting.PaginationCap{
+		{Path: "/api/v1/repos/*/*/commits", MaxResponseItems: 10},
+	})
+	var query url.Values
+	handler := paginationLimits(30, 50, 100, caps)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query()
+	}))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+		return resp
+	}
+
+	resp := serve("/api/v1/repos/search?q=gitea&limit=1000")
+	assert.Equal(t, "50", query.Get("limit"))
+	assert.Equal(t, "gitea", query.Get("q"))
+	assert.Equal(t, "50", resp.Header().Get("X-Pagination-Limit"))
+
+	resp = serve("/api/v1/repos/search?limit=20")
+	assert.Equal(t, "20", query.Get("limit"))
+	assert.Empty(t, resp.Header().Get("X-Pagination-Limit"))
+
+	resp = serve("/api/v1/repos/user2/repo1/commits?limit=40&page=500")
+	assert.Equal(t, "10", query.Get("limit"))
+	assert.Equal(t, "100", query.Get("page"))
+	assert.Equal(t, "10", resp.Header().Get("X-Pagination-Limit"))
+	assert.Equal(t, "100", resp.Header().Get("X-Pagination-Page"))
+
+	// the default page size is capped too
+	resp = serve("/api/v1/repos/user2/repo1/commits")
+	assert.Equal(t, "10", query.Get("limit"))
+	assert.Equal(t, "10", resp.Header().Get("X-Pagination-Limit"))
+
+	resp = serve("/explore/repos?limit=1000")
+	assert.Equal(t, "1000", query.Get("limit"))
+	assert.Empty(t, resp.Header().Get("X-Pagination-Limit"))
+}
+
+func TestMaxResponseHeaderSize(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+
+	links := strings.Repeat(`<https://try.gitea.io/api/v1/repos/search?page=2>; rel="next", `, 20)
+	handler := maxResponseHeaderSize(512)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", "1000")
+		if req.URL.Query().Get("links") != "" {
+			w.Header().Set("Link", links)
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/repos/search", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "1000", resp.Header().Get("X-Total-Count"))
+	assert.NotContains(t, read(), "exceed")
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/repos/search?links=1", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Link"))
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "1000", resp.Header().Get("X-Total-Count"))
+	assert.Equal(t, "[]", resp.Body.String())
+	assert.Contains(t, read(), "Response headers for GET /api/v1/repos/search exceed 512 bytes, dropped: Link")
+}
+
+func TestExpensiveRequestLimiter(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := expensiveRequestLimiter(1, compilePathGlobs([]string{"/*/*/search", "/*/*/compare/**"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("block") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- serve("/user2/repo1/search?q=x&block=1").Code
+	}()
+	<-started
+
+	resp := serve("/user2/repo1/compare/master...develop")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("/user2/repo1/search?q=y").Code)
+
+	// normal endpoints are unaffected
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1").Code)
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1/src/branch/master/search").Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, serve("/user2/repo1/search?q=y").Code)
+}
+
+func TestMaxRequestHeaderCount(t *testing.T) {
+	handler := maxRequestHeaderCount(100)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	serve := func(method, target string, headers int) int {
+		req := httptest.NewRequest(method, target, nil)
+		for i := 0; i < headers; i++ {
+			req.Header.Add(fmt.Sprintf("X-Bogus-%d", i%150), "1")
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/explore/repos", 100))
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, serve("GET", "/explore/repos", 101))
+	// repeated headers count once per value
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, serve("GET", "/explore/repos", 200))
+	// health checks are not limited
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/healthz", 200))
+	assert.Equal(t, http.StatusOK, serve("HEAD", "/", 200))
+
+	// the API gets its JSON errors
+	req := httptest.NewRequest("GET", "/api/v1/version", nil)
+	for i := 0; i < 101; i++ {
+		req.Header.Add("X-Bogus", "1")
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"Request Header Fields Too Large","url":"`+setting.API.SwaggerURL+`"}`, resp.Body.String())
+}
+
+func TestMaxURLLength(t *testing.T) {
+	handler := maxURLLength(64)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	serve := func(method, target string) int {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(method, target, nil))
+		return resp.Code
+	}
+
+	branch := strings.Repeat("a", 64)
+	assert.Equal(t, http.StatusOK, serve("GET", "/user2/repo1/src/branch/master"))
+	assert.Equal(t, http.StatusRequestURITooLong, serve("GET", "/user2/repo1/src/branch/"+branch))
+	// the query is not part of the path
+	assert.Equal(t, http.StatusOK, serve("GET", "/user2/repo1?branch="+branch))
+	// neither health checks nor the storages are exempt
+	assert.Equal(t, http.StatusRequestURITooLong, serve("HEAD", "/"+branch+branch))
+	assert.Equal(t, http.StatusRequestURITooLong, serve("GET", "/avatars/"+branch))
+
+	// the API gets its JSON errors
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/repos/user2/"+branch, nil))
+	assert.Equal(t, http.StatusRequestURITooLong, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"`+http.StatusText(http.StatusRequestURITooLong)+`","url":"`+setting.API.SwaggerURL+`"}`, resp.Body.String())
+}
+
+func TestRenderTimeout(t *testing.T) {
+	aborted := make(chan bool, 1)
+	handler := renderTimeout(50*time.Millisecond, compilePathGlobs([]string{"/api/v1/markdown"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("heavy") != "" {
+			// spin like a pathological render until the timeout has passed
+			for i := 0; ; i++ {
+				if i%1000 == 0 && req.Context().Err() != nil {
+					aborted <- true
+					return
+				}
+			}
+		}
+		_, _ = w.Write([]byte("<p>rendered</p>"))
+	}))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("POST", target, nil))
+		return resp
+	}
+
+	start := time.Now()
+	resp := serve("/api/v1/markdown?heavy=1")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	// the request is only finished once the render has stopped
+	select {
+	case <-aborted:
+	default:
+		assert.Fail(t, "render was still running")
+	}
+
+	resp = serve("/api/v1/markdown")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "<p>rendered</p>", resp.Body.String())
+}
+
+func TestWebSocketUpgradeBypass(t *testing.T) {
+	var body []byte
+	var wrapped bool
+	handler := maxRequestBodySize(4, nil)(renderTimeout(10*time.Millisecond, compilePathGlobs([]string{"/user/events"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, wrapped = w.(*renderTimeoutWriter)
+		// outlast the timeout as a WebSocket connection would
+		time.Sleep(50 * time.Millisecond)
+		if _, hasDeadline := req.Context().Deadline(); hasDeadline || req.Context().Err() != nil {
+			wrapped = true
+		}
+		body, _ = ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	})))
+
+	req := httptest.NewRequest("GET", "/user/events", strings.NewReader("0123456789"))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.Code)
+	assert.False(t, wrapped)
+	assert.Equal(t, "0123456789", string(body))
+
+	// other requests are still limited
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/user/events", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestRenderTimeoutStartedResponse(t *testing.T) {
+	lateWrite := make(chan error, 1)
+	handler := Recovery()(renderTimeout(50*time.Millisecond, compilePathGlobs([]string{"/api/v1/markdown", "/panic"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/panic" {
+			panicInRender()
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<p>partial"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+		_, err := w.Write([]byte("</p>"))
+		lateWrite <- err
+	})))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/v1/markdown", "text/plain", nil)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		// the response was started so the connection is closed rather than a 503 being sent
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Error(t, err)
+		assert.Equal(t, "<p>partial", string(body))
+	}
+	select {
+	case err := <-lateWrite:
+		assert.Equal(t, http.ErrHandlerTimeout, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "handler did not finish")
+	}
+
+	// panics in the handler are still recovered, and logged with the stack of the handler
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+	resp, err = http.Get(server.URL + "/panic")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+	logged := read()
+	assert.Contains(t, logged, "PANIC: oops")
+	assert.Contains(t, logged, "panicInRender")
+}
+
+func panicInRender() {
+	panic("oops")
+}
+
+func TestLiftTransferDeadlines(t *testing.T) {
+	handler := liftTransferDeadlines(0, 100*time.Millisecond, compilePathGlobs([]string{"/*/*/info/refs"}))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("refs"))
+	}))
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Config.ConnContext = graceful.ConnContext
+	server.Start()
+	defer server.Close()
+
+	get := func(p string) (string, error) {
+		resp, err := http.Get(server.URL + p)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// a long transfer outlives the write timeout
+	body, err := get("/user2/repo1.git/info/refs")
+	assert.NoError(t, err)
+	assert.Equal(t, "refs", body)
+
+	// any other request is cut off
+	_, err = get("/user2/repo1")
+	assert.Error(t, err)
+}
@@ -6,6 +6,8 @@ package routes
 
 import (
 	"encoding/gob"
+	"fmt"
+	"net/http"
 	"path"
 
 	"code.gitea.io/gitea/models"
@@ -13,7 +15,6 @@ import (
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/lfs"
 	"code.gitea.io/gitea/modules/log"
-	"code.gitea.io/gitea/modules/metrics"
 	"code.gitea.io/gitea/modules/options"
 	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/templates"
@@ -38,12 +39,10 @@ import (
 	"gitea.com/macaron/captcha"
 	"gitea.com/macaron/cors"
 	"gitea.com/macaron/csrf"
-	"gitea.com/macaron/gzip"
 	"gitea.com/macaron/i18n"
 	"gitea.com/macaron/macaron"
 	"gitea.com/macaron/session"
 	"gitea.com/macaron/toolbox"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tstranex/u2f"
 )
 
@@ -58,9 +57,6 @@ func NewMacaron() *macaron.Macaron {
 		m = macaron.New()
 	}
 
-	if setting.EnableGzip {
-		m.Use(gzip.Middleware())
-	}
 	if setting.Protocol == setting.FCGI || setting.Protocol == setting.FCGIUnix {
 		m.SetURLPrefix(setting.AppSubURL)
 	}
@@ -253,7 +249,6 @@ func RegisterMacaronRoutes(m *macaron.Macaron) {
 		// TODO manage redirection
 		m.Post("/authorize", bindIgnErr(auth.AuthorizationForm{}), user.AuthorizeOAuth)
 	}, ignSignInAndCsrf, reqSignIn)
-	m.Post("/login/oauth/access_token", bindIgnErr(auth.AccessTokenForm{}), ignSignInAndCsrf, user.AccessTokenOAuth)
 
 	m.Group("/user/settings", func() {
 		m.Get("", userSetting.Profile)
@@ -953,6 +948,41 @@ func RegisterMacaronRoutes(m *macaron.Macaron) {
 		m.Post("/purge", user.NotificationPurgePost)
 	}, reqSignIn)
 
+	registerMacaronAPIRoutes(m)
+
+	m.Get("/apple-touch-icon.png", func(ctx *context.Context) {
+		ctx.Redirect(path.Join(setting.StaticURLPrefix, "img/apple-touch-icon.png"), 301)
+	})
+
+	// Progressive Web App
+	m.Get("/manifest.json", templates.JSONRenderer(), func(ctx *context.Context) {
+		ctx.HTML(200, "pwa/manifest_json")
+	})
+
+	// Not found handler.
+	m.NotFound(routers.NotFound)
+}
+
+// RegisterMacaronAPIRoutes registers only the API routes and the OAuth2 access token endpoint to Macaron, for instances without the web UI
+func RegisterMacaronAPIRoutes(m *macaron.Macaron) {
+	validation.AddBindingRules()
+	registerMacaronAPIRoutes(m)
+
+	m.NotFound(func(ctx *context.Context) {
+		ctx.JSON(http.StatusNotFound, map[string]string{
+			"message": http.StatusText(http.StatusNotFound),
+			"url":     setting.API.SwaggerURL,
+		})
+	})
+}
+
+// registerMacaronAPIRoutes registers the routes shared by the web UI and the API only instances
+func registerMacaronAPIRoutes(m *macaron.Macaron) {
+	ignSignIn := context.Toggle(&context.ToggleOptions{SignInRequired: setting.Service.RequireSignInView})
+	ignSignInAndCsrf := context.Toggle(&context.ToggleOptions{DisableCSRF: true})
+
+	m.Post("/login/oauth/access_token", binding.BindIgnErr(auth.AccessTokenForm{}), ignSignInAndCsrf, user.AccessTokenOAuth)
+
 	if setting.API.EnableSwagger {
 		m.Get("/swagger.v1.json", templates.JSONRenderer(), routers.SwaggerV1Json)
 	}
@@ -976,25 +1006,37 @@ func RegisterMacaronRoutes(m *macaron.Macaron) {
 	m.Group("/api/internal", func() {
 		// package name internal is ideal but Golang is not allowed, so we use private as package name.
 		private.RegisterRoutes(m)
+		// the access logger belongs to the routes, which the private routes cannot import
+		m.Post("/manager/reload-access-log-template", private.CheckInternalToken, reloadAccessLogTemplate)
+		m.Post("/manager/maintenance/:mode", private.CheckInternalToken, setMaintenanceMode)
 	})
+}
 
-	m.Get("/apple-touch-icon.png", func(ctx *context.Context) {
-		ctx.Redirect(path.Join(setting.StaticURLPrefix, "img/apple-touch-icon.png"), 301)
-	})
-
-	// Progressive Web App
-	m.Get("/manifest.json", templates.JSONRenderer(), func(ctx *context.Context) {
-		ctx.HTML(200, "pwa/manifest_json")
-	})
-
-	// prometheus metrics endpoint
-	if setting.Metrics.Enabled {
-		c := metrics.NewCollector()
-		prometheus.MustRegister(c)
-
-		m.Get("/metrics", routers.Metrics)
+// reloadAccessLogTemplate reloads the ACCESS_LOG_TEMPLATE for `gitea manager logging reload-access-log-template`
+func reloadAccessLogTemplate(ctx *macaron.Context) {
+	if err := ReloadAccessLogTemplate(); err != nil {
+		ctx.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"err": fmt.Sprintf("Error during reload of the access log template: %v", err),
+		})
+		return
 	}
+	ctx.PlainText(http.StatusOK, []byte("success"))
+}
 
-	// Not found handler.
-	m.NotFound(routers.NotFound)
+// setMaintenanceMode switches the maintenance mode on or off for `gitea manager maintenance`
+func setMaintenanceMode(ctx *macaron.Context) {
+	switch ctx.Params("mode") {
+	case "on":
+		SetMaintenanceMode(true)
+		log.Info("Maintenance mode switched on")
+	case "off":
+		SetMaintenanceMode(false)
+		log.Info("Maintenance mode switched off")
+	default:
+		ctx.JSON(http.StatusBadRequest, map[string]interface{}{
+			"err": fmt.Sprintf("Unknown maintenance mode %q, must be on or off", ctx.Params("mode")),
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, []byte("success"))
 }
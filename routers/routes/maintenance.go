@@ -0,0 +1,81 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceSwitch is whether a router is in maintenance mode, which can be switched at runtime
+type MaintenanceSwitch struct {
+	mode int32
+}
+
+// NewMaintenanceSwitch returns a MaintenanceSwitch which is switched on if enabled
+func NewMaintenanceSwitch(enabled bool) *MaintenanceSwitch {
+	s := &MaintenanceSwitch{}
+	s.Set(enabled)
+	return s
+}
+
+// Set switches the maintenance mode on or off
+func (s *MaintenanceSwitch) Set(enabled bool) {
+	var mode int32
+	if enabled {
+		mode = 1
+	}
+	atomic.StoreInt32(&s.mode, mode)
+}
+
+// Enabled returns whether the maintenance mode is on
+func (s *MaintenanceSwitch) Enabled() bool {
+	return atomic.LoadInt32(&s.mode) == 1
+}
+
+// maintenance is the switch of the router built by NewChi, which `gitea manager maintenance` switches
+var maintenance = &MaintenanceSwitch{}
+
+// SetMaintenanceMode switches the maintenance mode of the instance on or off until the next restart
+func SetMaintenanceMode(enabled bool) {
+	maintenance.Set(enabled)
+}
+
+// IsMaintenanceMode returns whether the instance is in maintenance mode
+func IsMaintenanceMode() bool {
+	return maintenance.Enabled()
+}
+
+// maintenanceGuard answers requests with 503 Service Unavailable whilst mode is switched on, using the page if it
+// exists and custom/public/503.html like renderStatus otherwise. Health checks, /metrics, the internal API (needed
+// by `gitea manager maintenance off`) and requests from the bypass networks are let through. The networks are those
+// of the connections, so a reverse proxy in front of Gitea must not be among them.
+func maintenanceGuard(mode *MaintenanceSwitch, bypass []*net.IPNet, retryAfter time.Duration, page string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !mode.Enabled() || isHealthCheck(req) || req.URL.Path == "/metrics" || hasPathPrefix(req.URL.Path, "/api/internal") {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if ip := remoteIP(req); ip != nil {
+				for _, ipNet := range bypass {
+					if ipNet.Contains(ip) {
+						next.ServeHTTP(w, req)
+						return
+					}
+				}
+			}
+
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter.Seconds()), 10))
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			writeErrorPage(w, req, http.StatusServiceUnavailable, "Gitea is under maintenance, please try again later", page, statusPage(http.StatusServiceUnavailable))
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitea.com/macaron/macaron"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceGuard(t *testing.T) {
+	defer SetMaintenanceMode(false)
+
+	dir, err := ioutil.TempDir("", "maintenance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "maintenance.html")
+	assert.NoError(t, ioutil.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644))
+
+	c := chi.NewRouter()
+	c.Use(maintenanceGuard(maintenance, parseTrustedProxies([]string{"192.0.2.0/24"}), 5*time.Minute, page))
+	for _, p := range []string{"/", "/explore/repos", "/api/v1/version", "/api/healthz", "/metrics", "/api/internal/manager/maintenance/off"} {
+		c.HandleFunc(p, func(w http.ResponseWriter, req *http.Request) {})
+	}
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	m.Post("/manager/maintenance/:mode", setMaintenanceMode)
+
+	serve := func(method, p, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, nil)
+		if remote != "" {
+			req.RemoteAddr = remote
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+	toggle := func(mode string) int {
+		resp := httptest.NewRecorder()
+		m.ServeHTTP(resp, httptest.NewRequest("POST", "/manager/maintenance/"+mode, nil))
+		return resp.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/explore/repos", "").Code)
+
+	assert.Equal(t, http.StatusOK, toggle("on"))
+	assert.True(t, IsMaintenanceMode())
+	resp := serve("GET", "/explore/repos", "203.0.113.7:41234")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "300", resp.Header().Get("Retry-After"))
+	assert.Equal(t, "<h1>Back soon</h1>", resp.Body.String())
+	resp = serve("GET", "/api/v1/version", "203.0.113.7:41234")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), `"message":"Gitea is under maintenance, please try again later"`)
+
+	// health checks, the metrics, the internal API and the admins are let through
+	assert.Equal(t, http.StatusOK, serve("HEAD", "/", "203.0.113.7:41234").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/healthz", "203.0.113.7:41234").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/metrics", "203.0.113.7:41234").Code)
+	assert.Equal(t, http.StatusOK, serve("POST", "/api/internal/manager/maintenance/off", "127.0.0.1:41234").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/explore/repos", "192.0.2.10:41234").Code)
+
+	assert.Equal(t, http.StatusBadRequest, toggle("maybe"))
+	assert.True(t, IsMaintenanceMode())
+	assert.Equal(t, http.StatusOK, toggle("off"))
+	assert.False(t, IsMaintenanceMode())
+	assert.Equal(t, http.StatusOK, serve("GET", "/explore/repos", "203.0.113.7:41234").Code)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/go-chi/chi"
+)
+
+// The priority bands of the middlewares registered with RegisterPreRoutingMiddleware. Middlewares with a lower
+// priority wrap those with a higher one, so that e.g. a logging middleware sees what a security middleware does.
+const (
+	// MiddlewarePriorityLogging is for middlewares recording requests and responses, such as metrics
+	MiddlewarePriorityLogging = 100
+	// MiddlewarePriorityRecovery is for middlewares handling the panics and errors of the ones below them
+	MiddlewarePriorityRecovery = 200
+	// MiddlewarePrioritySecurity is for middlewares authenticating or rejecting requests, such as auth adapters
+	MiddlewarePrioritySecurity = 300
+	// MiddlewarePriorityApp is for any other middleware
+	MiddlewarePriorityApp = 400
+)
+
+// preRoutingMiddleware is a middleware registered with RegisterPreRoutingMiddleware
+type preRoutingMiddleware struct {
+	priority   int
+	middleware func(next http.Handler) http.Handler
+}
+
+var (
+	preRoutingMiddlewaresLock sync.Mutex
+	preRoutingMiddlewares     []preRoutingMiddleware
+)
+
+// RegisterPreRoutingMiddleware registers a middleware which NewChi adds after its own, in order of priority, so that
+// extensions can handle all requests before they are routed without changing NewChi. Middlewares of the same priority
+// are added in the order they are registered. It has to be called before NewChi, e.g. from an init function.
+func RegisterPreRoutingMiddleware(priority int, middleware func(next http.Handler) http.Handler) {
+	preRoutingMiddlewaresLock.Lock()
+	defer preRoutingMiddlewaresLock.Unlock()
+	preRoutingMiddlewares = append(preRoutingMiddlewares, preRoutingMiddleware{priority: priority, middleware: middleware})
+}
+
+// usePreRoutingMiddlewares adds the middlewares registered with RegisterPreRoutingMiddleware to the router
+func usePreRoutingMiddlewares(c chi.Router) {
+	preRoutingMiddlewaresLock.Lock()
+	middlewares := make([]preRoutingMiddleware, len(preRoutingMiddlewares))
+	copy(middlewares, preRoutingMiddlewares)
+	preRoutingMiddlewaresLock.Unlock()
+
+	sort.SliceStable(middlewares, func(i, j int) bool {
+		return middlewares[i].priority < middlewares[j].priority
+	})
+	for _, mw := range middlewares {
+		c.Use(mw.middleware)
+	}
+}
+
+// StatusError is an error of a path guard which rejects the request with its own status instead of 403 Forbidden,
+// e.g. 401 Unauthorized or 404 Not Found to hide the path altogether
+type StatusError interface {
+	error
+	Status() int
+}
+
+// pathGuard is a guard registered with RegisterPathGuard
+type pathGuard struct {
+	prefix string
+	guard  func(req *http.Request) error
+}
+
+var (
+	pathGuardsLock sync.Mutex
+	pathGuards     []pathGuard
+)
+
+// RegisterPathGuard registers a guard which NewChi asks about every request for the path prefix or below it, before
+// any of the routes. Requests it returns an error for are rejected with 403 Forbidden, or with the status of the
+// error if it is a StatusError. It has to be called before NewChi, e.g. from an init function.
+func RegisterPathGuard(prefix string, guard func(req *http.Request) error) {
+	pathGuardsLock.Lock()
+	defer pathGuardsLock.Unlock()
+	pathGuards = append(pathGuards, pathGuard{prefix: prefix, guard: guard})
+}
+
+// guardPaths rejects the requests any of the guards of their path returns an error for. The paths are cleaned up
+// by canonicalPathHandler before, so that e.g. //admin cannot get around a guard of /admin.
+func guardPaths() func(next http.Handler) http.Handler {
+	pathGuardsLock.Lock()
+	guards := make([]pathGuard, len(pathGuards))
+	copy(guards, pathGuards)
+	pathGuardsLock.Unlock()
+
+	return func(next http.Handler) http.Handler {
+		if len(guards) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, guard := range guards {
+				if !hasPathPrefix(req.URL.Path, guard.prefix) {
+					continue
+				}
+				if err := guard.guard(req); err != nil {
+					status := http.StatusForbidden
+					var statusErr StatusError
+					if errors.As(err, &statusErr) {
+						status = statusErr.Status()
+					}
+					log.Debug("Rejecting %s %s with %d as the guard of %s denied it: %v", req.Method, req.URL.Path, status, guard.prefix, err)
+					renderStatus(w, req, status)
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
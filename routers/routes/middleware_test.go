@@ -0,0 +1,80 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterPreRoutingMiddleware(t *testing.T) {
+	defer func() { preRoutingMiddlewares = nil }()
+
+	addHeader := func(value string) func(next http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Add("X-Plugin", value)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	RegisterPreRoutingMiddleware(MiddlewarePriorityApp, addHeader("app"))
+	RegisterPreRoutingMiddleware(MiddlewarePriorityLogging, addHeader("logging"))
+	RegisterPreRoutingMiddleware(MiddlewarePrioritySecurity, addHeader("security"))
+	RegisterPreRoutingMiddleware(MiddlewarePriorityLogging, addHeader("logging 2"))
+
+	c := NewChi()
+	c.Get("/", func(w http.ResponseWriter, req *http.Request) {})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"logging", "logging 2", "security", "app"}, resp.Header().Values("X-Plugin"))
+}
+
+// notFoundError hides the path it is returned for
+type notFoundError struct{}
+
+func (notFoundError) Error() string { return "hidden" }
+func (notFoundError) Status() int   { return http.StatusNotFound }
+
+func TestRegisterPathGuard(t *testing.T) {
+	defer func() { pathGuards = nil }()
+
+	RegisterPathGuard("/admin", func(req *http.Request) error {
+		if req.Header.Get("Authorization") == "" {
+			return errors.New("not signed in")
+		}
+		return nil
+	})
+	RegisterPathGuard("/-/internal", func(req *http.Request) error {
+		return fmt.Errorf("internal: %w", notFoundError{})
+	})
+
+	c := NewChi()
+	for _, p := range []string{"/admin", "/admin/users", "/administrator", "/-/internal/status"} {
+		c.Get(p, func(w http.ResponseWriter, req *http.Request) {})
+	}
+	serve := func(p, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("/admin", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve("/admin/users", "").Code)
+	assert.Equal(t, http.StatusOK, serve("/admin/users", "token 0123456789").Code)
+	assert.Equal(t, http.StatusOK, serve("/administrator", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("/-/internal/status", "token 0123456789").Code)
+}
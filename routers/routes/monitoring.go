@@ -0,0 +1,66 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"sync"
+
+	"code.gitea.io/gitea/modules/metrics"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/routers"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the collectors of the metrics with prometheus, once however many routers serve them
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(metrics.NewCollector(), metrics.StorageBytesServed, metrics.NotFoundRequests, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "gitea_http_requests_in_flight",
+				Help: "Number of HTTP requests being handled",
+			},
+			func() float64 { return float64(InFlightRequests()) },
+		))
+	})
+}
+
+// RegisterMonitoringRoutes registers the startup probe, the health check and, if enabled, the metrics. They are
+// answered before and so without any of the authentication of the other routes.
+func RegisterMonitoringRoutes(c chi.Router) {
+	// for startup probe
+	c.Get("/-/startupz", startupProbe)
+	c.Head("/-/startupz", startupProbe)
+
+	// for external monitoring
+	healthz := healthCheck(newHealthCheckLimiter(setting.HealthCheckRateLimit))
+	c.Get("/api/healthz", healthz)
+	c.Head("/api/healthz", healthz)
+
+	// prometheus metrics endpoint
+	if setting.Metrics.Enabled {
+		registerMetrics()
+		c.Get("/metrics", routers.Metrics)
+	}
+}
+
+// NewMonitoringChi returns the router served on setting.Metrics.ListenAddress, e.g. an internal interface, which only
+// has the routes of RegisterMonitoringRoutes. RegisterRoutes leaves them out of the main router then.
+func NewMonitoringChi() chi.Router {
+	c := chi.NewRouter()
+	c.Use(trustProxies(parseTrustedProxies(setting.Proxy.TrustedProxies)))
+	c.Use(middleware.RequestID)
+	c.Use(Recovery())
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	})
+	RegisterMonitoringRoutes(c)
+	return c
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitoringRoutes(t *testing.T) {
+	defer func(enabled bool, token string) {
+		setting.Metrics.Enabled, setting.Metrics.Token = enabled, token
+	}(setting.Metrics.Enabled, setting.Metrics.Token)
+	setting.Metrics.Enabled, setting.Metrics.Token = true, "secret"
+	defer atomic.StoreInt32(&startupComplete, atomic.LoadInt32(&startupComplete))
+	defer func(checks map[string]func() error) {
+		healthChecks = checks
+	}(healthChecks)
+	healthChecks = map[string]func() error{
+		"database:ping": func() error { return nil },
+	}
+	MarkStartupComplete()
+
+	newMain := func(monitoring bool) *httptest.Server {
+		c := chi.NewRouter()
+		c.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("home"))
+		})
+		if monitoring {
+			RegisterMonitoringRoutes(c)
+		}
+		return httptest.NewServer(c)
+	}
+	get := func(server *httptest.Server, p string) int {
+		resp, err := http.Get(server.URL + p)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// with a listener of their own the main router leaves them out
+	main := newMain(false)
+	defer main.Close()
+	monitoring := httptest.NewServer(NewMonitoringChi())
+	defer monitoring.Close()
+	assert.Equal(t, http.StatusOK, get(main, "/"))
+	assert.Equal(t, http.StatusNotFound, get(monitoring, "/"))
+	for _, p := range []string{"/-/startupz", "/api/healthz"} {
+		assert.Equal(t, http.StatusNotFound, get(main, p), p)
+		assert.Equal(t, http.StatusOK, get(monitoring, p), p)
+	}
+	assert.Equal(t, http.StatusNotFound, get(main, "/metrics"))
+	// the metrics still need the token
+	assert.Equal(t, http.StatusUnauthorized, get(monitoring, "/metrics"))
+
+	// otherwise they are on the main router
+	combined := newMain(true)
+	defer combined.Close()
+	assert.Equal(t, http.StatusOK, get(combined, "/"))
+	assert.Equal(t, http.StatusOK, get(combined, "/-/startupz"))
+	assert.Equal(t, http.StatusOK, get(combined, "/api/healthz"))
+	assert.Equal(t, http.StatusUnauthorized, get(combined, "/metrics"))
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"gitea.com/macaron/macaron"
+	"github.com/go-chi/chi"
+)
+
+// corsPreflightHeaders sets the CORS headers of the response to a preflight request for a path allowing the
+// methods, following the [cors] settings the same way the CORS middleware of the API routes does. Nothing is
+// set if CORS is disabled or the origin is not allowed, which makes the browser reject the request.
+func corsPreflightHeaders(w http.ResponseWriter, req *http.Request, allowed []string) {
+	if !setting.CORSConfig.Enabled {
+		return
+	}
+	header := w.Header()
+
+	if len(setting.CORSConfig.AllowDomain) == 0 || setting.CORSConfig.AllowDomain[0] == "*" {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		u, err := url.Parse(req.Header.Get("Origin"))
+		if err != nil || u.Host == "" {
+			return
+		}
+		ok := false
+		for _, domain := range setting.CORSConfig.AllowDomain {
+			if u.Hostname() == domain || (setting.CORSConfig.AllowSubdomain && strings.HasSuffix(u.Hostname(), "."+domain)) || domain == "!*" {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+		if setting.CORSConfig.Scheme != "" && setting.CORSConfig.Scheme != "*" {
+			u.Scheme = setting.CORSConfig.Scheme
+		}
+		header.Set("Access-Control-Allow-Origin", u.String())
+		header.Set("Access-Control-Allow-Credentials", strconv.FormatBool(setting.CORSConfig.AllowCredentials))
+		header.Add("Vary", "Origin")
+	}
+
+	// only the methods the path has routes for and CORS allows are allowed
+	methods := allowed
+	if len(setting.CORSConfig.Methods) > 0 {
+		methods = make([]string, 0, len(allowed))
+		for _, method := range allowed {
+			for _, corsMethod := range setting.CORSConfig.Methods {
+				if strings.EqualFold(method, strings.TrimSpace(corsMethod)) {
+					methods = append(methods, method)
+					break
+				}
+			}
+		}
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	header.Set("Access-Control-Max-Age", strconv.Itoa(int(setting.CORSConfig.MaxAge.Seconds())))
+}
+
+// autoOptions answers OPTIONS requests to API paths that have routes but no OPTIONS route of their own with a
+// 204 listing the allowed methods, so that CORS preflight requests get the same answer for every route. Other
+// OPTIONS requests are passed on. This only sees the chi routes, macaronAutoOptions does the same for the routes
+// of the macaron fallback.
+func autoOptions() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rctx := chi.RouteContext(req.Context())
+			if req.Method != "OPTIONS" || !isAPIRequest(req) || rctx == nil || rctx.Routes == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if !answerOptions(w, req, allowedMethods(rctx.Routes, req.URL.Path)) {
+				next.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+// macaronAutoOptions answers OPTIONS requests to the API paths of the macaron routes like autoOptions does for
+// the chi routes, passing any other request on to m
+func macaronAutoOptions(routes macaronRouteTable, m http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "OPTIONS" || !isAPIRequest(req) || !answerOptions(w, req, routes.allowedMethods(req.URL.EscapedPath())) {
+			m.ServeHTTP(w, req)
+		}
+	}
+}
+
+// answerOptions answers an OPTIONS request with a 204 listing the allowed methods, unless there are none or
+// OPTIONS is one of them, in which case it returns false and the route is left to answer it
+func answerOptions(w http.ResponseWriter, req *http.Request, allowed []string) bool {
+	if len(allowed) == 0 || allowed[len(allowed)-1] == "OPTIONS" {
+		return false
+	}
+	allowed = append(allowed, "OPTIONS")
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	corsPreflightHeaders(w, req, allowed)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// macaronRouteTable holds the routing trees of a macaron router by method
+type macaronRouteTable map[string]*macaron.Tree
+
+// newMacaronRouteTable returns the route table of m once its routes are registered. macaron keeps its trees in an
+// unexported field, which is read through reflection, the trees themselves and their Match are exported. An empty
+// table is returned if the field cannot be found.
+func newMacaronRouteTable(m *macaron.Macaron) macaronRouteTable {
+	field := reflect.ValueOf(m.Router).Elem().FieldByName("routers")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(map[string]*macaron.Tree{}) {
+		log.Warn("Unable to read the macaron routes, OPTIONS requests to them will not be answered automatically")
+		return nil
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(map[string]*macaron.Tree)
+}
+
+// allowedMethods returns the methods the table has a route for the escaped path with. Gitea registers no OPTIONS
+// routes with macaron, so its OPTIONS tree only holds the routes registered for any method, such as the catch-all
+// 404 of the API. The methods only matching one of those are left out.
+func (t macaronRouteTable) allowedMethods(escapedPath string) []string {
+	var anyParams macaron.Params
+	anyMatched := false
+	if tree, ok := t["OPTIONS"]; ok {
+		_, anyParams, anyMatched = tree.Match(escapedPath)
+	}
+
+	var allowed []string
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		tree, ok := t[method]
+		if !ok {
+			continue
+		}
+		if _, params, ok := tree.Match(escapedPath); ok && !(anyMatched && reflect.DeepEqual(params, anyParams)) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
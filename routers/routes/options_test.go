@@ -0,0 +1,170 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+	apiv1 "code.gitea.io/gitea/routers/api/v1"
+
+	"gitea.com/macaron/macaron"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutoOptions(t *testing.T) {
+	oldCORSConfig := setting.CORSConfig
+	defer func() {
+		setting.CORSConfig = oldCORSConfig
+	}()
+
+	var fallbackHit bool
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fallbackHit = true
+		http.NotFound(w, req)
+	})
+
+	c := chi.NewRouter()
+	c.Use(middleware.GetHead)
+	c.Use(autoOptions())
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("[]"))
+	}
+	c.Get("/api/v1/repos/{owner}/{repo}/topics", handler)
+	c.Post("/api/v1/repos/{owner}/{repo}/topics", handler)
+	c.Get("/robots.txt", handler)
+	c.NotFound(fallback)
+	c.MethodNotAllowed(methodNotAllowed(fallback))
+
+	serve := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		fallbackHit = false
+		req := httptest.NewRequest("OPTIONS", target, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := serve("/api/v1/repos/user2/repo1/topics", nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	// GET routes answer HEAD requests too
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", resp.Header().Get("Allow"))
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.False(t, fallbackHit)
+
+	setting.CORSConfig.Enabled = true
+	setting.CORSConfig.AllowDomain = []string{"example.com"}
+	setting.CORSConfig.AllowSubdomain = true
+	setting.CORSConfig.Scheme = "https"
+	setting.CORSConfig.Methods = []string{"GET", "POST", "DELETE"}
+	setting.CORSConfig.MaxAge = 10 * time.Minute
+	setting.CORSConfig.AllowCredentials = true
+
+	preflight := map[string]string{
+		"Origin":                         "https://app.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "Authorization, Content-Type",
+	}
+	resp = serve("/api/v1/repos/user2/repo1/topics", preflight)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", resp.Header().Get("Allow"))
+	assert.Equal(t, "https://app.example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", resp.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", resp.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", resp.Header().Get("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin", resp.Header().Get("Vary"))
+
+	preflight["Origin"] = "https://evil.test"
+	resp = serve("/api/v1/repos/user2/repo1/topics", preflight)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+
+	// paths without routes and outside of the API are left to the other handlers
+	serve("/api/v1/version", nil)
+	assert.True(t, fallbackHit)
+	resp = serve("/robots.txt", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.True(t, fallbackHit)
+}
+
+func TestMacaronAutoOptions(t *testing.T) {
+	oldCORSConfig := setting.CORSConfig
+	defer func() {
+		setting.CORSConfig = oldCORSConfig
+	}()
+
+	// the actual API routes, which are macaron routes
+	m := macaron.New()
+	m.SetAutoHead(true)
+	m.Group("/api", func() {
+		apiv1.RegisterRoutes(m)
+	})
+
+	// the API routes need the contexters of NewMacaron, so the requests left to macaron go to a stand-in
+	var fallbackHit bool
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fallbackHit = true
+		http.NotFound(w, req)
+	})
+
+	c := chi.NewRouter()
+	c.Use(autoOptions())
+	c.Get("/api/healthz", func(w http.ResponseWriter, req *http.Request) {})
+	c.NotFound(macaronAutoOptions(newMacaronRouteTable(m), fallback))
+
+	serve := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		fallbackHit = false
+		req := httptest.NewRequest("OPTIONS", target, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := serve("/api/v1/repos/user2/repo1/topics", nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "GET, HEAD, PUT, OPTIONS", resp.Header().Get("Allow"))
+	assert.Empty(t, resp.Body.String())
+	assert.False(t, fallbackHit)
+
+	resp = serve("/api/v1/repos/user2/repo1/topics/gitea", nil)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "PUT, DELETE, OPTIONS", resp.Header().Get("Allow"))
+
+	setting.CORSConfig.Enabled = true
+	setting.CORSConfig.AllowDomain = []string{"*"}
+	setting.CORSConfig.Methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	setting.CORSConfig.MaxAge = 10 * time.Minute
+	resp = serve("/api/v1/version", map[string]string{
+		"Origin":                        "https://app.example.com",
+		"Access-Control-Request-Method": "GET",
+	})
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", resp.Header().Get("Allow"))
+	assert.Equal(t, "*", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, HEAD, OPTIONS", resp.Header().Get("Access-Control-Allow-Methods"))
+
+	// paths only matched by the catch-all 404 of the API are left to macaron, as are those outside of the API
+	resp = serve("/api/v1/missing", nil)
+	assert.True(t, fallbackHit)
+	assert.Empty(t, resp.Header().Get("Allow"))
+	serve("/user2/repo1", nil)
+	assert.True(t, fallbackHit)
+	// as are other methods
+	resp = httptest.NewRecorder()
+	fallbackHit = false
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/version", nil))
+	assert.True(t, fallbackHit)
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// trustedProxyRanges are the ranges the special values of setting.Proxy.TrustedProxies stand for
+var trustedProxyRanges = map[string][]string{
+	"loopback":  {"127.0.0.0/8", "::1/128"},
+	"linklocal": {"169.254.0.0/16", "fe80::/10"},
+	"private":   {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+}
+
+// trustedProxiesKey is the key of the networks of the trusted reverse proxies in the context of a request
+type trustedProxiesKey struct{}
+
+// withTrustedProxies returns req with nets as the networks of its trusted reverse proxies
+func withTrustedProxies(req *http.Request, nets []*net.IPNet) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), trustedProxiesKey{}, nets))
+}
+
+// trustProxies trusts the reverse proxies of nets for the requests, so that every router has its own
+func trustProxies(nets []*net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, withTrustedProxies(req, nets))
+		})
+	}
+}
+
+// parseTrustedProxies parses a list of IP addresses, CIDR ranges and the special values of
+// trustedProxyRanges into networks. Malformed entries are logged and left out.
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		cidrs, ok := trustedProxyRanges[strings.ToLower(entry)]
+		if !ok {
+			cidrs = []string{entry}
+			if !strings.Contains(entry, "/") {
+				// a single address
+				if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+					cidrs[0] += "/32"
+				} else {
+					cidrs[0] += "/128"
+				}
+			}
+		}
+
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Error("Ignoring invalid trusted proxy %q: %v", entry, err)
+				continue
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+// parseIP parses an IP address with or without brackets and port, e.g. "[::1]:54321", dropping any zone
+func parseIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// without a port, e.g. for requests over a unix socket or from tests
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// remoteIP returns the IP address of the connection of the request, which is that of the reverse proxy in front
+// of Gitea if there is one, or nil if the RemoteAddr cannot be parsed
+func remoteIP(req *http.Request) net.IP {
+	return parseIP(req.RemoteAddr)
+}
+
+// ClientIP returns the IP address of the client of the request, or nil if it cannot be parsed. Requests from the
+// trusted proxies are followed back through the X-Forwarded-For from the right for setting.Proxy.ForwardedForDepth
+// hops, the connecting proxy being the first, e.g. 2 for a CDN in front of a load balancer. Every hop passed must
+// be a trusted proxy, the first one which is not is taken to be the client, as is the entry after the last hop.
+// Without a depth the address of the connection is returned. IPv6 addresses are handled with or without brackets
+// and port, e.g. "[::1]:54321", and any zone is dropped.
+func ClientIP(req *http.Request) net.IP {
+	ip := remoteIP(req)
+	depth := setting.Proxy.ForwardedForDepth
+	if depth <= 0 || !isTrustedProxy(req, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for hop := 1; hop <= depth && len(forwarded) > 0; hop++ {
+		next := parseIP(strings.TrimSpace(forwarded[len(forwarded)-1]))
+		forwarded = forwarded[:len(forwarded)-1]
+		if next == nil {
+			// a malformed entry cannot be followed, the last trusted proxy is as close to the client as it gets
+			return ip
+		}
+		ip = next
+		if hop == depth || !isTrustedProxy(req, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// clientAddr returns the ClientIP of the request for logging it, or the RemoteAddr as it is if that cannot be parsed
+func clientAddr(req *http.Request) string {
+	if ip := ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// trustedProxies are the networks of setting.Proxy.TrustedProxies, parsed by NewChi at startup
+var trustedProxies []*net.IPNet
+
+// IsTrustedProxy returns whether ip belongs to one of the reverse proxies of setting.Proxy.TrustedProxies
+func IsTrustedProxy(ip net.IP) bool {
+	return containsIP(trustedProxies, ip)
+}
+
+// isTrustedProxy returns whether ip belongs to one of the trusted reverse proxies of the router serving req, those
+// of setting.Proxy.TrustedProxies unless it was built with others. Outside of a router no proxy is trusted.
+func isTrustedProxy(req *http.Request, ip net.IP) bool {
+	nets, _ := req.Context().Value(trustedProxiesKey{}).([]*net.IPNet)
+	return containsIP(nets, ip)
+}
+
+// containsIP returns whether ip belongs to any of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestIsSecure returns whether the request reached this instance over TLS, either directly or through one of
+// the trusted proxies which says so with the setting.Proxy.ForwardedProtoHeader, e.g. X-Forwarded-Proto: https
+func RequestIsSecure(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	if setting.Proxy.ForwardedProtoHeader == "" {
+		return false
+	}
+	proto := req.Header.Get(setting.Proxy.ForwardedProtoHeader)
+	if proto == "" {
+		return false
+	}
+	if !isTrustedProxy(req, remoteIP(req)) {
+		return false
+	}
+	// proxies appending to the header put the proto the client used first, X-Forwarded-Ssl uses on instead
+	proto = strings.TrimSpace(strings.SplitN(proto, ",", 2)[0])
+	return strings.EqualFold(proto, "https") || strings.EqualFold(proto, "on")
+}
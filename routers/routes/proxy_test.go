@@ -0,0 +1,180 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets := parseTrustedProxies([]string{"loopback", " Private ", "203.0.113.7", "2001:db8::1", "198.51.100.0/24", "300.1.1.1/8", "not-a-proxy", ""})
+	var cidrs []string
+	for _, ipNet := range nets {
+		cidrs = append(cidrs, ipNet.String())
+	}
+	assert.Equal(t, []string{
+		"127.0.0.0/8", "::1/128",
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+		"203.0.113.7/32", "2001:db8::1/128", "198.51.100.0/24",
+	}, cidrs)
+
+	nets = parseTrustedProxies([]string{"linklocal"})
+	if assert.Len(t, nets, 2) {
+		assert.Equal(t, "169.254.0.0/16", nets[0].String())
+		assert.Equal(t, "fe80::/10", nets[1].String())
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for remote, expected := range map[string]string{
+		"192.0.2.1:1234":        "192.0.2.1",
+		"[2001:db8::1]:54321":   "2001:db8::1",
+		"[::1]:54321":           "::1",
+		"[fe80::1%eth0]:54321":  "fe80::1",
+		"192.0.2.1":             "192.0.2.1",
+		"2001:db8::1":           "2001:db8::1",
+		"[2001:db8::1]":         "2001:db8::1",
+		"[::ffff:192.0.2.1]:80": "192.0.2.1",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		assert.Equal(t, expected, ClientIP(req).String(), remote)
+		assert.Equal(t, expected, clientAddr(req), remote)
+	}
+
+	for _, remote := range []string{"", "@", "gitea.sock", "192.0.2.1:1234:5678"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		assert.Nil(t, ClientIP(req), remote)
+		assert.Equal(t, remote, clientAddr(req), remote)
+	}
+}
+
+func TestClientIPForwardedFor(t *testing.T) {
+	defer func(depth int) {
+		setting.Proxy.ForwardedForDepth = depth
+	}(setting.Proxy.ForwardedForDepth)
+	// a CDN at 203.0.113.0/24 in front of the load balancer at 10.0.0.2
+	trusted := parseTrustedProxies([]string{"10.0.0.2", "203.0.113.0/24"})
+	setting.Proxy.ForwardedForDepth = 2
+
+	for _, tc := range []struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{"10.0.0.2:41234", []string{"198.51.100.7, 203.0.113.5"}, "198.51.100.7"},
+		{"[::ffff:10.0.0.2]:41234", []string{"198.51.100.7, 203.0.113.5"}, "198.51.100.7"},
+		// entries the client sent itself are ignored
+		{"10.0.0.2:41234", []string{"192.0.2.66, 198.51.100.7, 203.0.113.5"}, "198.51.100.7"},
+		{"10.0.0.2:41234", []string{"192.0.2.66", "198.51.100.7,203.0.113.5"}, "198.51.100.7"},
+		{"10.0.0.2:41234", []string{"[2001:db8::7]:3000, 203.0.113.5"}, "2001:db8::7"},
+		// the first hop which is not a trusted proxy is the client, e.g. when bypassing the CDN
+		{"10.0.0.2:41234", []string{"192.0.2.66, 198.51.100.7"}, "198.51.100.7"},
+		// an exhausted or malformed list stops at the last trusted proxy
+		{"10.0.0.2:41234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"10.0.0.2:41234", nil, "10.0.0.2"},
+		{"10.0.0.2:41234", []string{"unknown, 203.0.113.5"}, "203.0.113.5"},
+		// only trusted proxies are believed
+		{"198.51.100.7:41234", []string{"192.0.2.66, 203.0.113.5"}, "198.51.100.7"},
+	} {
+		req := withTrustedProxies(httptest.NewRequest("GET", "/", nil), trusted)
+		req.RemoteAddr = tc.remote
+		for _, header := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		assert.Equal(t, tc.expected, ClientIP(req).String(), "%s %v", tc.remote, tc.forwarded)
+	}
+
+	// without a depth the address of the connection is used
+	setting.Proxy.ForwardedForDepth = 0
+	req := withTrustedProxies(httptest.NewRequest("GET", "/", nil), trusted)
+	req.RemoteAddr = "10.0.0.2:41234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.5")
+	assert.Equal(t, "10.0.0.2", ClientIP(req).String())
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	req := withTrustedProxies(httptest.NewRequest("GET", "/", nil), parseTrustedProxies([]string{"loopback", "linklocal", "private", "203.0.113.7"}))
+
+	for ip, expected := range map[string]bool{
+		"127.0.0.1":       true,
+		"::1":             true,
+		"169.254.10.1":    true,
+		"fe80::1":         true,
+		"10.1.2.3":        true,
+		"172.31.255.255":  true,
+		"172.32.0.1":      false,
+		"192.168.1.1":     true,
+		"fd12:3456::1":    true,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"8.8.8.8":         false,
+		"2001:4860::8888": false,
+	} {
+		assert.Equal(t, expected, isTrustedProxy(req, net.ParseIP(ip)), ip)
+	}
+	assert.False(t, isTrustedProxy(req, nil))
+
+	// outside of a router no proxy is trusted
+	assert.False(t, isTrustedProxy(httptest.NewRequest("GET", "/", nil), net.ParseIP("127.0.0.1")))
+}
+
+func TestIsTrustedProxyStartupList(t *testing.T) {
+	defer func(nets []*net.IPNet) { trustedProxies = nets }(trustedProxies)
+	trustedProxies = parseTrustedProxies([]string{"loopback", "203.0.113.0/24"})
+
+	assert.True(t, IsTrustedProxy(net.ParseIP("127.0.0.1")))
+	assert.True(t, IsTrustedProxy(net.ParseIP("203.0.113.7")))
+	assert.False(t, IsTrustedProxy(net.ParseIP("198.51.100.7")))
+	assert.False(t, IsTrustedProxy(nil))
+
+	// the startup list does not depend on the router a request is served by
+	trustedProxies = nil
+	assert.False(t, IsTrustedProxy(net.ParseIP("127.0.0.1")))
+}
+
+func TestRequestIsSecure(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"loopback"})
+	defer func(header string) {
+		setting.Proxy.ForwardedProtoHeader = header
+	}(setting.Proxy.ForwardedProtoHeader)
+
+	newRequest := func(remote, header, value string) *http.Request {
+		req := withTrustedProxies(httptest.NewRequest("GET", "http://try.gitea.io/explore", nil), trusted)
+		req.RemoteAddr = remote
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+
+	req := httptest.NewRequest("GET", "https://try.gitea.io/explore", nil)
+	assert.True(t, RequestIsSecure(req))
+	assert.False(t, RequestIsSecure(newRequest("127.0.0.1:41234", "", "")))
+
+	setting.Proxy.ForwardedProtoHeader = "X-Forwarded-Proto"
+	assert.True(t, RequestIsSecure(newRequest("127.0.0.1:41234", "X-Forwarded-Proto", "https")))
+	assert.False(t, RequestIsSecure(newRequest("127.0.0.1:41234", "X-Forwarded-Proto", "http")))
+	assert.False(t, RequestIsSecure(newRequest("203.0.113.7:41234", "X-Forwarded-Proto", "https")))
+	assert.False(t, RequestIsSecure(newRequest("127.0.0.1:41234", "X-Forwarded-Scheme", "https")))
+
+	// only the configured header is trusted
+	setting.Proxy.ForwardedProtoHeader = "X-Forwarded-Scheme"
+	assert.True(t, RequestIsSecure(newRequest("127.0.0.1:41234", "X-Forwarded-Scheme", "HTTPS")))
+	assert.False(t, RequestIsSecure(newRequest("127.0.0.1:41234", "X-Forwarded-Proto", "https")))
+	assert.False(t, RequestIsSecure(newRequest("203.0.113.7:41234", "X-Forwarded-Scheme", "https")))
+
+	setting.Proxy.ForwardedProtoHeader = "X-Forwarded-Ssl"
+	assert.True(t, RequestIsSecure(newRequest("[::1]:41234", "X-Forwarded-Ssl", "on")))
+	assert.False(t, RequestIsSecure(newRequest("[::1]:41234", "X-Forwarded-Ssl", "off")))
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// defaultPort returns the implied port for a scheme
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// hostname strips any port from a host
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// allowedRedirectPorts returns the set of ports that redirects to this instance may point at
+func allowedRedirectPorts() map[string]bool {
+	ports := setting.AllowedRedirectPorts
+	if len(ports) == 0 {
+		if appURL, err := url.Parse(setting.AppURL); err == nil {
+			port := appURL.Port()
+			if port == "" {
+				port = defaultPort(appURL.Scheme)
+			}
+			ports = []string{port}
+		}
+	}
+	allowed := make(map[string]bool, len(ports))
+	for _, port := range ports {
+		allowed[strings.TrimSpace(port)] = true
+	}
+	return allowed
+}
+
+// normalizeRedirectPort checks that an absolute redirect built from the Host the client sent uses an allowed
+// port. Redirects to any other port are rewritten to point at the AppURL instead, the returned bool is false if
+// the location had to be changed. Redirects whose host and port did not come from the client, e.g. to an object
+// storage on another port of the same domain, are left alone.
+func normalizeRedirectPort(location string, req *http.Request, allowed map[string]bool) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		// relative redirects stay on whatever port the client used
+		return location, true
+	}
+
+	reqPort := ""
+	if _, p, err := net.SplitHostPort(req.Host); err == nil {
+		reqPort = p
+	}
+	if !strings.EqualFold(u.Hostname(), hostname(req.Host)) || u.Port() != reqPort {
+		return location, true
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	if allowed[port] {
+		return location, true
+	}
+
+	appURL, err := url.Parse(setting.AppURL)
+	if err != nil {
+		return location, true
+	}
+	u.Scheme = appURL.Scheme
+	u.Host = appURL.Host
+	return u.String(), false
+}
+
+// redirectPortGuard rewrites redirects back to this instance that point at a port which is not allowed
+func redirectPortGuard(allowed map[string]bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(onWriteHeader(w, func(status int) {
+				if status < 300 || status >= 400 {
+					return
+				}
+				location := w.Header().Get("Location")
+				if location == "" {
+					return
+				}
+				if normalized, ok := normalizeRedirectPort(location, req, allowed); !ok {
+					log.Warn("Rewriting redirect for %s %s from %s to %s as its port is not allowed", req.Method, req.URL.Path, location, normalized)
+					w.Header().Set("Location", normalized)
+				}
+			}), req)
+		})
+	}
+}
+
+// canonicalPath collapses duplicate slashes and removes any trailing slash from an escaped path.
+// Encoded slashes are not slashes as far as this is concerned so they are left alone.
+func canonicalPath(escapedPath string) string {
+	var buf strings.Builder
+	buf.Grow(len(escapedPath))
+	for i := 0; i < len(escapedPath); i++ {
+		if escapedPath[i] == '/' && i > 0 && escapedPath[i-1] == '/' {
+			continue
+		}
+		buf.WriteByte(escapedPath[i])
+	}
+	p := buf.String()
+	if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// canonicalPathHandler removes duplicate and trailing slashes from request paths so that they can be routed.
+// If redirect is set GET and HEAD requests are redirected to the canonical path instead. Paths below any of
+// the excluded prefixes, e.g. the storage prefixes whose paths are object keys, are left alone.
+func canonicalPathHandler(redirect bool, excludedPrefixes []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			escaped := req.URL.EscapedPath()
+			cleaned := canonicalPath(escaped)
+			if cleaned == escaped {
+				next.ServeHTTP(w, req)
+				return
+			}
+			for _, prefix := range excludedPrefixes {
+				if hasPathPrefix(req.URL.Path, prefix) {
+					next.ServeHTTP(w, req)
+					return
+				}
+			}
+
+			requestURI := cleaned
+			if req.URL.RawQuery != "" {
+				requestURI += "?" + req.URL.RawQuery
+			}
+
+			if redirect && (req.Method == "GET" || req.Method == "HEAD") {
+				http.Redirect(w, req, setting.AppSubURL+requestURI, http.StatusMovedPermanently)
+				return
+			}
+
+			unescaped, err := url.PathUnescape(cleaned)
+			if err != nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			req.URL.Path = unescaped
+			req.URL.RawPath = ""
+			if req.URL.EscapedPath() != cleaned {
+				req.URL.RawPath = cleaned
+			}
+			req.RequestURI = requestURI
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// acmeChallengePrefix is the path of the ACME HTTP-01 challenges, which are answered over plain HTTP
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// forceHTTPS redirects requests which did not reach this instance over TLS to the https:// AppURL with a 308,
+// which keeps the method and body. Requests which did get a Strict-Transport-Security header if hstsMaxAge is
+// set, telling browsers to only use https:// from now on. ACME challenges, health checks, which load balancers
+// commonly send over plain HTTP, and the internal API, which the hooks and `gitea manager` call on the
+// LOCAL_ROOT_URL, are left alone.
+func forceHTTPS(hstsMaxAge time.Duration, hstsIncludeSubdomains bool) func(next http.Handler) http.Handler {
+	base := strings.TrimSuffix(setting.AppURL, "/")
+	if appURL, err := url.Parse(base); err == nil {
+		appURL.Scheme = "https"
+		base = appURL.String()
+	}
+	hsts := ""
+	if hstsMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds()))
+		if hstsIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if RequestIsSecure(req) {
+				if hsts != "" {
+					w.Header().Set("Strict-Transport-Security", hsts)
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+			if strings.HasPrefix(req.URL.Path, acmeChallengePrefix) || isHealthCheck(req) || hasPathPrefix(req.URL.Path, "/api/internal") {
+				next.ServeHTTP(w, req)
+				return
+			}
+			http.Redirect(w, req, base+req.URL.RequestURI(), http.StatusPermanentRedirect)
+		})
+	}
+}
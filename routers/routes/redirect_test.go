@@ -0,0 +1,207 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectPortGuard(t *testing.T) {
+	oldAppURL, oldDomain, oldPorts := setting.AppURL, setting.Domain, setting.AllowedRedirectPorts
+	defer func() {
+		setting.AppURL, setting.Domain, setting.AllowedRedirectPorts = oldAppURL, oldDomain, oldPorts
+	}()
+	setting.AppURL = "https://try.gitea.io/"
+	setting.Domain = "try.gitea.io"
+	setting.AllowedRedirectPorts = nil
+
+	allowed := allowedRedirectPorts()
+	assert.Equal(t, map[string]bool{"443": true}, allowed)
+
+	redirectTo := func(host, location string) string {
+		handler := redirectPortGuard(allowed)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, location, http.StatusFound)
+		}))
+		req := httptest.NewRequest("GET", "/user/login", nil)
+		req.Host = host
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusFound, resp.Code)
+		return resp.Header().Get("Location")
+	}
+
+	assert.Equal(t, "https://try.gitea.io/explore", redirectTo("try.gitea.io", "https://try.gitea.io/explore"))
+	assert.Equal(t, "https://try.gitea.io:443/explore", redirectTo("try.gitea.io", "https://try.gitea.io:443/explore"))
+	assert.Equal(t, "/explore", redirectTo("try.gitea.io:8443", "/explore"))
+	assert.Equal(t, "https://github.com:8443/login", redirectTo("try.gitea.io", "https://github.com:8443/login"))
+
+	// manipulated ports are normalized back to the AppURL
+	assert.Equal(t, "https://try.gitea.io/explore?q=1", redirectTo("try.gitea.io:6666", "http://try.gitea.io:6666/explore?q=1"))
+	assert.Equal(t, "https://try.gitea.io/explore", redirectTo("evil.example.com:6666", "https://evil.example.com:6666/explore"))
+
+	// redirects to other services on the domain, e.g. to an object storage served directly, are left alone
+	assert.Equal(t, "https://try.gitea.io:9000/avatars/1234?X-Amz-Signature=0123", redirectTo("try.gitea.io", "https://try.gitea.io:9000/avatars/1234?X-Amz-Signature=0123"))
+	assert.Equal(t, "http://try.gitea.io:9000/avatars/1234", redirectTo("try.gitea.io:6666", "http://try.gitea.io:9000/avatars/1234"))
+
+	setting.AllowedRedirectPorts = []string{"443", "8443"}
+	allowed = allowedRedirectPorts()
+	assert.Equal(t, "https://try.gitea.io:8443/explore", redirectTo("try.gitea.io", "https://try.gitea.io:8443/explore"))
+}
+
+func TestCanonicalPathHandler(t *testing.T) {
+	var routedPath, routedRawPath, routedRequestURI string
+	c := chi.NewRouter()
+	c.Use(canonicalPathHandler(false, []string{"/avatars"}))
+	c.Get("/user/settings", func(w http.ResponseWriter, req *http.Request) {
+		routedPath, routedRequestURI = req.URL.Path, req.RequestURI
+		w.WriteHeader(http.StatusOK)
+	})
+	c.Get("/api/v1/repos/{owner}/{repo}/issues", func(w http.ResponseWriter, req *http.Request) {
+		routedPath, routedRequestURI = req.URL.Path, req.RequestURI
+		w.WriteHeader(http.StatusOK)
+	})
+	c.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		routedPath, routedRawPath, routedRequestURI = req.URL.Path, req.URL.RawPath, req.RequestURI
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		routedPath, routedRawPath, routedRequestURI = "", "", ""
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/user//settings").Code)
+	assert.Equal(t, "/user/settings", routedPath)
+	assert.Equal(t, "/user/settings", routedRequestURI)
+
+	assert.Equal(t, http.StatusOK, serve("/api/v1//repos/user2/repo1//issues?state=open&q=a//b").Code)
+	assert.Equal(t, "/api/v1/repos/user2/repo1/issues", routedPath)
+	assert.Equal(t, "/api/v1/repos/user2/repo1/issues?state=open&q=a//b", routedRequestURI)
+
+	assert.Equal(t, http.StatusOK, serve("/user/settings/").Code)
+	assert.Equal(t, "/user/settings", routedPath)
+
+	// encoded slashes are part of a path segment, e.g. a branch name, and must be left alone
+	serve("/user2/repo1/src/branch/feature%2F%2Fx")
+	assert.Equal(t, "/user2/repo1/src/branch/feature//x", routedPath)
+	assert.Equal(t, "/user2/repo1/src/branch/feature%2F%2Fx", routedRawPath)
+
+	serve("/user2//repo1/src/branch/feature%2Fx/")
+	assert.Equal(t, "/user2/repo1/src/branch/feature/x", routedPath)
+	assert.Equal(t, "/user2/repo1/src/branch/feature%2Fx", routedRawPath)
+	assert.Equal(t, "/user2/repo1/src/branch/feature%2Fx", routedRequestURI)
+
+	// storage paths are object keys
+	serve("/avatars//abc/")
+	assert.Equal(t, "/avatars//abc/", routedRequestURI)
+
+	serve("/")
+	assert.Equal(t, "/", routedPath)
+}
+
+func TestCanonicalPathRedirect(t *testing.T) {
+	oldAppSubURL := setting.AppSubURL
+	defer func() {
+		setting.AppSubURL = oldAppSubURL
+	}()
+	setting.AppSubURL = "/gitea"
+
+	handler := canonicalPathHandler(true, nil)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(method, target, nil))
+		return resp
+	}
+
+	resp := serve("GET", "/user//settings/?tab=keys")
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+	assert.Equal(t, "/gitea/user/settings?tab=keys", resp.Header().Get("Location"))
+
+	resp = serve("GET", "/user2/repo1/src/branch/feature%2Fx/")
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+	assert.Equal(t, "/gitea/user2/repo1/src/branch/feature%2Fx", resp.Header().Get("Location"))
+
+	// redirecting would lose the body so other methods are rewritten instead
+	assert.Equal(t, http.StatusOK, serve("POST", "/user//settings").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/user/settings").Code)
+}
+
+func TestForceHTTPS(t *testing.T) {
+	defer func(appURL string) { setting.AppURL = appURL }(setting.AppURL)
+	setting.AppURL = "http://try.gitea.io/"
+	c := chi.NewRouter()
+	c.Use(trustProxies(parseTrustedProxies([]string{"loopback"})))
+	c.Use(forceHTTPS(365*24*time.Hour, true))
+	c.HandleFunc("/*", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	serve := func(method, target, remote, proto string, tls bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if remote != "" {
+			req.RemoteAddr = remote
+		}
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if !tls {
+			req.TLS = nil
+		}
+		resp := httptest.NewRecorder()
+		c.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// plain requests are redirected, keeping their method
+	resp := serve("POST", "http://try.gitea.io/user/login?redirect_to=%2Fexplore", "", "", false)
+	assert.Equal(t, http.StatusPermanentRedirect, resp.Code)
+	assert.Equal(t, "https://try.gitea.io/user/login?redirect_to=%2Fexplore", resp.Header().Get("Location"))
+	assert.Empty(t, resp.Header().Get("Strict-Transport-Security"))
+
+	// a forwarded proto is only trusted from trusted proxies
+	resp = serve("GET", "http://try.gitea.io/explore", "203.0.113.7:41234", "https", false)
+	assert.Equal(t, http.StatusPermanentRedirect, resp.Code)
+	resp = serve("GET", "http://try.gitea.io/explore", "127.0.0.1:41234", "http", false)
+	assert.Equal(t, http.StatusPermanentRedirect, resp.Code)
+
+	// ACME challenges are answered over plain HTTP
+	resp = serve("GET", "http://try.gitea.io/.well-known/acme-challenge/token", "", "", false)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Strict-Transport-Security"))
+
+	// so are the health checks of load balancers and the internal API on the LOCAL_ROOT_URL
+	assert.Equal(t, http.StatusOK, serve("HEAD", "http://10.0.0.5:3000/", "", "", false).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "http://10.0.0.5:3000/api/healthz", "", "", false).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "http://10.0.0.5:3000/-/startupz", "", "", false).Code)
+	resp = serve("POST", "http://localhost:3000/api/internal/hook/pre-receive/user2/repo1", "127.0.0.1:41234", "", false)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+	// but not pages that merely look like them
+	assert.Equal(t, http.StatusPermanentRedirect, serve("GET", "http://try.gitea.io/", "", "", false).Code)
+	assert.Equal(t, http.StatusPermanentRedirect, serve("GET", "http://try.gitea.io/api/internalx", "", "", false).Code)
+
+	// secure requests get HSTS
+	for _, resp := range []*httptest.ResponseRecorder{
+		serve("GET", "https://try.gitea.io/explore", "", "", true),
+		serve("GET", "http://try.gitea.io/explore", "127.0.0.1:41234", "https", false),
+		serve("GET", "http://try.gitea.io/explore", "[::1]:41234", "HTTPS, http", false),
+	} {
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "max-age=31536000; includeSubDomains", resp.Header().Get("Strict-Transport-Security"))
+	}
+}
@@ -0,0 +1,783 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"code.gitea.io/gitea/modules/auth/sso"
+	"code.gitea.io/gitea/modules/cache"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/metrics"
+	"code.gitea.io/gitea/modules/public"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/storage"
+	"code.gitea.io/gitea/modules/timing"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// storageETag returns a strong ETag for an object derived from its size, name and modification time
+func storageETag(fi os.FileInfo) string {
+	return `"` + public.GenerateETag(fmt.Sprint(fi.Size()), fi.Name(), fi.ModTime().UTC().Format(http.TimeFormat)) + `"`
+}
+
+// contentDisposition returns an inline Content-Disposition for a filename, non-ASCII filenames are
+// encoded as per RFC 5987 along with an ASCII fallback for older clients
+func contentDisposition(filename string) string {
+	ascii := true
+	var fallback strings.Builder
+	for _, r := range filename {
+		switch {
+		case r >= utf8.RuneSelf || r < 0x20 || r == 0x7f:
+			ascii = false
+			fallback.WriteByte('_')
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	if ascii {
+		return `inline; filename="` + fallback.String() + `"`
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < len(filename); i++ {
+		// attr-char of RFC 5987 is written as is, anything else is percent encoded
+		if b := filename[i]; 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return `inline; filename="` + fallback.String() + `"; filename*=UTF-8''` + encoded.String()
+}
+
+// isStorageNotExist returns whether a storage error means that the object does not exist
+func isStorageNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist)
+}
+
+// storageRetryAfter is the number of seconds clients are asked to wait when the storage is throttling requests
+const storageRetryAfter = "5"
+
+// isStorageErrorKnown returns whether a storage error is one that has its own response in storageError
+func isStorageErrorKnown(err error) bool {
+	return isStorageNotExist(err) || os.IsPermission(err) || errors.Is(err, os.ErrPermission) || storage.IsErrThrottled(err) ||
+		errors.Is(err, gocontext.DeadlineExceeded)
+}
+
+var (
+	storageTombstonesLock sync.RWMutex
+	storageTombstones     = map[string]func(p string) bool{}
+)
+
+// RegisterStorageTombstones registers a lookup returning whether an object below the prefix of a storage, e.g.
+// "avatars", was deliberately deleted. Requests for such objects are answered with 410 Gone instead of 404 Not Found,
+// so that caches can tell them from paths which never existed. Only one lookup is kept per prefix.
+func RegisterStorageTombstones(prefix string, isDeleted func(p string) bool) {
+	storageTombstonesLock.Lock()
+	defer storageTombstonesLock.Unlock()
+	storageTombstones[strings.Trim(prefix, "/")] = isDeleted
+}
+
+// isStorageTombstone returns whether the lookup registered for prefix knows the missing object to be deleted
+func isStorageTombstone(prefix, rPath string) bool {
+	storageTombstonesLock.RLock()
+	isDeleted := storageTombstones[strings.Trim(prefix, "/")]
+	storageTombstonesLock.RUnlock()
+	return isDeleted != nil && isDeleted(strings.TrimPrefix(rPath, "/"))
+}
+
+// storageError responds to a failed storage request for an object: a 404 if it does not exist, or a 410 if it
+// was deleted according to the RegisterStorageTombstones lookup of its prefix, a 403 if
+// the storage denies access to it, a 503 if the storage is throttling requests, a 504 if the storage did not
+// respond within its OPERATION_TIMEOUT and a 500 otherwise
+func storageError(w http.ResponseWriter, req *http.Request, prefix, rPath, action string, err error) {
+	status, message := http.StatusInternalServerError, fmt.Sprintf("Error whilst %s %s %s", action, prefix, rPath)
+	switch {
+	case isStorageNotExist(err) && isStorageTombstone(prefix, rPath):
+		log.Debug("Unable to find deleted %s %s", prefix, rPath)
+		status, message = http.StatusGone, "file deleted"
+	case isStorageNotExist(err):
+		log.Warn("Unable to find %s %s", prefix, rPath)
+		status, message = http.StatusNotFound, "file not found"
+	case os.IsPermission(err) || errors.Is(err, os.ErrPermission):
+		log.Error("Access denied whilst %s %s %s. Error: %v", action, prefix, rPath, err)
+		status, message = http.StatusForbidden, "access denied"
+	case storage.IsErrThrottled(err):
+		log.Warn("Storage throttled whilst %s %s %s. Error: %v", action, prefix, rPath, err)
+		w.Header().Set("Retry-After", storageRetryAfter)
+		status, message = http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)
+	case errors.Is(err, gocontext.DeadlineExceeded):
+		log.Warn("Storage timed out whilst %s %s %s", action, prefix, rPath)
+		status, message = http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)
+	case errors.Is(err, gocontext.Canceled) && req.Context().Err() != nil:
+		log.Debug("Client went away whilst %s %s %s", action, prefix, rPath)
+	default:
+		log.Error("Error whilst %s %s %s. Error: %v", action, prefix, rPath, err)
+	}
+
+	if context.WantsProblemDetails(req) {
+		context.WriteProblemDetails(w, req, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// fromStorages calls get with each of the stores in turn until it finds the object, so that objects not found in
+// one store are looked up in the next. The error of the last store is returned if none of them has the object.
+func fromStorages(stores []storage.ObjectStorage, prefix, p string, get func(objStore storage.ObjectStorage) error) error {
+	err := os.ErrNotExist
+	for i, objStore := range stores {
+		if objStore == nil {
+			continue
+		}
+		if err = get(objStore); err == nil {
+			log.Debug("Found %s %s in storage %d (%T)", prefix, p, i, objStore)
+			return nil
+		} else if !isStorageNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// openStorageObject opens an object from the first of the stores which has it
+func openStorageObject(ctx gocontext.Context, stores []storage.ObjectStorage, prefix, p string) (fr storage.Object, err error) {
+	err = fromStorages(stores, prefix, p, func(objStore storage.ObjectStorage) (err error) {
+		fr, err = storage.OpenWithContext(ctx, objStore, p)
+		return err
+	})
+	return fr, err
+}
+
+// statStorageObject returns the info of an object from the first of the stores which has it
+func statStorageObject(ctx gocontext.Context, stores []storage.ObjectStorage, prefix, p string) (fi os.FileInfo, err error) {
+	err = fromStorages(stores, prefix, p, func(objStore storage.ObjectStorage) (err error) {
+		fi, err = storage.StatWithContext(ctx, objStore, p)
+		return err
+	})
+	return fi, err
+}
+
+// storageRedirectMaxAge is the longest time in seconds the redirects to objects served directly may be cached for,
+// which is well below the time the signed URLs they redirect to are valid for
+const storageRedirectMaxAge = 60
+
+// storageRedirectCacheControl returns the Cache-Control of a redirect to an object served directly by the storage,
+// that is the Cache-Control of the storage with its ages shortened to storageRedirectMaxAge. The object itself has
+// the Cache-Control set by the storage.
+func storageRedirectCacheControl(cacheControl string) string {
+	if strings.TrimSpace(cacheControl) == "" {
+		return fmt.Sprintf("private, max-age=%d", storageRedirectMaxAge)
+	}
+
+	var directives []string
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(directive)
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name = strings.TrimSpace(name[:idx])
+		}
+		switch name {
+		case "":
+			continue
+		case "immutable":
+			// the signed URL changes even if the object does not
+			continue
+		case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error":
+			age, err := strconv.Atoi(strings.TrimSpace(directive[strings.IndexByte(directive, '=')+1:]))
+			if err != nil || age > storageRedirectMaxAge {
+				age = storageRedirectMaxAge
+			}
+			directive = fmt.Sprintf("%s=%d", name, age)
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, ", ")
+}
+
+// setStorageCacheHeaders sets the Cache-Control and Vary configured for a storage
+func setStorageCacheHeaders(w http.ResponseWriter, storageSetting setting.Storage) {
+	if storageSetting.CacheControl != "" {
+		w.Header().Set("Cache-Control", storageSetting.CacheControl)
+	}
+	if storageSetting.Vary != "" {
+		w.Header().Set("Vary", storageSetting.Vary)
+	}
+}
+
+// storageObjectHeaders sets the headers describing an object that are sent for GET and HEAD requests,
+// returning the filename the object is downloaded as
+func storageObjectHeaders(w http.ResponseWriter, storageSetting setting.Storage, rPath string, fi os.FileInfo) string {
+	name := path.Base(rPath)
+	if info, ok := fi.(storage.FilenameInfo); ok && info.Filename() != "" {
+		name = info.Filename()
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(name))
+	w.Header().Set("ETag", storageETag(fi))
+	setStorageCacheHeaders(w, storageSetting)
+	return name
+}
+
+// storageNotModified reports whether the client's cached copy of an object with etag and modTime is still good,
+// evaluating If-None-Match, or If-Modified-Since if there is none, the way http.ServeContent does for GET
+func storageNotModified(req *http.Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, match := range strings.Split(inm, ",") {
+			match = strings.TrimSpace(match)
+			// If-None-Match uses the weak comparison, so W/ tags match too
+			if match == "*" || strings.TrimPrefix(match, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() || modTime.Equal(time.Unix(0, 0)) {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// the Last-Modified sent has a granularity of seconds
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// serveStorageObjectHead answers a HEAD request for an object from its info alone, so that clients can
+// check whether an object exists and get its size without it being read. It returns false if the info
+// could not be got for any other reason than those handled by storageError.
+func serveStorageObjectHead(ctx gocontext.Context, w http.ResponseWriter, req *http.Request, storageSetting setting.Storage, prefix, rPath string, stores []storage.ObjectStorage) bool {
+	fi, err := statStorageObject(ctx, stores, prefix, rPath)
+	if err != nil {
+		if isStorageErrorKnown(err) {
+			storageError(w, req, prefix, rPath, "getting info for", err)
+			return true
+		}
+		return false
+	}
+
+	name := storageObjectHeaders(w, storageSetting, rPath, fi)
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if storageNotModified(req, w.Header().Get("ETag"), fi.ModTime()) {
+		cache.SetStatus(req.Context(), cache.StatusHit)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	cache.SetStatus(req.Context(), cache.StatusMiss)
+	if storageSetting.AcceptRanges {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// serveStorageObjectXAccel answers a GET or HEAD request for an object of a local storage with its headers, leaving
+// the body to the reverse proxy through X-Accel-Redirect or X-Sendfile. It returns false if the request has to
+// be served by Gitea instead, i.e. if the object is not in the first of the stores or that is not local.
+func serveStorageObjectXAccel(ctx gocontext.Context, w http.ResponseWriter, req *http.Request, storageSetting setting.Storage, prefix, rPath string, stores []storage.ObjectStorage) bool {
+	if len(stores) == 0 {
+		return false
+	}
+	if _, ok := stores[0].(*storage.LocalStorage); !ok {
+		return false
+	}
+	fi, err := storage.StatWithContext(ctx, stores[0], rPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the storage would not be any quicker to serve the object through Gitea
+			storageError(w, req, prefix, rPath, "getting info for", err)
+			return true
+		}
+		return false
+	}
+
+	// the object paths are cleaned as rooted paths, so that they cannot point outside of the storage
+	objectPath := path.Clean("/" + rPath)
+	if storageSetting.XAccelHeader == "X-Sendfile" {
+		w.Header().Set("X-Sendfile", filepath.Join(storageSetting.Path, filepath.FromSlash(objectPath)))
+	} else {
+		w.Header().Set("X-Accel-Redirect", storageSetting.XAccelLocation+(&url.URL{Path: objectPath}).EscapedPath())
+	}
+	name := storageObjectHeaders(w, storageSetting, rPath, fi)
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	cache.SetStatus(req.Context(), cache.StatusBypass)
+	log.Trace("Handing %s %s over to the reverse proxy", prefix, rPath)
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// storageObjectURL returns the URL of an object from the endpoint for region of the first of the stores which has it.
+// Stores such as minio sign URLs without checking that the object exists, if stat is set its info is got first so
+// that missing objects are reported as such instead.
+func storageObjectURL(ctx gocontext.Context, stores []storage.ObjectStorage, prefix, p, name, region string, stat bool) (u *url.URL, err error) {
+	err = fromStorages(stores, prefix, p, func(objStore storage.ObjectStorage) (err error) {
+		if stat {
+			if _, err := storage.StatWithContext(ctx, objStore, strings.TrimPrefix(p, "/")); err != nil {
+				return err
+			}
+		}
+		u, err = storage.RegionURLWithContext(ctx, objStore, p, name, region)
+		return err
+	})
+	return u, err
+}
+
+// validateStorageURL checks that a URL an object is served directly from is an absolute http or https URL, and
+// that its host is one of allowedHosts if there are any, so that a misconfigured storage cannot send clients to
+// broken or foreign locations
+func validateStorageURL(u *url.URL, allowedHosts []string) error {
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is neither an http nor an https URL", u)
+	}
+	if len(allowedHosts) == 0 {
+		return nil
+	}
+	for _, host := range allowedHosts {
+		if strings.EqualFold(u.Hostname(), hostname(strings.TrimSpace(host))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the host of %q is not one of the ALLOWED_REDIRECT_HOSTS", u)
+}
+
+// clientRegion returns the region of the client from the header, which is only trusted if the request was
+// passed on by one of the trusted reverse proxies
+func clientRegion(req *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	if !isTrustedProxy(req, remoteIP(req)) {
+		return ""
+	}
+	return strings.TrimSpace(req.Header.Get(header))
+}
+
+// downloadLimiter limits the number of objects each client IP downloads at once, so that a single client
+// cannot saturate the disks with parallel downloads
+type downloadLimiter struct {
+	limit         int
+	signedInLimit int
+
+	lock     sync.Mutex
+	inFlight map[string]int
+}
+
+// downloadSignedIn reports whether a download request carries a valid access or OAuth2 token. The storage
+// requests are served before their sessions are loaded, so only tokens can get a client the signed in limit.
+var downloadSignedIn = func(req *http.Request) bool {
+	return sso.VerifiedTokenUserID(req) > 0
+}
+
+// newDownloadLimiter returns a limiter allowing limit downloads at once per IP, or signedInLimit to clients
+// which are signed in with a token. It returns nil, which allows any number of downloads, if limit is 0 or less.
+func newDownloadLimiter(limit, signedInLimit int) *downloadLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &downloadLimiter{
+		limit:         limit,
+		signedInLimit: signedInLimit,
+		inFlight:      make(map[string]int),
+	}
+}
+
+// acquire takes a download slot of the client IP of the request, returning false if it has none left. The
+// token of the request is only looked up once the IP has used up the slots of anonymous clients. The slot is
+// given back by the returned function or once the client goes away, whichever comes first.
+func (l *downloadLimiter) acquire(req *http.Request) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	ip := clientAddr(req)
+	l.lock.Lock()
+	if l.inFlight[ip] >= l.limit {
+		if l.inFlight[ip] >= l.signedInLimit {
+			l.lock.Unlock()
+			return nil, false
+		}
+		// the token is not looked up with the lock held, the count is checked again afterwards
+		l.lock.Unlock()
+		if !downloadSignedIn(req) {
+			return nil, false
+		}
+		l.lock.Lock()
+		if l.inFlight[ip] >= l.signedInLimit {
+			l.lock.Unlock()
+			return nil, false
+		}
+	}
+	l.inFlight[ip]++
+	l.lock.Unlock()
+
+	var once sync.Once
+	done := make(chan struct{})
+	release := func() {
+		once.Do(func() {
+			close(done)
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			if l.inFlight[ip]--; l.inFlight[ip] <= 0 {
+				delete(l.inFlight, ip)
+			}
+		})
+	}
+	go func() {
+		select {
+		case <-req.Context().Done():
+			release()
+		case <-done:
+		}
+	}()
+	return release, true
+}
+
+// defaultCopyBufferSize is the size of the buffers objects are copied with if the storage has no size set
+const defaultCopyBufferSize = 32 * 1024
+
+// copyBufferPool reuses the buffers objects are copied to the responses with, rather than each request
+// allocating its own
+type copyBufferPool struct {
+	// inUse is the number of buffers taken from the pool that have not been returned yet, it comes first so
+	// that it is aligned for atomic access on 32-bit platforms
+	inUse int64
+	pool  sync.Pool
+}
+
+func newCopyBufferPool(size int) *copyBufferPool {
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	p := &copyBufferPool{}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// copy copies src to dst with a buffer from the pool, which is returned to it even if the copy fails
+func (p *copyBufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.pool.Get().(*[]byte)
+	atomic.AddInt64(&p.inUse, 1)
+	defer func() {
+		atomic.AddInt64(&p.inUse, -1)
+		p.pool.Put(buf)
+	}()
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// pooledCopyWriter makes the copies io.Copy does to a response, such as those of http.ServeContent, use
+// a buffer from the pool
+type pooledCopyWriter struct {
+	http.ResponseWriter
+	buffers *copyBufferPool
+}
+
+func (w pooledCopyWriter) ReadFrom(r io.Reader) (int64, error) {
+	// the ResponseWriter is wrapped so that io.CopyBuffer does not call ReadFrom again
+	return w.buffers.copy(struct{ io.Writer }{w.ResponseWriter}, r)
+}
+
+// sendErrorWriter keeps the error of a failed write, so that failures to send an object to the client can be told
+// apart from failures to read it from the storage
+type sendErrorWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *sendErrorWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// isClientDisconnect returns whether the error sending the response of the request is down to the client going
+// away, e.g. by cancelling a download, rather than anything being wrong with this instance
+func isClientDisconnect(req *http.Request, err error) bool {
+	return req.Context().Err() != nil || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// sendStorageObject copies the object to the response, failures to send it because the client went away are
+// only logged at debug level
+func sendStorageObject(w http.ResponseWriter, req *http.Request, buffers *copyBufferPool, prefix, rPath string, fr io.Reader) {
+	dst := &sendErrorWriter{Writer: w}
+	if _, err := buffers.copy(dst, fr); err != nil {
+		if dst.err != nil && isClientDisconnect(req, dst.err) {
+			log.Debug("Client went away whilst sending %s %s: %v", prefix, rPath, err)
+		} else {
+			log.Error("Error whilst sending %s %s. Error: %v", prefix, rPath, err)
+		}
+	}
+}
+
+// isSeekable returns whether the end of the object can be sought and it can be rewound again, as ServeContent
+// does to find its size and serve ranges of it
+func isSeekable(fr io.Seeker) bool {
+	if _, err := fr.Seek(0, io.SeekEnd); err != nil {
+		return false
+	}
+	_, err := fr.Seek(0, io.SeekStart)
+	return err == nil
+}
+
+// storageTiming starts timing the storage phase of the request and returns the header hook stopping it, so that
+// the time until the object is ready to be sent is recorded
+func storageTiming(req *http.Request) func(status int) {
+	stop := timing.Start(req.Context(), timing.PhaseStorage)
+	return func(int) {
+		stop()
+	}
+}
+
+// requestsNoCache returns whether the client asks for a fresh response with Cache-Control: no-cache, or with
+// Pragma: no-cache if it sends no Cache-Control
+func requestsNoCache(req *http.Request) bool {
+	cacheControl := req.Header.Values("Cache-Control")
+	if len(cacheControl) == 0 {
+		cacheControl = req.Header.Values("Pragma")
+	}
+	for _, value := range cacheControl {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutCacheValidators returns a copy of the request without the validators of the client's cached copy, so
+// that the whole object is sent instead of a 304 Not Modified. Any other precondition, such as If-Match, is kept.
+func withoutCacheValidators(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	return r
+}
+
+// storageOperationContext returns the context the storage has to open an object or get its info or URL within,
+// which is the context of the request limited to the OPERATION_TIMEOUT of the storage, so that the storage is given
+// up on once the client has gone away too. Without a timeout the storage is waited for as long as the client waits.
+func storageOperationContext(req *http.Request, storageSetting setting.Storage) (gocontext.Context, gocontext.CancelFunc) {
+	if storageSetting.OperationTimeout <= 0 {
+		return gocontext.WithCancel(req.Context())
+	}
+	return gocontext.WithTimeout(req.Context(), storageSetting.OperationTimeout)
+}
+
+// storageObjectPath returns the path of the object requested by req below prefix, and whether req is for an object
+// below prefix at all. With Gitea hosted under subURL its requests are matched whether or not the proxy in front of
+// it strips the sub-path.
+func storageObjectPath(req *http.Request, subURL, prefix string) (string, bool) {
+	uri := req.RequestURI
+	if subURL != "" && strings.HasPrefix(uri, subURL+"/") {
+		uri = uri[len(subURL):]
+	}
+	if !strings.HasPrefix(uri, "/"+prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(uri, "/"+prefix), true
+}
+
+// storageHandler serves the objects below prefix from the first of the stores which has them, so that objects can be
+// migrated from one store to another without downtime, nil stores are skipped. Objects served directly are redirected
+// to the store which has them. HEAD requests are answered from the info of the objects.
+func storageHandler(storageSetting setting.Storage, prefix string, stores ...storage.ObjectStorage) func(next http.Handler) http.Handler {
+	subURL := setting.AppSubURL
+	buffers := newCopyBufferPool(storageSetting.CopyBufferSize)
+	downloads := newDownloadLimiter(storageSetting.MaxConcurrentPerIP, storageSetting.MaxConcurrentPerIPSignedIn)
+	return func(next http.Handler) http.Handler {
+		if storageSetting.ServeDirect {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != "GET" && req.Method != "HEAD" {
+					next.ServeHTTP(w, req)
+					return
+				}
+
+				rPath, ok := storageObjectPath(req, subURL, prefix)
+				if !ok {
+					next.ServeHTTP(w, req)
+					return
+				}
+
+				w = onWriteHeader(w, storageTiming(req))
+				ctx, cancel := storageOperationContext(req, storageSetting)
+				defer cancel()
+				// HEAD requests check that the object exists, so that they do not get a redirect to a missing object
+				u, err := storageObjectURL(ctx, stores, prefix, rPath, path.Base(rPath), clientRegion(req, storageSetting.ServeDirectRegionHeader), req.Method == "HEAD")
+				if err != nil {
+					storageError(w, req, prefix, rPath, "getting URL for", err)
+					return
+				}
+				if err := validateStorageURL(u, storageSetting.AllowedRedirectHosts); err != nil {
+					storageError(w, req, prefix, rPath, "validating URL for", err)
+					return
+				}
+				cache.SetStatus(req.Context(), cache.StatusBypass)
+				w.Header().Set("Cache-Control", storageRedirectCacheControl(storageSetting.CacheControl))
+				if storageSetting.Vary != "" {
+					w.Header().Set("Vary", storageSetting.Vary)
+				}
+				if storageSetting.ServeDirectRegionHeader != "" {
+					// the redirect depends on the region of the client
+					w.Header().Add("Vary", storageSetting.ServeDirectRegionHeader)
+				}
+				http.Redirect(
+					w,
+					req,
+					u.String(),
+					301,
+				)
+			})
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			rPath, ok := storageObjectPath(req, subURL, prefix)
+			if !ok {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			// the bytes actually written are counted, including those of ranges and of failed copies
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			defer func() {
+				metrics.StorageBytesServed.WithLabelValues(prefix).Add(float64(ww.BytesWritten()))
+			}()
+			w = onWriteHeader(ww, storageTiming(req))
+			rPath = strings.TrimPrefix(rPath, "/")
+			if requestsNoCache(req) {
+				// the client wants the object even if its copy is still good, e.g. to refresh an avatar after an upload
+				req = withoutCacheValidators(req)
+			}
+			ctx, cancel := storageOperationContext(req, storageSetting)
+			defer cancel()
+			if storageSetting.ServeViaXAccel && serveStorageObjectXAccel(ctx, w, req, storageSetting, prefix, rPath, stores) {
+				return
+			}
+			if req.Method == "HEAD" && serveStorageObjectHead(ctx, w, req, storageSetting, prefix, rPath, stores) {
+				return
+			}
+
+			release, ok := downloads.acquire(req)
+			if !ok {
+				log.Debug("Too many downloads in flight for %s, rejecting %s %s", clientAddr(req), prefix, rPath)
+				w.Header().Set("Retry-After", "1")
+				renderStatus(w, req, http.StatusTooManyRequests)
+				return
+			}
+			defer release()
+
+			//If we have matched and access to release or issue
+			fr, err := openStorageObject(ctx, stores, prefix, rPath)
+			if err != nil {
+				storageError(w, req, prefix, rPath, "opening", err)
+				return
+			}
+			defer fr.Close()
+
+			fi, err := storage.StatObjectWithContext(ctx, fr)
+			if err != nil && isStorageErrorKnown(err) {
+				// objects may only be fetched once they are read, e.g. with minio
+				storageError(w, req, prefix, rPath, "opening", err)
+				return
+			} else if err != nil {
+				// without the size there is no Content-Length or range support, so just stream the object
+				log.Debug("Unable to get info for %s %s, sending it without a Content-Length. Error: %v", prefix, rPath, err)
+				w.Header().Set("Content-Disposition", contentDisposition(path.Base(rPath)))
+				setStorageCacheHeaders(w, storageSetting)
+				cache.SetStatus(req.Context(), cache.StatusBypass)
+				if req.Method == "HEAD" {
+					return
+				}
+				sendStorageObject(w, req, buffers, prefix, rPath, fr)
+				return
+			}
+
+			name := storageObjectHeaders(w, storageSetting, rPath, fi)
+			if fi.Size() == 0 {
+				// there is nothing to sniff the type of an empty object from, which would make it text/plain
+				ctype := mime.TypeByExtension(path.Ext(name))
+				if ctype == "" {
+					ctype = "application/octet-stream"
+				}
+				w.Header().Set("Content-Type", ctype)
+			}
+			if !isSeekable(fr) {
+				// ServeContent needs to seek for ranges, so the whole object is sent instead
+				log.Debug("Unable to seek in %s %s, ignoring any Range", prefix, rPath)
+				if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+					w.Header().Set("Content-Type", ctype)
+				}
+				w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+				w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+				cache.SetStatus(req.Context(), cache.StatusMiss)
+				w.WriteHeader(http.StatusOK)
+				if req.Method != "HEAD" {
+					sendStorageObject(w, req, buffers, prefix, rPath, fr)
+				}
+				return
+			}
+
+			if !storageSetting.AcceptRanges {
+				// ranges are expensive for some storages, so the whole object is sent instead
+				req = req.Clone(req.Context())
+				req.Header.Del("Range")
+				req.Header.Del("If-Range")
+			}
+			// ServeContent handles Range, If-Range and the other conditional request headers for us
+			http.ServeContent(pooledCopyWriter{onWriteHeader(w, func(status int) {
+				if !storageSetting.AcceptRanges {
+					w.Header().Del("Accept-Ranges")
+				}
+				// a 304 means that the client's cached copy is still good
+				if status == http.StatusNotModified {
+					cache.SetStatus(req.Context(), cache.StatusHit)
+				} else {
+					cache.SetStatus(req.Context(), cache.StatusMiss)
+				}
+			}), buffers}, req, name, fi.ModTime(), fr)
+		})
+	}
+}
@@ -0,0 +1,1288 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/metrics"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryFileInfo struct {
+	name     string
+	filename string
+	size     int64
+	modTime  time.Time
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return fi.size }
+func (fi memoryFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memoryFileInfo) IsDir() bool        { return false }
+func (fi memoryFileInfo) Sys() interface{}   { return nil }
+func (fi memoryFileInfo) Filename() string   { return fi.filename }
+
+type memoryObject struct {
+	*bytes.Reader
+	info memoryFileInfo
+}
+
+func (o *memoryObject) Close() error { return nil }
+
+func (o *memoryObject) Stat() (os.FileInfo, error) {
+	if o.info.size < 0 {
+		return nil, errors.New("size unknown")
+	}
+	return o.info, nil
+}
+
+// memoryStorage is an in memory storage.ObjectStorage for testing the storage handler
+type memoryStorage struct {
+	objects     map[string][]byte
+	filenames   map[string]string
+	unknownSize map[string]bool
+	modTime     time.Time
+	// baseURL is the URL objects are served directly from, https://storage.example.com/ if empty
+	baseURL string
+}
+
+func newMemoryStorage(objects map[string]string) *memoryStorage {
+	m := &memoryStorage{
+		objects:     make(map[string][]byte, len(objects)),
+		filenames:   make(map[string]string),
+		unknownSize: make(map[string]bool),
+		modTime:     time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for p, content := range objects {
+		m.objects[p] = []byte(content)
+	}
+	return m
+}
+
+func (m *memoryStorage) info(p string) memoryFileInfo {
+	size := int64(len(m.objects[p]))
+	if m.unknownSize[p] {
+		size = -1
+	}
+	return memoryFileInfo{name: path.Base(p), filename: m.filenames[p], size: size, modTime: m.modTime}
+}
+
+func (m *memoryStorage) Open(p string) (storage.Object, error) {
+	content, ok := m.objects[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &memoryObject{Reader: bytes.NewReader(content), info: m.info(p)}, nil
+}
+
+func (m *memoryStorage) Save(p string, r io.Reader) (int64, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.objects[p] = content
+	return int64(len(content)), nil
+}
+
+func (m *memoryStorage) SaveWithFilename(p string, r io.Reader, filename string) (int64, error) {
+	m.filenames[p] = filename
+	return m.Save(p, r)
+}
+
+func (m *memoryStorage) Stat(p string) (os.FileInfo, error) {
+	if _, ok := m.objects[p]; !ok {
+		return nil, os.ErrNotExist
+	}
+	if m.unknownSize[p] {
+		return nil, errors.New("size unknown")
+	}
+	return m.info(p), nil
+}
+
+func (m *memoryStorage) Delete(p string) error {
+	delete(m.objects, p)
+	return nil
+}
+
+func (m *memoryStorage) URL(p, name string) (*url.URL, error) {
+	// like the minio storage the path may have a leading slash when serving directly
+	p = strings.TrimPrefix(p, "/")
+	if _, ok := m.objects[p]; !ok {
+		return nil, os.ErrNotExist
+	}
+	if m.baseURL != "" {
+		return url.Parse(m.baseURL + p)
+	}
+	return url.Parse("https://storage.example.com/" + p)
+}
+
+func (m *memoryStorage) IterateObjects(fn func(p string, obj storage.Object) error) error {
+	for p := range m.objects {
+		obj, _ := m.Open(p)
+		if err := fn(p, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveStorage sends a request through a storage handler, returning the response
+func serveStorage(handler func(next http.Handler) http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	handler(http.NotFoundHandler()).ServeHTTP(resp, req)
+	return resp
+}
+
+// disconnectedWriter is a response whose client went away once the headers were sent
+type disconnectedWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w *disconnectedWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestStorageHandlerClientDisconnect(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+
+	objStore := newMemoryStorage(map[string]string{"unknown": "0123456789"})
+	objStore.unknownSize["unknown"] = true
+	handler := storageHandler(setting.Storage{}, "avatars", objStore)(http.NotFoundHandler())
+
+	for _, err := range []error{
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)},
+	} {
+		handler.ServeHTTP(&disconnectedWriter{httptest.NewRecorder(), err}, httptest.NewRequest("GET", "/avatars/unknown", nil))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/avatars/unknown", nil).WithContext(ctx)
+	handler.ServeHTTP(&disconnectedWriter{httptest.NewRecorder(), errors.New("write: stream closed")}, req)
+
+	logged := read()
+	assert.Contains(t, logged, "Client went away whilst sending avatars unknown")
+	assert.NotContains(t, logged, "Error whilst sending")
+
+	// failing to read the object is still an error
+	handler = storageHandler(setting.Storage{}, "avatars", &brokenStorage{objStore})(http.NotFoundHandler())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatars/unknown", nil))
+	assert.Contains(t, read(), "Error whilst sending avatars unknown")
+}
+
+// brokenObject is an object of unknown size whose reads fail after the first one
+type brokenObject struct {
+	brokenReader
+}
+
+func (o *brokenObject) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (o *brokenObject) Close() error                                 { return nil }
+func (o *brokenObject) Stat() (os.FileInfo, error)                   { return nil, errors.New("size unknown") }
+
+// brokenStorage is a storage whose objects are broken
+type brokenStorage struct {
+	*memoryStorage
+}
+
+func (s *brokenStorage) Open(p string) (storage.Object, error) {
+	return &brokenObject{}, nil
+}
+
+func TestStorageHandlerIfRange(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "0123456789"})
+	handler := storageHandler(setting.Storage{AcceptRanges: true}, "avatars", objStore, nil)
+
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "0123456789", resp.Body.String())
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// matching validator continues the partial download
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("If-Range", etag)
+	resp = serveStorage(handler, req)
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes 4-9/10", resp.Header().Get("Content-Range"))
+	assert.Equal(t, "456789", resp.Body.String())
+
+	req = httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("If-Range", objStore.modTime.Format(http.TimeFormat))
+	resp = serveStorage(handler, req)
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "456789", resp.Body.String())
+
+	// the object has changed so the whole body must be sent again
+	req = httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("If-Range", `"stale"`)
+	resp = serveStorage(handler, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Content-Range"))
+	assert.Equal(t, "0123456789", resp.Body.String())
+
+	req = httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("If-Range", objStore.modTime.Add(-time.Hour).Format(http.TimeFormat))
+	resp = serveStorage(handler, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "0123456789", resp.Body.String())
+}
+
+func TestStorageHandlerRangeNotSatisfiable(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	handler := storageHandler(setting.Storage{AcceptRanges: true}, "avatars", objStore)
+
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=99999999-")
+	resp := serveStorage(handler, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.Code)
+	assert.Equal(t, "bytes */6", resp.Header().Get("Content-Range"))
+	assert.NotContains(t, resp.Body.String(), "avatar")
+
+	req = httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=2-")
+	resp = serveStorage(handler, req)
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes 2-5/6", resp.Header().Get("Content-Range"))
+	assert.Equal(t, "atar", resp.Body.String())
+}
+
+func TestStorageHandlerAcceptRanges(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "0123456789"})
+	serve := func(acceptRanges bool, method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/avatars/1234", nil)
+		req.Header.Set("Range", "bytes=4-")
+		return serveStorage(storageHandler(setting.Storage{AcceptRanges: acceptRanges}, "avatars", objStore), req)
+	}
+
+	resp := serve(true, "GET")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes", resp.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "456789", resp.Body.String())
+	assert.Equal(t, "bytes", serve(true, "HEAD").Header().Get("Accept-Ranges"))
+
+	// without ranges the whole object is sent
+	resp = serve(false, "GET")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Header(), "Accept-Ranges")
+	assert.Empty(t, resp.Header().Get("Content-Range"))
+	assert.Equal(t, "10", resp.Header().Get("Content-Length"))
+	assert.Equal(t, "0123456789", resp.Body.String())
+	resp = serve(false, "HEAD")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Header(), "Accept-Ranges")
+}
+
+// unseekableObject is an object which cannot seek, as with some object stores
+type unseekableObject struct {
+	*memoryObject
+}
+
+func (o unseekableObject) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("seeking is not supported")
+}
+
+// unseekableStorage is a storage whose objects cannot seek
+type unseekableStorage struct {
+	*memoryStorage
+}
+
+func (s *unseekableStorage) Open(p string) (storage.Object, error) {
+	obj, err := s.memoryStorage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return unseekableObject{obj.(*memoryObject)}, nil
+}
+
+func TestStorageHandlerUnseekable(t *testing.T) {
+	objStore := &unseekableStorage{newMemoryStorage(map[string]string{"1234": "avatar"})}
+	handler := storageHandler(setting.Storage{}, "avatars", objStore)
+
+	// the range is ignored rather than failing the request
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=99999999-")
+	resp := serveStorage(handler, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "6", resp.Header().Get("Content-Length"))
+	assert.Empty(t, resp.Header().Get("Content-Range"))
+	assert.NotEmpty(t, resp.Header().Get("ETag"))
+	assert.Equal(t, "avatar", resp.Body.String())
+}
+
+func TestStorageHandlerFallback(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"new": "new avatar"})
+	fallback := newMemoryStorage(map[string]string{"old": "old avatar"})
+
+	for _, serveDirect := range []bool{false, true} {
+		handler := storageHandler(setting.Storage{ServeDirect: serveDirect}, "avatars", objStore, fallback)
+
+		resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/new", nil))
+		if serveDirect {
+			assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+			assert.Equal(t, "https://storage.example.com/new", resp.Header().Get("Location"))
+		} else {
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, "new avatar", resp.Body.String())
+		}
+
+		// only found in the fallback storage
+		resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/old", nil))
+		if serveDirect {
+			assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+			assert.Equal(t, "https://storage.example.com/old", resp.Header().Get("Location"))
+		} else {
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, "old avatar", resp.Body.String())
+		}
+
+		resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/missing", nil))
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestStorageHandlerContentDisposition(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"a/b/1234": "data"})
+	for p, filename := range map[string]string{"named": "gitea-1.13.0-linux-amd64", "unicode": "rapport été \"final\".pdf"} {
+		_, err := storage.SaveWithFilename(objStore, p, strings.NewReader("data"), filename)
+		assert.NoError(t, err)
+	}
+	// avatars are saved with the name of their user or repository
+	assert.NoError(t, storage.SaveFromWithFilename(objStore, "5c5fc2ee2b8d3db7ee7c5e06bb6a2fb4", "user2.png", func(w io.Writer) error {
+		_, err := w.Write([]byte("avatar"))
+		return err
+	}))
+	handler := storageHandler(setting.Storage{}, "avatars", objStore, nil)
+
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/5c5fc2ee2b8d3db7ee7c5e06bb6a2fb4", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "avatar", resp.Body.String())
+	assert.Equal(t, `inline; filename="user2.png"`, resp.Header().Get("Content-Disposition"))
+
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/named", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `inline; filename="gitea-1.13.0-linux-amd64"`, resp.Header().Get("Content-Disposition"))
+
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/unicode", nil))
+	assert.Equal(t, `inline; filename="rapport _t_ \"final\".pdf"; filename*=UTF-8''rapport%20%C3%A9t%C3%A9%20%22final%22.pdf`, resp.Header().Get("Content-Disposition"))
+	assert.Equal(t, "application/pdf", resp.Header().Get("Content-Type"))
+
+	// without a stored filename the base name of the path is used
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/a/b/1234", nil))
+	assert.Equal(t, `inline; filename="1234"`, resp.Header().Get("Content-Disposition"))
+}
+
+func TestStorageHandlerNotCompressed(t *testing.T) {
+	defer func(algorithms []string) { setting.CompressionAlgorithms = algorithms }(setting.CompressionAlgorithms)
+	setting.CompressionAlgorithms = []string{"br", "gzip", "deflate"}
+
+	content := strings.Repeat("0123456789", 1000)
+	objStore := newMemoryStorage(map[string]string{"a/b/1234": content})
+	handler := storageHandler(setting.Storage{AcceptRanges: true}, "avatars", objStore, nil)
+	compressed := func(next http.Handler) http.Handler {
+		return compressResponses(setting.CompressionAlgorithms, []string{"/avatars", "/repo-avatars"})(handler(next))
+	}
+
+	req := httptest.NewRequest("GET", "/avatars/a/b/1234", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=100-199")
+	resp := serveStorage(compressed, req)
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes 100-199/10000", resp.Header().Get("Content-Range"))
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, "100", resp.Header().Get("Content-Length"))
+	assert.Equal(t, content[100:200], resp.Body.String())
+
+	req = httptest.NewRequest("GET", "/avatars/a/b/1234", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	resp = serveStorage(compressed, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, "10000", resp.Header().Get("Content-Length"))
+	assert.Equal(t, content, resp.Body.String())
+}
+
+func TestStorageHandlerContentLength(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"known": "0123456789", "unknown": "0123456789"})
+	objStore.unknownSize["unknown"] = true
+	handler := storageHandler(setting.Storage{}, "avatars", objStore, nil)
+
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/known", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Content-Length"))
+	assert.Equal(t, "0123456789", resp.Body.String())
+
+	// the size is unknown so the object is streamed without a Content-Length, i.e. chunked
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/unknown", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Content-Length"))
+	assert.Empty(t, resp.Header().Get("ETag"))
+	assert.Equal(t, "0123456789", resp.Body.String())
+}
+
+func TestStorageHandlerEmptyObject(t *testing.T) {
+	objects := map[string]string{"1234": "", "5678.png": ""}
+	for _, objStore := range []storage.ObjectStorage{newMemoryStorage(objects), &unseekableStorage{newMemoryStorage(objects)}} {
+		handler := storageHandler(setting.Storage{}, "avatars", objStore)
+
+		// the type is not sniffed from the empty body
+		resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "0", resp.Header().Get("Content-Length"))
+		assert.Equal(t, "application/octet-stream", resp.Header().Get("Content-Type"))
+		assert.Empty(t, resp.Body.String())
+
+		resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/5678.png", nil))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "0", resp.Header().Get("Content-Length"))
+		assert.Equal(t, "image/png", resp.Header().Get("Content-Type"))
+		assert.Empty(t, resp.Body.String())
+	}
+}
+
+func TestStorageHandlerHead(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"a/b/1234": "0123456789", "unknown": "0123456789"})
+	objStore.unknownSize["unknown"] = true
+	_, err := storage.SaveWithFilename(objStore, "a/b/5678", strings.NewReader("data"), "report.pdf")
+	assert.NoError(t, err)
+	// Open must not be needed for HEAD requests
+	opened := &openCountingStorage{memoryStorage: objStore}
+	handler := storageHandler(setting.Storage{}, "attachments", opened, nil)
+
+	resp := serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/a/b/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Content-Length"))
+	assert.NotEmpty(t, resp.Header().Get("ETag"))
+	assert.Equal(t, "Sun, 01 Nov 2020 12:00:00 GMT", resp.Header().Get("Last-Modified"))
+	assert.Empty(t, resp.Body.String())
+
+	get := serveStorage(handler, httptest.NewRequest("GET", "/attachments/a/b/1234", nil))
+	assert.Equal(t, get.Header().Get("ETag"), resp.Header().Get("ETag"))
+	opened.count = 0
+
+	resp = serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/a/b/5678", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/pdf", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename="report.pdf"`, resp.Header().Get("Content-Disposition"))
+
+	etag := get.Header().Get("ETag")
+	for _, test := range []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"If-None-Match", "W/" + etag, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", "Sun, 01 Nov 2020 12:00:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Mon, 02 Nov 2020 12:00:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Sat, 31 Oct 2020 12:00:00 GMT", http.StatusOK},
+	} {
+		req := httptest.NewRequest("HEAD", "/attachments/a/b/1234", nil)
+		req.Header.Set(test.header, test.value)
+		assert.Equal(t, test.status, serveStorage(handler, req).Code, "%s: %s", test.header, test.value)
+	}
+	// If-Modified-Since is ignored if there is an If-None-Match
+	req := httptest.NewRequest("HEAD", "/attachments/a/b/1234", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	req.Header.Set("If-Modified-Since", "Mon, 02 Nov 2020 12:00:00 GMT")
+	assert.Equal(t, http.StatusOK, serveStorage(handler, req).Code)
+
+	assert.Equal(t, http.StatusNotFound, serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/missing", nil)).Code)
+	assert.Zero(t, opened.count)
+
+	// objects without info are still answered by opening them
+	resp = serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/unknown", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 1, opened.count)
+	// but not read
+	assert.Empty(t, resp.Body.String())
+}
+
+// presigningStorage signs URLs without checking that the objects exist, like the minio storage
+type presigningStorage struct {
+	*memoryStorage
+}
+
+func (s *presigningStorage) URL(p, name string) (*url.URL, error) {
+	return url.Parse("https://storage.example.com/" + strings.TrimPrefix(p, "/") + "?X-Amz-Signature=0123")
+}
+
+func TestStorageHandlerServeDirectHead(t *testing.T) {
+	objStore := &presigningStorage{newMemoryStorage(map[string]string{"1234": "avatar"})}
+	handler := storageHandler(setting.Storage{ServeDirect: true}, "avatars", objStore)
+
+	resp := serveStorage(handler, httptest.NewRequest("HEAD", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+	assert.Equal(t, "https://storage.example.com/1234?X-Amz-Signature=0123", resp.Header().Get("Location"))
+
+	// missing objects are not redirected to
+	resp = serveStorage(handler, httptest.NewRequest("HEAD", "/avatars/missing", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+
+	// GET requests are redirected straight away, leaving it to the storage to answer them
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/missing", nil))
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+}
+
+func TestStorageHandlerSubURL(t *testing.T) {
+	defer func(subURL string) {
+		setting.AppSubURL = subURL
+	}(setting.AppSubURL)
+	setting.AppSubURL = "/gitea"
+
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	copied := storageHandler(setting.Storage{}, "avatars", objStore)
+	direct := storageHandler(setting.Storage{ServeDirect: true}, "avatars", &presigningStorage{objStore})
+
+	for _, p := range []string{"/gitea/avatars/1234", "/avatars/1234"} {
+		resp := serveStorage(copied, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, p)
+		assert.Equal(t, "avatar", resp.Body.String(), p)
+
+		resp = serveStorage(direct, httptest.NewRequest("GET", p, nil))
+		assert.Equal(t, http.StatusMovedPermanently, resp.Code, p)
+		assert.Equal(t, "https://storage.example.com/1234?X-Amz-Signature=0123", resp.Header().Get("Location"), p)
+	}
+
+	resp := serveStorage(direct, httptest.NewRequest("HEAD", "/gitea/avatars/missing", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+
+	// the other routes below the sub-path are left alone
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("next"))
+	})
+	for _, handler := range []func(next http.Handler) http.Handler{copied, direct} {
+		resp := httptest.NewRecorder()
+		handler(next).ServeHTTP(resp, httptest.NewRequest("GET", "/gitea/user2", nil))
+		assert.Equal(t, "next", resp.Body.String())
+	}
+}
+
+// fixedURLStorage returns the same URL for every object, like a misconfigured storage
+type fixedURLStorage struct {
+	*memoryStorage
+	url string
+}
+
+func (s *fixedURLStorage) URL(p, name string) (*url.URL, error) {
+	return url.Parse(s.url)
+}
+
+func TestStorageHandlerServeDirectValidation(t *testing.T) {
+	read, reset := captureLog(t, log.DEFAULT)
+	defer reset()
+
+	serve := func(storageURL string, allowedHosts ...string) *httptest.ResponseRecorder {
+		objStore := &fixedURLStorage{newMemoryStorage(map[string]string{"1234": "avatar"}), storageURL}
+		handler := storageHandler(setting.Storage{ServeDirect: true, AllowedRedirectHosts: allowedHosts}, "avatars", objStore)
+		return serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+	}
+
+	for _, tc := range []struct {
+		url          string
+		allowedHosts []string
+		status       int
+	}{
+		{"https://storage.example.com/1234", nil, http.StatusMovedPermanently},
+		{"https://storage.example.com/1234", []string{"cdn.example.com", " Storage.Example.com:443"}, http.StatusMovedPermanently},
+		{"http://[2001:db8::10]:9000/1234", []string{"[2001:db8::10]"}, http.StatusMovedPermanently},
+		{"/gitea/avatars/1234", nil, http.StatusInternalServerError},
+		{"storage.example.com/1234", nil, http.StatusInternalServerError},
+		{"ftp://storage.example.com/1234", nil, http.StatusInternalServerError},
+		{"javascript:alert(1)", nil, http.StatusInternalServerError},
+		{"https://evil.example.com/1234", []string{"storage.example.com"}, http.StatusInternalServerError},
+		{"https://storage.example.com.evil.example.com/1234", []string{"storage.example.com"}, http.StatusInternalServerError},
+	} {
+		resp := serve(tc.url, tc.allowedHosts...)
+		assert.Equal(t, tc.status, resp.Code, tc.url)
+		if tc.status == http.StatusMovedPermanently {
+			assert.Equal(t, tc.url, resp.Header().Get("Location"), tc.url)
+		} else {
+			assert.Empty(t, resp.Header().Get("Location"), tc.url)
+		}
+	}
+	logged := read()
+	assert.Contains(t, logged, `Error whilst validating URL for avatars /1234. Error: "/gitea/avatars/1234" is not an absolute URL`)
+	assert.Contains(t, logged, `the host of "https://evil.example.com/1234" is not one of the ALLOWED_REDIRECT_HOSTS`)
+}
+
+// storageBytesServed returns the bytes served from the storage of the prefix so far
+func storageBytesServed(t *testing.T, prefix string) float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.StorageBytesServed)
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "prefix" && label.GetValue() == prefix {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestStorageHandlerBytesServed(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	handler := storageHandler(setting.Storage{AcceptRanges: true}, "avatars", objStore)
+
+	before := storageBytesServed(t, "avatars")
+	assert.Equal(t, http.StatusOK, serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil)).Code)
+	assert.Equal(t, before+6, storageBytesServed(t, "avatars"))
+
+	// only the bytes of a range are sent
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	assert.Equal(t, http.StatusPartialContent, serveStorage(handler, req).Code)
+	assert.Equal(t, before+8, storageBytesServed(t, "avatars"))
+
+	assert.Equal(t, http.StatusOK, serveStorage(handler, httptest.NewRequest("HEAD", "/avatars/1234", nil)).Code)
+	assert.Equal(t, before+8, storageBytesServed(t, "avatars"))
+
+	// even with the metrics objects served directly are redirected to without asking the storage for their size
+	defer func(enabled bool) { setting.Metrics.Enabled = enabled }(setting.Metrics.Enabled)
+	setting.Metrics.Enabled = true
+	before = storageBytesServed(t, "repo-avatars")
+	statted := &statCountingStorage{ObjectStorage: &presigningStorage{newMemoryStorage(map[string]string{"1234": "repo avatar"})}}
+	direct := storageHandler(setting.Storage{ServeDirect: true}, "repo-avatars", statted)
+	assert.Equal(t, http.StatusMovedPermanently, serveStorage(direct, httptest.NewRequest("GET", "/repo-avatars/1234", nil)).Code)
+	assert.Equal(t, 0, statted.count)
+	assert.Equal(t, before, storageBytesServed(t, "repo-avatars"))
+}
+
+// openCountingStorage counts the objects opened in the wrapped storage
+type openCountingStorage struct {
+	*memoryStorage
+	count int
+}
+
+func (s *openCountingStorage) Open(p string) (storage.Object, error) {
+	s.count++
+	return s.memoryStorage.Open(p)
+}
+
+// statCountingStorage counts the infos got from the wrapped storage
+type statCountingStorage struct {
+	storage.ObjectStorage
+	count int
+}
+
+func (s *statCountingStorage) Stat(p string) (os.FileInfo, error) {
+	s.count++
+	return s.ObjectStorage.Stat(p)
+}
+
+// failingStorage is a storage whose requests fail with err
+type failingStorage struct {
+	*memoryStorage
+	err error
+}
+
+func (s *failingStorage) Open(p string) (storage.Object, error) {
+	return nil, s.err
+}
+
+func (s *failingStorage) Stat(p string) (os.FileInfo, error) {
+	return nil, s.err
+}
+
+func (s *failingStorage) URL(p, name string) (*url.URL, error) {
+	return nil, s.err
+}
+
+func TestStorageHandlerServeViaXAccel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local, err := storage.NewLocalStorage(context.Background(), storage.LocalStorageConfig{Path: dir})
+	assert.NoError(t, err)
+	_, err = local.Save("ab/report.pdf", strings.NewReader("report"))
+	assert.NoError(t, err)
+	fallback := newMemoryStorage(map[string]string{"old": "migrating"})
+
+	storageSetting := setting.Storage{Path: dir, ServeViaXAccel: true, XAccelHeader: "X-Accel-Redirect", XAccelLocation: "/internal/attachments"}
+	handler := storageHandler(storageSetting, "attachments", local, fallback)
+
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/attachments/ab/report.pdf", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "/internal/attachments/ab/report.pdf", resp.Header().Get("X-Accel-Redirect"))
+	assert.Equal(t, "application/pdf", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename="report.pdf"`, resp.Header().Get("Content-Disposition"))
+	assert.Empty(t, resp.Body.String())
+
+	storageSetting.XAccelHeader = "X-Sendfile"
+	resp = serveStorage(storageHandler(storageSetting, "attachments", local, fallback), httptest.NewRequest("GET", "/attachments/ab/report.pdf", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, filepath.Join(dir, "ab", "report.pdf"), resp.Header().Get("X-Sendfile"))
+	assert.Empty(t, resp.Body.String())
+
+	// HEAD requests are handed over too
+	resp = serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/ab/report.pdf", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "/internal/attachments/ab/report.pdf", resp.Header().Get("X-Accel-Redirect"))
+	assert.Empty(t, resp.Body.String())
+
+	// objects only in the fallback storage and missing objects are answered by Gitea
+	resp = serveStorage(handler, httptest.NewRequest("HEAD", "/attachments/old", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "9", resp.Header().Get("Content-Length"))
+	assert.Empty(t, resp.Header().Get("X-Accel-Redirect"))
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/attachments/old", nil))
+	assert.Equal(t, "migrating", resp.Body.String())
+	assert.Empty(t, resp.Header().Get("X-Accel-Redirect"))
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/attachments/missing", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, resp.Header().Get("X-Accel-Redirect"))
+
+	// storages which are not local are never handed over
+	resp = serveStorage(storageHandler(storageSetting, "attachments", fallback), httptest.NewRequest("GET", "/attachments/old", nil))
+	assert.Equal(t, "migrating", resp.Body.String())
+	assert.Empty(t, resp.Header().Get("X-Sendfile"))
+}
+
+func TestStorageHandlerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{os.ErrNotExist, http.StatusNotFound, ""},
+		{fmt.Errorf("open avatar: %w", os.ErrPermission), http.StatusForbidden, ""},
+		{storage.ErrThrottled{}, http.StatusServiceUnavailable, storageRetryAfter},
+		{errors.New("connection reset"), http.StatusInternalServerError, ""},
+	} {
+		objStore := &failingStorage{memoryStorage: newMemoryStorage(nil), err: tc.err}
+		for _, serveDirect := range []bool{false, true} {
+			handler := storageHandler(setting.Storage{ServeDirect: serveDirect}, "avatars", objStore, nil)
+			for _, method := range []string{"GET", "HEAD"} {
+				resp := serveStorage(handler, httptest.NewRequest(method, "/avatars/1234", nil))
+				assert.Equal(t, tc.status, resp.Code, "%v %s %v", tc.err, method, serveDirect)
+				assert.Equal(t, tc.retryAfter, resp.Header().Get("Retry-After"), "%v %s %v", tc.err, method, serveDirect)
+			}
+		}
+	}
+}
+
+func TestStorageHandlerTombstones(t *testing.T) {
+	defer RegisterStorageTombstones("avatars", nil)
+	objStore := &presigningStorage{newMemoryStorage(map[string]string{"1234": "avatar"})}
+	handler := storageHandler(setting.Storage{}, "avatars", objStore)
+	// GET requests are redirected without checking for the object, so only HEAD requests can tell deleted objects
+	directHandler := storageHandler(setting.Storage{ServeDirect: true}, "avatars", objStore)
+	serve := func(handler func(next http.Handler) http.Handler, method, p string) int {
+		return serveStorage(handler, httptest.NewRequest(method, p, nil)).Code
+	}
+
+	// without a lookup deleted objects are not found like any other
+	assert.Equal(t, http.StatusNotFound, serve(handler, "GET", "/avatars/5678"))
+
+	RegisterStorageTombstones("avatars", func(p string) bool {
+		return p == "5678"
+	})
+	assert.Equal(t, http.StatusGone, serve(handler, "GET", "/avatars/5678"))
+	assert.Equal(t, http.StatusGone, serve(handler, "HEAD", "/avatars/5678"))
+	assert.Equal(t, http.StatusGone, serve(directHandler, "HEAD", "/avatars/5678"))
+	assert.Equal(t, http.StatusNotFound, serve(handler, "GET", "/avatars/9012"))
+	assert.Equal(t, http.StatusNotFound, serve(handler, "HEAD", "/avatars/9012"))
+	assert.Equal(t, http.StatusNotFound, serve(directHandler, "HEAD", "/avatars/9012"))
+
+	// objects which exist are served whatever the lookup says
+	RegisterStorageTombstones("avatars", func(p string) bool {
+		return true
+	})
+	assert.Equal(t, http.StatusOK, serve(handler, "GET", "/avatars/1234"))
+	assert.Equal(t, http.StatusMovedPermanently, serve(directHandler, "HEAD", "/avatars/1234"))
+}
+
+func TestStorageHandlerProblemDetails(t *testing.T) {
+	defer func(paths []string) {
+		setting.ProblemDetailsPaths = paths
+	}(setting.ProblemDetailsPaths)
+	setting.ProblemDetailsPaths = []string{"/api/", "/attachments/"}
+
+	handler := storageHandler(setting.Storage{}, "attachments", newMemoryStorage(nil), nil)
+	req := httptest.NewRequest("GET", "/attachments/missing", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	resp := serveStorage(handler, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"detail":"file not found","instance":"/attachments/missing"}`, resp.Body.String())
+}
+
+func TestStorageHandlerNoCache(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	fi, err := objStore.Stat("1234")
+	assert.NoError(t, err)
+	etag := storageETag(fi)
+	handler := storageHandler(setting.Storage{}, "avatars", objStore)
+	newRequest := func(method string, header ...string) *http.Request {
+		req := httptest.NewRequest(method, "/avatars/1234", nil)
+		req.Header.Set("If-None-Match", etag)
+		req.Header.Set("If-Modified-Since", "Sun, 01 Nov 2020 12:00:00 GMT")
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		return req
+	}
+
+	assert.Equal(t, http.StatusNotModified, serveStorage(handler, newRequest("GET")).Code)
+	assert.Equal(t, http.StatusNotModified, serveStorage(handler, newRequest("HEAD")).Code)
+
+	for _, header := range [][]string{
+		{"Cache-Control", "no-cache"},
+		{"Cache-Control", "max-age=0, No-Cache"},
+		{"Pragma", "no-cache"},
+	} {
+		resp := serveStorage(handler, newRequest("GET", header...))
+		assert.Equal(t, http.StatusOK, resp.Code, "%v", header)
+		assert.Equal(t, "avatar", resp.Body.String(), "%v", header)
+		// the validators are still sent for the next request
+		assert.Equal(t, etag, resp.Header().Get("ETag"), "%v", header)
+		assert.Equal(t, "Sun, 01 Nov 2020 12:00:00 GMT", resp.Header().Get("Last-Modified"), "%v", header)
+
+		assert.Equal(t, http.StatusOK, serveStorage(handler, newRequest("HEAD", header...)).Code, "%v", header)
+	}
+
+	// Pragma is ignored if the client sends a Cache-Control
+	assert.Equal(t, http.StatusNotModified, serveStorage(handler, newRequest("GET", "Cache-Control", "max-age=60", "Pragma", "no-cache")).Code)
+}
+
+func TestStorageHandlerCacheHeaders(t *testing.T) {
+	objStore := newMemoryStorage(map[string]string{"1234": "avatar"})
+	storageSetting := setting.Storage{
+		CacheControl: "public, max-age=86400, s-maxage=604800, immutable",
+		Vary:         "Accept-Encoding",
+	}
+
+	handler := storageHandler(storageSetting, "avatars", objStore, nil)
+	for _, method := range []string{"GET", "HEAD"} {
+		resp := serveStorage(handler, httptest.NewRequest(method, "/avatars/1234", nil))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, storageSetting.CacheControl, resp.Header().Get("Cache-Control"), method)
+		assert.Equal(t, "Accept-Encoding", resp.Header().Get("Vary"), method)
+	}
+
+	// missing objects must not be cached for as long as the objects
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/missing", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Empty(t, resp.Header().Get("Cache-Control"))
+
+	// the redirects are cached only briefly as the signed URLs expire
+	storageSetting.ServeDirect = true
+	handler = storageHandler(storageSetting, "avatars", objStore, nil)
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+	assert.Equal(t, "public, max-age=60, s-maxage=60", resp.Header().Get("Cache-Control"))
+	assert.Equal(t, "Accept-Encoding", resp.Header().Get("Vary"))
+
+	handler = storageHandler(setting.Storage{ServeDirect: true}, "avatars", objStore, nil)
+	resp = serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, "private, max-age=60", resp.Header().Get("Cache-Control"))
+	assert.Empty(t, resp.Header().Get("Vary"))
+
+	assert.Equal(t, "private, max-age=30", storageRedirectCacheControl("private, max-age=30"))
+	assert.Equal(t, "no-cache", storageRedirectCacheControl("no-cache"))
+}
+
+// regionalStorage serves objects directly from an endpoint per region
+type regionalStorage struct {
+	*memoryStorage
+}
+
+func (s *regionalStorage) RegionURL(p, name, region string) (*url.URL, error) {
+	if _, err := s.URL(p, name); err != nil {
+		return nil, err
+	}
+	return url.Parse("https://" + region + ".storage-accelerate.example.com/" + strings.TrimPrefix(p, "/"))
+}
+
+func TestStorageHandlerStores(t *testing.T) {
+	s3 := newMemoryStorage(map[string]string{"migrated": "migrated avatar", "both": "new copy"})
+	s3.baseURL = "https://s3.example.com/"
+	local := newMemoryStorage(map[string]string{"local": "local avatar", "both": "old copy"})
+	local.baseURL = "https://local.example.com/"
+	old := newMemoryStorage(map[string]string{"old": "old avatar"})
+	old.baseURL = "https://old.example.com/"
+
+	for _, tc := range []struct {
+		p, body, location string
+	}{
+		{"migrated", "migrated avatar", "https://s3.example.com/migrated"},
+		{"both", "new copy", "https://s3.example.com/both"},
+		{"local", "local avatar", "https://local.example.com/local"},
+		{"old", "old avatar", "https://old.example.com/old"},
+	} {
+		resp := serveStorage(storageHandler(setting.Storage{}, "avatars", s3, nil, local, old), httptest.NewRequest("GET", "/avatars/"+tc.p, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, tc.p)
+		assert.Equal(t, tc.body, resp.Body.String(), tc.p)
+
+		resp = serveStorage(storageHandler(setting.Storage{}, "avatars", s3, nil, local, old), httptest.NewRequest("HEAD", "/avatars/"+tc.p, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, tc.p)
+		assert.Equal(t, strconv.Itoa(len(tc.body)), resp.Header().Get("Content-Length"), tc.p)
+
+		// objects served directly are redirected to the store which has them
+		resp = serveStorage(storageHandler(setting.Storage{ServeDirect: true}, "avatars", s3, nil, local, old), httptest.NewRequest("GET", "/avatars/"+tc.p, nil))
+		assert.Equal(t, http.StatusMovedPermanently, resp.Code, tc.p)
+		assert.Equal(t, tc.location, resp.Header().Get("Location"), tc.p)
+	}
+
+	resp := serveStorage(storageHandler(setting.Storage{}, "avatars", s3, local, old), httptest.NewRequest("GET", "/avatars/missing", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	// other errors are not hidden by the next store
+	failing := &failingStorage{memoryStorage: newMemoryStorage(nil), err: os.ErrPermission}
+	resp = serveStorage(storageHandler(setting.Storage{}, "avatars", failing, old), httptest.NewRequest("GET", "/avatars/old", nil))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// without any store nothing is found
+	resp = serveStorage(storageHandler(setting.Storage{}, "avatars", nil), httptest.NewRequest("GET", "/avatars/old", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestStorageHandlerServeDirectRegion(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"loopback"})
+	objStore := &regionalStorage{newMemoryStorage(map[string]string{"1234": "avatar"})}
+	handler := storageHandler(setting.Storage{ServeDirect: true, ServeDirectRegionHeader: "X-Client-Region"}, "avatars", objStore, nil)
+
+	serve := func(remoteAddr, region string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatars/1234", nil)
+		req.RemoteAddr = remoteAddr
+		if region != "" {
+			req.Header.Set("X-Client-Region", region)
+		}
+		return serveStorage(handler, withTrustedProxies(req, trusted))
+	}
+
+	resp := serve("127.0.0.1:4321", "eu")
+	assert.Equal(t, http.StatusMovedPermanently, resp.Code)
+	assert.Equal(t, "https://eu.storage-accelerate.example.com/1234", resp.Header().Get("Location"))
+	assert.Equal(t, "X-Client-Region", resp.Header().Get("Vary"))
+
+	// without a region, or one set by the client itself, the default endpoint is used
+	assert.Equal(t, "https://storage.example.com/1234", serve("127.0.0.1:4321", "").Header().Get("Location"))
+	assert.Equal(t, "https://storage.example.com/1234", serve("203.0.113.7:4321", "eu").Header().Get("Location"))
+
+	// storages without region endpoints ignore the region
+	handler = storageHandler(setting.Storage{ServeDirect: true, ServeDirectRegionHeader: "X-Client-Region"}, "avatars", objStore.memoryStorage, nil)
+	assert.Equal(t, "https://storage.example.com/1234", serve("127.0.0.1:4321", "eu").Header().Get("Location"))
+}
+
+// brokenReader fails after the first read, like a connection to the storage dropping mid-stream
+type brokenReader struct {
+	read bool
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, errors.New("connection reset")
+	}
+	r.read = true
+	return copy(p, "partial"), nil
+}
+
+// blockingStorage is a storage whose objects cannot be opened until unblock is closed
+type blockingStorage struct {
+	*memoryStorage
+	opened  chan string
+	unblock chan struct{}
+}
+
+func (s *blockingStorage) Open(p string) (storage.Object, error) {
+	s.opened <- p
+	<-s.unblock
+	return s.memoryStorage.Open(p)
+}
+
+func TestStorageHandlerMaxConcurrentPerIP(t *testing.T) {
+	objStore := &blockingStorage{
+		memoryStorage: newMemoryStorage(map[string]string{"1234": "avatar"}),
+		opened:        make(chan string, 10),
+		unblock:       make(chan struct{}),
+	}
+	handler := storageHandler(setting.Storage{MaxConcurrentPerIP: 2, MaxConcurrentPerIPSignedIn: 3}, "avatars", objStore)
+
+	defer func(signedIn func(*http.Request) bool) {
+		downloadSignedIn = signedIn
+	}(downloadSignedIn)
+	var lookups int32
+	downloadSignedIn = func(req *http.Request) bool {
+		atomic.AddInt32(&lookups, 1)
+		return req.Header.Get("Authorization") == "token valid"
+	}
+
+	newRequest := func(remote, token string) *http.Request {
+		req := httptest.NewRequest("GET", "/avatars/1234", nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: setting.SessionConfig.CookieName, Value: "session"})
+			req.Header.Set("Authorization", "token "+token)
+		}
+		return req
+	}
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	start := func(req *http.Request) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serveStorage(handler, req).Code
+		}()
+		<-objStore.opened
+	}
+
+	// the token is only looked up once the slots of anonymous clients are used up
+	start(newRequest("203.0.113.7:41234", "valid"))
+	start(newRequest("203.0.113.7:41235", ""))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&lookups))
+	resp := serveStorage(handler, newRequest("203.0.113.7:41236", ""))
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+
+	// a session cookie or a token which is not valid does not get a client more slots
+	assert.Equal(t, http.StatusTooManyRequests, serveStorage(handler, newRequest("203.0.113.7:41237", "0123")).Code)
+
+	// a valid token gets it the signed in limit
+	start(newRequest("203.0.113.7:41238", "valid"))
+	assert.Equal(t, http.StatusTooManyRequests, serveStorage(handler, newRequest("203.0.113.7:41239", "valid")).Code)
+
+	// other IPs have their own slots
+	start(newRequest("198.51.100.3:41234", ""))
+
+	close(objStore.unblock)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+}
+
+func TestDownloadLimiterRelease(t *testing.T) {
+	limiter := newDownloadLimiter(1, 1)
+	newRequest := func(ctx context.Context) *http.Request {
+		req := httptest.NewRequest("GET", "/avatars/1234", nil).WithContext(ctx)
+		req.RemoteAddr = "203.0.113.7:41234"
+		return req
+	}
+
+	release, ok := limiter.acquire(newRequest(context.Background()))
+	assert.True(t, ok)
+	_, ok = limiter.acquire(newRequest(context.Background()))
+	assert.False(t, ok)
+	release()
+	release()
+	assert.Empty(t, limiter.inFlight)
+
+	// the slot of a client which went away is given back before the handler is done with it
+	ctx, cancel := context.WithCancel(context.Background())
+	release, ok = limiter.acquire(newRequest(ctx))
+	assert.True(t, ok)
+	cancel()
+	assert.Eventually(t, func() bool {
+		next, ok := limiter.acquire(newRequest(context.Background()))
+		if ok {
+			next()
+		}
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	release()
+	assert.Empty(t, limiter.inFlight)
+
+	// without limits there is nothing to keep track of
+	assert.Nil(t, newDownloadLimiter(0, 0))
+}
+
+func TestCopyBufferPool(t *testing.T) {
+	buffers := newCopyBufferPool(1024)
+
+	var out bytes.Buffer
+	n, err := buffers.copy(struct{ io.Writer }{&out}, io.LimitReader(strings.NewReader(strings.Repeat("a", 4096)), 4096))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4096, n)
+	assert.Equal(t, 4096, out.Len())
+	assert.EqualValues(t, 0, buffers.inUse)
+
+	// the buffer is returned when the copy fails mid-stream
+	out.Reset()
+	_, err = buffers.copy(struct{ io.Writer }{&out}, &brokenReader{})
+	assert.Error(t, err)
+	assert.Equal(t, "partial", out.String())
+	assert.EqualValues(t, 0, buffers.inUse)
+
+	// the copies of ServeContent use the pool too
+	resp := httptest.NewRecorder()
+	w := pooledCopyWriter{resp, buffers}
+	http.ServeContent(w, httptest.NewRequest("GET", "/avatars/1234", nil), "1234", time.Time{}, strings.NewReader("avatar"))
+	assert.Equal(t, "avatar", resp.Body.String())
+	assert.EqualValues(t, 0, buffers.inUse)
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := bytes.Repeat([]byte("a"), 64*1024)
+	// neither side may implement WriterTo or ReaderFrom, as the writers of the middlewares wrapping the responses do not
+	dst := struct{ io.Writer }{ioutil.Discard}
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = io.Copy(dst, io.LimitReader(bytes.NewReader(data), int64(len(data))))
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		buffers := newCopyBufferPool(defaultCopyBufferSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = buffers.copy(dst, io.LimitReader(bytes.NewReader(data), int64(len(data))))
+		}
+	})
+}
+
+func BenchmarkStorageHandler(b *testing.B) {
+	objStore := newMemoryStorage(map[string]string{"1234": strings.Repeat("a", 64*1024)})
+	handler := storageHandler(setting.Storage{}, "avatars", objStore, nil)(http.NotFoundHandler())
+	req := httptest.NewRequest("GET", "/avatars/1234", nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// slowStorage is a storage taking delay to open objects or get their info, signalling the objects closed
+type slowStorage struct {
+	*memoryStorage
+	delay  time.Duration
+	closed chan string
+}
+
+type closeSignallingObject struct {
+	storage.Object
+	p      string
+	closed chan string
+}
+
+func (o *closeSignallingObject) Close() error {
+	o.closed <- o.p
+	return o.Object.Close()
+}
+
+func (s *slowStorage) Open(p string) (storage.Object, error) {
+	time.Sleep(s.delay)
+	obj, err := s.memoryStorage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &closeSignallingObject{Object: obj, p: p, closed: s.closed}, nil
+}
+
+func (s *slowStorage) Stat(p string) (os.FileInfo, error) {
+	time.Sleep(s.delay)
+	return s.memoryStorage.Stat(p)
+}
+
+// cancellableStorage is a storage which takes a context, whose info calls wait until their context is done
+type cancellableStorage struct {
+	*memoryStorage
+	statted   chan struct{}
+	cancelled chan error
+}
+
+func (s *cancellableStorage) StatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	close(s.statted)
+	<-ctx.Done()
+	s.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (s *cancellableStorage) RegionURLContext(ctx context.Context, p, name, region string) (*url.URL, error) {
+	return s.memoryStorage.URL(p, name)
+}
+
+func TestStorageHandlerClientGone(t *testing.T) {
+	objStore := &cancellableStorage{
+		memoryStorage: newMemoryStorage(map[string]string{"1234": "avatar"}),
+		statted:       make(chan struct{}),
+		cancelled:     make(chan error, 1),
+	}
+	handler := storageHandler(setting.Storage{}, "avatars", objStore)
+
+	// without a timeout the call to the storage is still cancelled once the client has gone away
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-objStore.statted
+		cancel()
+	}()
+	serveStorage(handler, httptest.NewRequest("HEAD", "/avatars/1234", nil).WithContext(ctx))
+	select {
+	case err := <-objStore.cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the call to the storage was not cancelled")
+	}
+}
+
+func TestStorageHandlerOperationTimeout(t *testing.T) {
+	objStore := &slowStorage{
+		memoryStorage: newMemoryStorage(map[string]string{"1234": "avatar"}),
+		delay:         100 * time.Millisecond,
+		closed:        make(chan string, 1),
+	}
+	handler := storageHandler(setting.Storage{OperationTimeout: 10 * time.Millisecond}, "avatars", objStore)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		resp := serveStorage(handler, httptest.NewRequest(method, "/avatars/1234", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, resp.Code, method)
+	}
+	// the object opened after the request gave up on it is closed
+	select {
+	case p := <-objStore.closed:
+		assert.Equal(t, "1234", p)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the object opened too late was not closed")
+	}
+
+	// objects are served as usual when the storage responds in time
+	handler = storageHandler(setting.Storage{OperationTimeout: 5 * time.Second}, "avatars", objStore)
+	resp := serveStorage(handler, httptest.NewRequest("GET", "/avatars/1234", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "avatar", resp.Body.String())
+	assert.Equal(t, "1234", <-objStore.closed)
+}
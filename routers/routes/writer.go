@@ -0,0 +1,63 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routes
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// headerHookResponseWriter calls a hook just before the response headers are sent,
+// allowing middlewares to inspect and rewrite the final response headers
+type headerHookResponseWriter struct {
+	http.ResponseWriter
+	hook        func(status int)
+	wroteHeader bool
+}
+
+// onWriteHeader returns a http.ResponseWriter calling hook once, just before the headers are written to w
+func onWriteHeader(w http.ResponseWriter, hook func(status int)) http.ResponseWriter {
+	return &headerHookResponseWriter{ResponseWriter: w, hook: hook}
+}
+
+func (w *headerHookResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.hook(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerHookResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (w *headerHookResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (w *headerHookResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", w.ResponseWriter)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter
+func (w *headerHookResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -5,14 +5,149 @@
 package routers
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/gobwas/glob"
 )
 
 // tplSwaggerV1Json swagger v1 json template
 const tplSwaggerV1Json base.TplName = "swagger/v1_json"
 
+// swaggerFeature is a feature that can be disabled along with the API operations it provides
+type swaggerFeature struct {
+	name    string
+	enabled func() bool
+	// paths are glob patterns of the paths of the spec, e.g. /users/{username}/heatmap is matched by /users/*/heatmap
+	paths []glob.Glob
+	// methods are the operations of the paths that belong to the feature, all of them if empty
+	methods []string
+}
+
+func compileSwaggerPaths(patterns ...string) []glob.Glob {
+	globs := make([]glob.Glob, len(patterns))
+	for i, pattern := range patterns {
+		globs[i] = glob.MustCompile(pattern, '/')
+	}
+	return globs
+}
+
+var swaggerFeatures = []swaggerFeature{
+	{
+		name:    "timetracking",
+		enabled: func() bool { return setting.Service.EnableTimetracking },
+		paths: compileSwaggerPaths(
+			"/repos/*/*/issues/*/stopwatch/*",
+			"/repos/*/*/issues/*/times",
+			"/repos/*/*/issues/*/times/*",
+			"/repos/*/*/times",
+			"/repos/*/*/times/*",
+			"/user/stopwatches",
+			"/user/times",
+		),
+	},
+	{
+		name:    "user-heatmap",
+		enabled: func() bool { return setting.Service.EnableUserHeatmap },
+		paths:   compileSwaggerPaths("/users/*/heatmap"),
+	},
+	{
+		name:    "attachments",
+		enabled: func() bool { return setting.Attachment.Enabled },
+		paths:   compileSwaggerPaths("/repos/*/*/releases/*/assets"),
+		methods: []string{"post"},
+	},
+}
+
+// filterSwaggerSpec removes the operations of the disabled features from the spec, listing the features as
+// x-gitea-disabled-features, and sets its host and scheme to those of the instance
+func filterSwaggerSpec(spec []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	var disabled []string
+	for _, feature := range swaggerFeatures {
+		if feature.enabled() {
+			continue
+		}
+		disabled = append(disabled, feature.name)
+		for path, item := range paths {
+			if !matchesSwaggerPaths(path, feature.paths) {
+				continue
+			}
+			operations, _ := item.(map[string]interface{})
+			for _, method := range feature.methods {
+				delete(operations, method)
+			}
+			if len(feature.methods) == 0 || len(operations) == 0 {
+				delete(paths, path)
+			}
+		}
+	}
+	if len(disabled) > 0 {
+		doc["x-gitea-disabled-features"] = disabled
+	}
+
+	if u, err := url.Parse(setting.AppURL); err == nil && u.Host != "" {
+		doc["host"] = u.Host
+		doc["schemes"] = []string{u.Scheme}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func matchesSwaggerPaths(path string, patterns []glob.Glob) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // SwaggerV1Json render swagger v1 json
 func SwaggerV1Json(ctx *context.Context) {
-	ctx.HTML(200, tplSwaggerV1Json)
+	spec, err := ctx.Render.HTMLString(string(tplSwaggerV1Json), ctx.Data)
+	if err != nil {
+		ctx.ServerError("SwaggerV1Json", err)
+		return
+	}
+	body := []byte(spec)
+	if setting.API.SwaggerFilterFeatures {
+		if body, err = filterSwaggerSpec(body); err != nil {
+			ctx.ServerError("filterSwaggerSpec", err)
+			return
+		}
+	}
+
+	// the spec only changes with the configuration, so clients may keep it as long as they check it is current
+	etag := `"` + base.EncodeSha256(string(body)) + `"`
+	ctx.Resp.Header().Set("ETag", etag)
+	ctx.Resp.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(ctx.Req.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			ctx.Resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	ctx.Resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	ctx.Resp.WriteHeader(http.StatusOK)
+	_, _ = ctx.Resp.Write(body)
 }
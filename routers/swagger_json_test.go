@@ -0,0 +1,75 @@
+// Copyright 2020 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSwaggerSpec = `{
+  "swagger": "2.0",
+  "schemes": ["http", "https"],
+  "basePath": "/api/v1",
+  "paths": {
+    "/version": {"get": {"operationId": "getVersion"}},
+    "/users/{username}/heatmap": {"get": {"operationId": "userGetHeatmapData"}},
+    "/repos/{owner}/{repo}/times": {"get": {"operationId": "repoTrackedTimes"}},
+    "/repos/{owner}/{repo}/issues/{index}/stopwatch/start": {"post": {"operationId": "issueStartStopWatch"}},
+    "/user/stopwatches": {"get": {"operationId": "userGetStopWatches"}},
+    "/repos/{owner}/{repo}/releases/{id}/assets": {
+      "get": {"operationId": "repoListReleaseAttachments"},
+      "post": {"operationId": "repoCreateReleaseAttachment"}
+    }
+  }
+}`
+
+func TestFilterSwaggerSpec(t *testing.T) {
+	defer func(appURL string, timetracking, heatmap, attachments bool) {
+		setting.AppURL = appURL
+		setting.Service.EnableTimetracking = timetracking
+		setting.Service.EnableUserHeatmap = heatmap
+		setting.Attachment.Enabled = attachments
+	}(setting.AppURL, setting.Service.EnableTimetracking, setting.Service.EnableUserHeatmap, setting.Attachment.Enabled)
+	setting.AppURL = "https://try.gitea.io/"
+
+	filter := func() map[string]interface{} {
+		spec, err := filterSwaggerSpec([]byte(testSwaggerSpec))
+		assert.NoError(t, err)
+		var doc map[string]interface{}
+		assert.NoError(t, json.Unmarshal(spec, &doc))
+		return doc
+	}
+
+	setting.Service.EnableTimetracking = true
+	setting.Service.EnableUserHeatmap = true
+	setting.Attachment.Enabled = true
+	doc := filter()
+	assert.Len(t, doc["paths"], 6)
+	assert.Nil(t, doc["x-gitea-disabled-features"])
+	assert.Equal(t, "try.gitea.io", doc["host"])
+	assert.Equal(t, []interface{}{"https"}, doc["schemes"])
+	assert.Equal(t, "/api/v1", doc["basePath"])
+
+	setting.Service.EnableTimetracking = false
+	setting.Service.EnableUserHeatmap = false
+	setting.Attachment.Enabled = false
+	doc = filter()
+	paths := doc["paths"].(map[string]interface{})
+	assert.Contains(t, paths, "/version")
+	assert.NotContains(t, paths, "/users/{username}/heatmap")
+	assert.NotContains(t, paths, "/repos/{owner}/{repo}/times")
+	assert.NotContains(t, paths, "/repos/{owner}/{repo}/issues/{index}/stopwatch/start")
+	assert.NotContains(t, paths, "/user/stopwatches")
+	// only uploading release attachments is disabled
+	assets := paths["/repos/{owner}/{repo}/releases/{id}/assets"].(map[string]interface{})
+	assert.Contains(t, assets, "get")
+	assert.NotContains(t, assets, "post")
+	assert.Equal(t, []interface{}{"timetracking", "user-heatmap", "attachments"}, doc["x-gitea-disabled-features"])
+}